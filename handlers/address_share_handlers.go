@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"anonymail/models"
+	"anonymail/services"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func GetAddressShares(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		addressID, ok := parseIDParam(c)
+		if !ok {
+			return
+		}
+
+		user := c.MustGet("user").(models.User)
+		shares, err := services.ListAddressShares(db, user.ID, addressID)
+		if err != nil {
+			respondAddressShareError(c, err, "Failed to retrieve shares")
+			return
+		}
+
+		response := make([]addressShareResponse, 0, len(shares))
+		for _, share := range shares {
+			response = append(response, newAddressShareResponse(share))
+		}
+		c.JSON(http.StatusOK, gin.H{"shares": response})
+	}
+}
+
+// 共享地址给其他用户，已经共享过时更新权限
+func ShareAddress(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		addressID, ok := parseIDParam(c)
+		if !ok {
+			return
+		}
+		var shareData struct {
+			Username   string `json:"username" binding:"required"`
+			Permission string `json:"permission"`
+		}
+		if err := c.ShouldBindJSON(&shareData); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if shareData.Permission == "" {
+			shareData.Permission = models.SharePermissionView
+		}
+
+		user := c.MustGet("user").(models.User)
+		share, previous, err := services.ShareAddress(db, user.ID, addressID, shareData.Username, shareData.Permission)
+		if err != nil {
+			respondAddressShareError(c, err, "Failed to share address")
+			return
+		}
+
+		log.Printf("Address %d shared with user %d (%s) by user %d", addressID, share.UserID, share.Permission, user.ID)
+		entry := services.AuditEntry{
+			Action:     models.AuditAddressShared,
+			TargetType: "address",
+			TargetID:   addressID,
+			After:      gin.H{"user_id": share.UserID, "permission": share.Permission},
+		}
+		if previous != "" {
+			entry.Before = gin.H{"user_id": share.UserID, "permission": previous}
+		}
+		recordAudit(c, db, entry)
+		c.JSON(http.StatusOK, gin.H{"message": "Address shared successfully"})
+	}
+}
+
+// 所有者撤销共享，或被共享的用户移除自己
+func RevokeAddressShare(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		addressID, ok := parseIDParam(c)
+		if !ok {
+			return
+		}
+		userID, ok := parseUserIDParam(c)
+		if !ok {
+			return
+		}
+
+		user := c.MustGet("user").(models.User)
+		share, err := services.RevokeAddressShare(db, user.ID, addressID, userID)
+		if err != nil {
+			respondAddressShareError(c, err, "Failed to revoke share")
+			return
+		}
+
+		log.Printf("Share of address %d with user %d revoked by user %d", addressID, userID, user.ID)
+		recordAudit(c, db, services.AuditEntry{
+			Action:     models.AuditAddressUnshared,
+			TargetType: "address",
+			TargetID:   addressID,
+			Before:     gin.H{"user_id": userID, "permission": share.Permission},
+		})
+		c.JSON(http.StatusOK, gin.H{"message": "Share revoked successfully"})
+	}
+}
+
+func respondAddressShareError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Address not found"})
+	case errors.Is(err, services.ErrShareUserNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	case errors.Is(err, services.ErrInvalidSharePermission), errors.Is(err, services.ErrShareWithSelf):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrAddressNotEditable):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	default:
+		log.Printf("%s: %v", message, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
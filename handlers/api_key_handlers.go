@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"anonymail/models"
+	"anonymail/services"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func GetAPIKeys(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userInterface, _ := c.Get("user")
+		user := userInterface.(models.User)
+
+		keys, err := services.ListAPIKeys(db, user.ID)
+		if err != nil {
+			log.Printf("Failed to retrieve API keys for user %d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve API keys"})
+			return
+		}
+
+		response := make([]apiKeyResponse, 0, len(keys))
+		for _, key := range keys {
+			response = append(response, newAPIKeyResponse(key))
+		}
+		c.JSON(http.StatusOK, gin.H{"api_keys": response})
+	}
+}
+
+func CreateAPIKey(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var keyData struct {
+			Name       string     `json:"name" binding:"required"`
+			Scopes     []string   `json:"scopes" binding:"required"`
+			AllowedIPs []string   `json:"allowed_ips"`
+			ExpiresAt  *time.Time `json:"expires_at"`
+		}
+		if err := c.ShouldBindJSON(&keyData); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if keyData.ExpiresAt != nil && keyData.ExpiresAt.Before(time.Now()) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Expiry must be in the future"})
+			return
+		}
+
+		userInterface, _ := c.Get("user")
+		user := userInterface.(models.User)
+
+		key, apiKey, err := services.CreateAPIKey(db, user, services.APIKeyOptions{
+			Name:       keyData.Name,
+			Scopes:     keyData.Scopes,
+			AllowedIPs: keyData.AllowedIPs,
+			ExpiresAt:  keyData.ExpiresAt,
+		})
+		if err != nil {
+			if errors.Is(err, services.ErrInvalidScope) || errors.Is(err, services.ErrInvalidIP) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			log.Printf("Failed to create API key for user %d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+			return
+		}
+
+		log.Printf("API key %d created for user %d", apiKey.ID, user.ID)
+		recordAudit(c, db, services.AuditEntry{
+			Action:     models.AuditAPIKeyCreated,
+			TargetType: "api_key",
+			TargetID:   apiKey.ID,
+			After:      gin.H{"name": apiKey.Name, "prefix": apiKey.Prefix, "scopes": keyData.Scopes},
+		})
+		c.JSON(http.StatusOK, gin.H{
+			"message": "API key created successfully",
+			"key":     key,
+			"api_key": newAPIKeyResponse(apiKey),
+		})
+	}
+}
+
+func RevokeAPIKey(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keyID, ok := parseIDParam(c)
+		if !ok {
+			return
+		}
+
+		userInterface, _ := c.Get("user")
+		user := userInterface.(models.User)
+
+		if err := services.RevokeAPIKey(db, user.ID, keyID); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+				return
+			}
+			log.Printf("Failed to revoke API key %d for user %d: %v", keyID, user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+			return
+		}
+
+		log.Printf("API key %d revoked for user %d", keyID, user.ID)
+		recordAudit(c, db, services.AuditEntry{Action: models.AuditAPIKeyRevoked, TargetType: "api_key", TargetID: keyID})
+		c.JSON(http.StatusOK, gin.H{"message": "API key revoked successfully"})
+	}
+}
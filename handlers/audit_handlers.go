@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"anonymail/models"
+	"anonymail/services"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// 记录审计事件，执行者默认是当前登录用户，涉及的账户默认是执行者本人
+// 写入失败只记录日志，不影响请求本身
+func recordAudit(c *gin.Context, db *gorm.DB, entry services.AuditEntry) {
+	if value, ok := c.Get("user"); ok && entry.ActorID == 0 {
+		actor := value.(models.User)
+		entry.ActorID = actor.ID
+		entry.ActorName = actor.Username
+	}
+	if entry.UserID == 0 {
+		entry.UserID = entry.ActorID
+	}
+	entry.IP = c.ClientIP()
+	entry.UserAgent = c.Request.UserAgent()
+	entry.RequestID = c.GetString("request_id")
+	if _, err := services.RecordAuditEvent(db, entry); err != nil {
+		log.Printf("Failed to record audit event %s: %v", entry.Action, err)
+	}
+}
+
+// 管理员查询审计日志，可以按执行者、涉及的账户、事件类型、请求 ID 和时间范围筛选
+func GetAuditEvents(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var query struct {
+			ActorID   uint   `form:"actor_id"`
+			UserID    uint   `form:"user_id"`
+			Action    string `form:"action"`
+			RequestID string `form:"request_id"`
+			Since     string `form:"since"`
+			Until     string `form:"until"`
+			Page      int    `form:"page"`
+			PageSize  int    `form:"page_size"`
+		}
+		if err := c.ShouldBindQuery(&query); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		since, ok := parseTimeQuery(c, "since", query.Since)
+		if !ok {
+			return
+		}
+		until, ok := parseTimeQuery(c, "until", query.Until)
+		if !ok {
+			return
+		}
+
+		auditQuery := services.AuditQuery{
+			ActorID:   query.ActorID,
+			UserID:    query.UserID,
+			Action:    query.Action,
+			RequestID: query.RequestID,
+			Since:     since,
+			Until:     until,
+			Page:      query.Page,
+			PageSize:  query.PageSize,
+		}.Normalized()
+		events, total, err := services.ListAuditEvents(db, auditQuery)
+		if err != nil {
+			log.Printf("Failed to retrieve audit events: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve audit events"})
+			return
+		}
+
+		response := make([]auditEventResponse, 0, len(events))
+		for _, event := range events {
+			response = append(response, newAuditEventResponse(event))
+		}
+		c.JSON(http.StatusOK, gin.H{"events": response, "total": total, "page": auditQuery.Page, "page_size": auditQuery.PageSize})
+	}
+}
+
+func VerifyAuditLog(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		result, err := services.VerifyAuditLog(db)
+		if err != nil {
+			log.Printf("Failed to verify audit log: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify audit log"})
+			return
+		}
+		if !result.Valid {
+			log.Printf("Audit log hash chain is broken at event %d", result.BrokenAt)
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"valid":     result.Valid,
+			"checked":   result.Checked,
+			"broken_at": result.BrokenAt,
+			"last_hash": result.LastHash,
+		})
+	}
+}
+
+// 当前用户账户的活动，包括管理员对该账户的操作
+func GetAccountActivity(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var query struct {
+			Page     int `form:"page"`
+			PageSize int `form:"page_size"`
+		}
+		if err := c.ShouldBindQuery(&query); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		user := c.MustGet("user").(models.User)
+		auditQuery := services.AuditQuery{UserID: user.ID, Page: query.Page, PageSize: query.PageSize}.Normalized()
+		events, total, err := services.ListAuditEvents(db, auditQuery)
+		if err != nil {
+			log.Printf("Failed to retrieve activity for user %d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve activity"})
+			return
+		}
+
+		response := make([]accountActivityResponse, 0, len(events))
+		for _, event := range events {
+			response = append(response, newAccountActivityResponse(event, user.ID))
+		}
+		c.JSON(http.StatusOK, gin.H{"events": response, "total": total, "page": auditQuery.Page, "page_size": auditQuery.PageSize})
+	}
+}
+
+func parseTimeQuery(c *gin.Context, name string, value string) (*time.Time, bool) {
+	if value == "" {
+		return nil, true
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + name + ", expected RFC 3339 time"})
+		return nil, false
+	}
+	return &parsed, true
+}
@@ -1,8 +1,10 @@
 package handlers
 
 import (
+	"errors"
 	"log"
 	"net/http"
+	"strconv"
 
 	"anonymail/models"
 	"anonymail/services"
@@ -14,8 +16,9 @@ import (
 func GenerateAddress(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req struct {
-			RealAddress string `json:"real_address"`
-			TokenID     uint   `json:"token_id"`
+			RealAddress    string `json:"real_address"`
+			TokenID        uint   `json:"token_id"`
+			OrganizationID uint   `json:"organization_id"`
 		}
 		if err := c.ShouldBindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -25,21 +28,41 @@ func GenerateAddress(db *gorm.DB) gin.HandlerFunc {
 		userInterface, _ := c.Get("user")
 		user := userInterface.(models.User)
 
+		// token_id 为空时使用默认 Token，指定 organization_id 时使用组织的 Token
 		var token models.Token
-		if err := db.First(&token, req.TokenID).Error; err != nil {
+		var err error
+		if req.OrganizationID != 0 {
+			if _, err := services.GetOrganizationMembership(db, req.OrganizationID, user.ID, false); err != nil {
+				respondOrganizationError(c, err, "Failed to check organization membership")
+				return
+			}
+			token, err = services.FindOrganizationToken(db, req.OrganizationID, req.TokenID)
+		} else {
+			token, err = services.FindUserToken(db, user.ID, req.TokenID)
+		}
+		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid token"})
 			return
 		}
 
-		convertedAddress, err := services.GenerateEmailAddress(db, user.ID, req.RealAddress, token.Value, token.Description)
+		address, err := services.GenerateEmailAddress(db, user.ID, req.RealAddress, token)
 		if err != nil {
+			if respondQuotaExceeded(c, err) {
+				return
+			}
 			log.Printf("Failed to generate email address for user %d: %v", user.ID, err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate email address"})
 			return
 		}
 
 		log.Printf("Generated email address for user %d", user.ID)
-		c.JSON(http.StatusOK, gin.H{"generated_address": convertedAddress})
+		recordAudit(c, db, services.AuditEntry{
+			Action:     models.AuditAddressCreated,
+			TargetType: "address",
+			TargetID:   address.ID,
+			After:      gin.H{"generated_address": address.GeneratedAddress, "token_id": address.TokenID, "organization_id": address.OrganizationID},
+		})
+		c.JSON(http.StatusOK, gin.H{"generated_address": string(address.ConvertedAddress)})
 	}
 }
 
@@ -48,19 +71,59 @@ func GetTokens(db *gorm.DB) gin.HandlerFunc {
 		userInterface, _ := c.Get("user")
 		user := userInterface.(models.User)
 
-		var tokens []struct {
-			ID          uint
-			Value       string
-			Description string
-		}
-		if err := db.Model(&models.Token{}).Where("user_id = ?", user.ID).Select("id, value, description").Find(&tokens).Error; err != nil {
+		var tokens []models.Token
+		if err := db.Where("user_id = ?", user.ID).Find(&tokens).Error; err != nil {
 			log.Printf("Failed to retrieve tokens for user %d: %v", user.ID, err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve tokens"})
 			return
 		}
 
+		stats, err := services.GetTokenStats(db, tokens, false)
+		if err != nil {
+			log.Printf("Failed to retrieve token stats for user %d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve tokens"})
+			return
+		}
+
+		response := make([]tokenResponse, 0, len(tokens))
+		for _, token := range tokens {
+			item := newTokenResponse(token)
+			item.Stats = newTokenStatsResponse(stats[token.ID])
+			response = append(response, item)
+		}
+
 		log.Printf("Retrieved %d tokens for user %d", len(tokens), user.ID)
-		c.JSON(http.StatusOK, gin.H{"tokens": tokens})
+		c.JSON(http.StatusOK, gin.H{"tokens": response})
+	}
+}
+
+// 每个 Token 的使用统计，包含最近 30 天的每日数据
+func GetTokenStats(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userInterface, _ := c.Get("user")
+		user := userInterface.(models.User)
+
+		var tokens []models.Token
+		if err := db.Where("user_id = ?", user.ID).Find(&tokens).Error; err != nil {
+			log.Printf("Failed to retrieve tokens for user %d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve token stats"})
+			return
+		}
+
+		stats, err := services.GetTokenStats(db, tokens, true)
+		if err != nil {
+			log.Printf("Failed to retrieve token stats for user %d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve token stats"})
+			return
+		}
+
+		response := make([]*tokenStatsResponse, 0, len(tokens))
+		for _, token := range tokens {
+			item := newTokenStatsResponse(stats[token.ID])
+			item.Description = token.Description
+			response = append(response, item)
+		}
+		c.JSON(http.StatusOK, gin.H{"stats": response})
 	}
 }
 
@@ -69,6 +132,7 @@ func AddToken(db *gorm.DB) gin.HandlerFunc {
 		var tokenData struct {
 			Value       string `json:"value" binding:"required"`
 			Description string `json:"description"`
+			IsDefault   bool   `json:"is_default"`
 		}
 		if err := c.ShouldBindJSON(&tokenData); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -80,40 +144,257 @@ func AddToken(db *gorm.DB) gin.HandlerFunc {
 
 		token := models.Token{
 			UserID:      user.ID,
-			Value:       tokenData.Value,
+			Value:       models.EncryptedString(tokenData.Value),
 			Description: tokenData.Description,
 			IsDefault:   false,
 		}
 
-		if err := db.Create(&token).Error; err != nil {
-			log.Printf("Failed to add token for user %d: %v", user.ID, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add token"})
+		if err := services.CreateTokenWithinQuota(db, &token); err != nil {
+			if !respondQuotaExceeded(c, err) {
+				log.Printf("Failed to add token for user %d: %v", user.ID, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add token"})
+			}
 			return
 		}
 
+		// 第一个 Token 自动成为默认 Token
+		var err error
+		if tokenData.IsDefault {
+			err = services.SetDefaultToken(db, user.ID, token.ID)
+		} else {
+			err = services.EnsureDefaultToken(db, user.ID)
+		}
+		if err != nil {
+			log.Printf("Failed to update default token for user %d: %v", user.ID, err)
+		}
+
 		log.Printf("Token added successfully for user %d", user.ID)
+		recordAudit(c, db, services.AuditEntry{
+			Action:     models.AuditTokenAdded,
+			TargetType: "token",
+			TargetID:   token.ID,
+			After:      gin.H{"description": token.Description, "masked_value": maskSecret(string(token.Value))},
+		})
 		c.JSON(http.StatusOK, gin.H{"message": "Token added successfully"})
 	}
 }
 
+// 查看完整的 Token 值前需要重新输入密码
+func RevealToken(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenID, ok := parseIDParam(c)
+		if !ok {
+			return
+		}
+		var reauthData struct {
+			Password string `json:"password"`
+		}
+		if err := c.ShouldBindJSON(&reauthData); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		userInterface, _ := c.Get("user")
+		user := userInterface.(models.User)
+
+		if !reauthenticate(c, user, reauthData.Password) {
+			log.Printf("Token reveal re-authentication failed for user %d", user.ID)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Re-authentication failed"})
+			return
+		}
+
+		var token models.Token
+		if err := db.Where("id = ? AND user_id = ?", tokenID, user.ID).First(&token).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+			return
+		}
+
+		log.Printf("Token %d revealed for user %d", tokenID, user.ID)
+		recordAudit(c, db, services.AuditEntry{Action: models.AuditTokenRevealed, TargetType: "token", TargetID: token.ID})
+		c.JSON(http.StatusOK, gin.H{"value": token.Value})
+	}
+}
+
 func DeleteToken(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		tokenID := c.Param("id")
+		tokenID, ok := parseIDParam(c)
+		if !ok {
+			return
+		}
 
 		userInterface, _ := c.Get("user")
 		user := userInterface.(models.User)
 
-		if err := db.Where("id = ? AND user_id = ?", tokenID, user.ID).Delete(&models.Token{}).Error; err != nil {
-			log.Printf("Failed to delete token %s for user %d: %v", tokenID, user.ID, err)
+		result := db.Where("id = ? AND user_id = ?", tokenID, user.ID).Delete(&models.Token{})
+		if result.Error != nil {
+			log.Printf("Failed to delete token %d for user %d: %v", tokenID, user.ID, result.Error)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete token"})
 			return
 		}
+		if result.RowsAffected == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+			return
+		}
+
+		if err := services.EnsureDefaultToken(db, user.ID); err != nil {
+			log.Printf("Failed to update default token for user %d: %v", user.ID, err)
+		}
 
-		log.Printf("Token %s deleted successfully for user %d", tokenID, user.ID)
+		log.Printf("Token %d deleted successfully for user %d", tokenID, user.ID)
+		recordAudit(c, db, services.AuditEntry{Action: models.AuditTokenDeleted, TargetType: "token", TargetID: tokenID})
 		c.JSON(http.StatusOK, gin.H{"message": "Token deleted successfully"})
 	}
 }
 
+func SetDefaultToken(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenID, ok := parseIDParam(c)
+		if !ok {
+			return
+		}
+
+		userInterface, _ := c.Get("user")
+		user := userInterface.(models.User)
+
+		if err := services.SetDefaultToken(db, user.ID, tokenID); err != nil {
+			respondTokenError(c, err, "Failed to set default token")
+			return
+		}
+
+		log.Printf("Token %d set as default for user %d", tokenID, user.ID)
+		c.JSON(http.StatusOK, gin.H{"message": "Default token updated successfully"})
+	}
+}
+
+func UpdateToken(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenID, ok := parseIDParam(c)
+		if !ok {
+			return
+		}
+		var tokenData struct {
+			Description string `json:"description"`
+		}
+		if err := c.ShouldBindJSON(&tokenData); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		userInterface, _ := c.Get("user")
+		user := userInterface.(models.User)
+
+		count, err := services.RenameToken(db, user.ID, tokenID, tokenData.Description)
+		if err != nil {
+			respondTokenError(c, err, "Failed to update token")
+			return
+		}
+
+		log.Printf("Token %d updated for user %d (%d addresses)", tokenID, user.ID, count)
+		c.JSON(http.StatusOK, gin.H{"message": "Token updated successfully"})
+	}
+}
+
+func ReplaceToken(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenID, ok := parseIDParam(c)
+		if !ok {
+			return
+		}
+		var tokenData struct {
+			Value string `json:"value" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&tokenData); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		userInterface, _ := c.Get("user")
+		user := userInterface.(models.User)
+
+		count, err := services.ReplaceTokenValue(db, user.ID, tokenID, tokenData.Value)
+		if err != nil {
+			respondTokenError(c, err, "Failed to replace token")
+			return
+		}
+
+		log.Printf("Token %d replaced for user %d (%d addresses)", tokenID, user.ID, count)
+		recordAudit(c, db, services.AuditEntry{
+			Action:     models.AuditTokenReplaced,
+			TargetType: "token",
+			TargetID:   tokenID,
+			After:      gin.H{"masked_value": maskSecret(tokenData.Value)},
+		})
+		c.JSON(http.StatusOK, gin.H{"message": "Token replaced successfully"})
+	}
+}
+
+func GetTokenHistory(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenID, ok := parseIDParam(c)
+		if !ok {
+			return
+		}
+
+		userInterface, _ := c.Get("user")
+		user := userInterface.(models.User)
+
+		if _, err := services.FindUserToken(db, user.ID, tokenID); err != nil {
+			respondTokenError(c, err, "Failed to retrieve token history")
+			return
+		}
+
+		var revisions []models.TokenRevision
+		if err := db.Where("token_id = ? AND user_id = ?", tokenID, user.ID).Order("id DESC").Find(&revisions).Error; err != nil {
+			log.Printf("Failed to retrieve history of token %d for user %d: %v", tokenID, user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve token history"})
+			return
+		}
+
+		response := make([]tokenRevisionResponse, 0, len(revisions))
+		for _, revision := range revisions {
+			response = append(response, newTokenRevisionResponse(revision))
+		}
+		c.JSON(http.StatusOK, gin.H{"history": response})
+	}
+}
+
+func ReassignTokenAddresses(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			FromTokenID uint `json:"from_token_id" binding:"required"`
+			ToTokenID   uint `json:"to_token_id" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		userInterface, _ := c.Get("user")
+		user := userInterface.(models.User)
+
+		count, err := services.ReassignTokenAddresses(db, user.ID, req.FromTokenID, req.ToTokenID)
+		if err != nil {
+			respondTokenError(c, err, "Failed to reassign addresses")
+			return
+		}
+
+		log.Printf("Reassigned %d addresses from token %d to token %d for user %d", count, req.FromTokenID, req.ToTokenID, user.ID)
+		c.JSON(http.StatusOK, gin.H{"message": "Addresses reassigned successfully", "count": count})
+	}
+}
+
+func respondTokenError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+	case errors.Is(err, services.ErrSameToken):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		log.Printf("%s: %v", message, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
+
 func GetAddresses(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userInterface, exists := c.Get("user")
@@ -134,14 +415,33 @@ func GetAddresses(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		log.Printf("Retrieved %d addresses for user %d", len(addresses), user.ID)
-		c.JSON(http.StatusOK, gin.H{"addresses": addresses})
+		response := make([]addressResponse, 0, len(addresses))
+		for _, address := range addresses {
+			response = append(response, newAddressResponse(address))
+		}
+
+		shared, err := services.ListSharedAddresses(db, user.ID)
+		if err != nil {
+			log.Printf("Failed to retrieve shared addresses for user %d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve addresses"})
+			return
+		}
+		sharedResponse := make([]addressResponse, 0, len(shared))
+		for _, item := range shared {
+			sharedResponse = append(sharedResponse, newSharedAddressResponse(item))
+		}
+
+		log.Printf("Retrieved %d addresses and %d shared addresses for user %d", len(addresses), len(shared), user.ID)
+		c.JSON(http.StatusOK, gin.H{"addresses": response, "shared_with_me": sharedResponse})
 	}
 }
 
 func DeleteAddress(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		addressID := c.Param("id")
+		addressID, ok := parseIDParam(c)
+		if !ok {
+			return
+		}
 
 		userInterface, exists := c.Get("user")
 		if !exists {
@@ -154,24 +454,59 @@ func DeleteAddress(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		var address models.Address
-		if err := db.Where("id = ? AND user_id = ?", addressID, user.ID).First(&address).Error; err != nil {
-			log.Printf("Address %s not found for user %d", addressID, user.ID)
-			c.JSON(http.StatusNotFound, gin.H{"error": "Address not found"})
+		// 只有所有者可以删除地址，共享记录一并删除
+		if err := services.DeleteUserAddress(db, user.ID, addressID); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				log.Printf("Address %d not found for user %d", addressID, user.ID)
+				c.JSON(http.StatusNotFound, gin.H{"error": "Address not found"})
+				return
+			}
+			log.Printf("Failed to delete address %d for user %d: %v", addressID, user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete address"})
 			return
 		}
 
-		if err := db.Delete(&address).Error; err != nil {
-			log.Printf("Failed to delete address %s for user %d: %v", addressID, user.ID, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete address"})
+		log.Printf("Address %d deleted successfully for user %d", addressID, user.ID)
+		recordAudit(c, db, services.AuditEntry{Action: models.AuditAddressDeleted, TargetType: "address", TargetID: addressID})
+		c.JSON(http.StatusOK, gin.H{"message": "Address deleted successfully"})
+	}
+}
+
+// 修改地址转发到的真实地址，所有者和拥有编辑权限的共享用户可以修改
+func UpdateAddress(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		addressID, ok := parseIDParam(c)
+		if !ok {
+			return
+		}
+		var req struct {
+			RealAddress string `json:"real_address"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		log.Printf("Address %s deleted successfully for user %d", addressID, user.ID)
-		c.JSON(http.StatusOK, gin.H{"message": "Address deleted successfully"})
+		user := c.MustGet("user").(models.User)
+		address, err := services.UpdateAddressRecipient(db, user.ID, addressID, req.RealAddress)
+		if err != nil {
+			respondAddressShareError(c, err, "Failed to update address")
+			return
+		}
+
+		log.Printf("Address %d updated by user %d", addressID, user.ID)
+		recordAudit(c, db, services.AuditEntry{
+			Action:     models.AuditAddressUpdated,
+			TargetType: "address",
+			TargetID:   addressID,
+			UserID:     address.UserID,
+			After:      gin.H{"generated_address": address.GeneratedAddress},
+		})
+		c.JSON(http.StatusOK, gin.H{"message": "Address updated successfully", "converted_address": string(address.ConvertedAddress)})
 	}
 }
 
+// 旧接口：保存一个 DuckDuckGo Token 并设为默认
 func SaveToken(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var tokenData struct {
@@ -185,23 +520,54 @@ func SaveToken(db *gorm.DB) gin.HandlerFunc {
 		userInterface, _ := c.Get("user")
 		user := userInterface.(models.User)
 
-		user.Token = tokenData.Token
-		if err := db.Save(&user).Error; err != nil {
-			log.Printf("Failed to save token for user %d: %v", user.ID, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save token"})
+		token := models.Token{
+			UserID: user.ID,
+			Value:  models.EncryptedString(tokenData.Token),
+		}
+		if err := services.CreateTokenWithinQuota(db, &token); err != nil {
+			if !respondQuotaExceeded(c, err) {
+				log.Printf("Failed to save token for user %d: %v", user.ID, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save token"})
+			}
 			return
 		}
+		if err := services.SetDefaultToken(db, user.ID, token.ID); err != nil {
+			log.Printf("Failed to set default token for user %d: %v", user.ID, err)
+		}
 
 		log.Printf("Token saved successfully for user %d", user.ID)
+		recordAudit(c, db, services.AuditEntry{
+			Action:     models.AuditTokenAdded,
+			TargetType: "token",
+			TargetID:   token.ID,
+			After:      gin.H{"masked_value": maskSecret(string(token.Value))},
+		})
 		c.JSON(http.StatusOK, gin.H{"message": "Token saved successfully"})
 	}
 }
 
+// 旧接口：返回默认 DuckDuckGo Token（已遮盖）
 func GetToken(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userInterface, _ := c.Get("user")
 		user := userInterface.(models.User)
 
-		c.JSON(http.StatusOK, gin.H{"token": user.Token})
+		token, err := services.FindUserToken(db, user.ID, 0)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{"token": ""})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"token": maskSecret(string(token.Value))})
+	}
+}
+
+// 解析路径中的 :id 参数，失败时直接返回 400
+func parseIDParam(c *gin.Context) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return 0, false
 	}
+	return uint(id), true
 }
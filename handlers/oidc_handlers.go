@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+
+	"anonymail/models"
+	"anonymail/services"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const oidcStateCookie = "oidc_state"
+
+// 登录页面根据可用的登录方式显示对应的按钮
+func GetAuthProviders(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		registrationMode, err := services.GetRegistrationMode(db)
+		if err != nil {
+			log.Printf("Failed to read registration mode: %v", err)
+			registrationMode = services.RegistrationClosed
+		}
+		if services.PasswordLoginDisabled() {
+			registrationMode = services.RegistrationClosed
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"registration":   registrationMode,
+			"password_login": !services.PasswordLoginDisabled() || services.LDAPEnabled(),
+			"ldap":           services.LDAPEnabled(),
+			"proxy":          services.ProxyAuthEnabled(),
+			"oidc":           services.OIDCEnabled(),
+			"oidc_name":      services.OIDCDisplayName(),
+		})
+	}
+}
+
+// 跳转到身份提供方登录，state 同时写入 Cookie，防止回调被他人伪造
+func OIDCLogin(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !services.OIDCEnabled() {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Single sign-on is not configured"})
+			return
+		}
+
+		authURL, state, err := services.BeginOIDCLogin(db, services.OIDCRedirectURL())
+		if err != nil {
+			log.Printf("Failed to start single sign-on: %v", err)
+			redirectSSOError(c, "Failed to start single sign-on")
+			return
+		}
+
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(oidcStateCookie, state, 600, "/oidc", "", c.Request.TLS != nil, true)
+		c.Redirect(http.StatusFound, authURL)
+	}
+}
+
+// 身份提供方回调，登录成功后通过 URL 片段把一次性登录凭证交给前端
+func OIDCCallback(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if providerError := c.Query("error"); providerError != "" {
+			log.Printf("Identity provider returned error: %s %s", providerError, c.Query("error_description"))
+			recordLoginFailure(c, db, "", "oidc")
+			redirectSSOError(c, "Single sign-on was cancelled or denied")
+			return
+		}
+
+		state := c.Query("state")
+		cookieState, err := c.Cookie(oidcStateCookie)
+		c.SetCookie(oidcStateCookie, "", -1, "/oidc", "", c.Request.TLS != nil, true)
+		if err != nil || state == "" || cookieState != state {
+			log.Printf("Single sign-on callback with mismatched state")
+			recordLoginFailure(c, db, "", "oidc")
+			redirectSSOError(c, "Single sign-on failed, please try again")
+			return
+		}
+
+		user, err := services.CompleteOIDCLogin(db, state, c.Query("code"))
+		if errors.Is(err, services.ErrRegistrationClosed) {
+			log.Printf("Single sign-on for unknown user rejected, registration is closed")
+			recordLoginFailure(c, db, "", "oidc")
+			redirectSSOError(c, "No account exists for this user and registration is closed")
+			return
+		}
+		if errors.Is(err, services.ErrUsernameTaken) {
+			log.Printf("Single sign-on username conflicts with an existing account: %v", err)
+			recordLoginFailure(c, db, "", "oidc")
+			redirectSSOError(c, "Username is already used by another account")
+			return
+		}
+		if err != nil {
+			log.Printf("Single sign-on failed: %v", err)
+			recordLoginFailure(c, db, "", "oidc")
+			redirectSSOError(c, "Single sign-on failed, please try again")
+			return
+		}
+
+		loginToken, err := services.CreateLoginChallenge(db, user.ID, models.LoginChallengeSSO)
+		if err != nil {
+			log.Printf("Error creating login challenge: %v", err)
+			redirectSSOError(c, "Single sign-on failed, please try again")
+			return
+		}
+
+		log.Printf("Single sign-on succeeded for user: %s", user.Username)
+		c.Redirect(http.StatusFound, "/#sso_token="+url.QueryEscape(loginToken))
+	}
+}
+
+// 前端用一次性登录凭证换取会话
+func SSOLogin(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var ssoData struct {
+			SSOToken string `json:"sso_token" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&ssoData); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		challenge, user, err := services.FindLoginChallenge(db, ssoData.SSOToken, models.LoginChallengeSSO)
+		if err != nil {
+			log.Printf("Invalid single sign-on token: %v", err)
+			recordLoginFailure(c, db, "", "sso_token")
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Login expired, please sign in again"})
+			return
+		}
+		if err := services.CompleteLoginChallenge(db, challenge); err != nil {
+			log.Printf("Error completing login challenge: %v", err)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Login expired, please sign in again"})
+			return
+		}
+
+		respondLoginSuccess(c, db, user)
+	}
+}
+
+// 反向代理已经认证过用户时，前端无需再次登录即可换取会话
+func ProxyLogin(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !services.ProxyAuthEnabled() {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Proxy authentication is not configured"})
+			return
+		}
+
+		username, groups, ok := services.ProxyIdentity(c.Request)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Request was not authenticated by a trusted proxy"})
+			return
+		}
+
+		user, err := services.ProxyAuthLogin(db, username, groups)
+		if errors.Is(err, services.ErrRegistrationClosed) {
+			log.Printf("Proxy login for unknown user %s rejected, registration is closed", username)
+			recordLoginFailure(c, db, username, "proxy")
+			c.JSON(http.StatusForbidden, gin.H{"error": "No account exists for this user and registration is closed"})
+			return
+		}
+		if errors.Is(err, services.ErrUsernameTaken) {
+			log.Printf("Proxy username conflicts with an existing account: %s", username)
+			recordLoginFailure(c, db, username, "proxy")
+			c.JSON(http.StatusConflict, gin.H{"error": "Username is already used by another account"})
+			return
+		}
+		if err != nil {
+			log.Printf("Proxy authentication failed for %s: %v", username, err)
+			recordLoginFailure(c, db, username, "proxy")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Proxy authentication failed"})
+			return
+		}
+
+		respondLoginSuccess(c, db, user)
+	}
+}
+
+func redirectSSOError(c *gin.Context, message string) {
+	c.Redirect(http.StatusFound, "/#sso_error="+url.QueryEscape(message))
+}
+
+// 只有 TRUSTED_PROXIES 中的反向代理转发的 X-Forwarded-Proto 才会被采用
+func requestBaseURL(c *gin.Context) string {
+	scheme := "http"
+	_, trusted := c.RemoteIP()
+	if c.Request.TLS != nil || (trusted && c.GetHeader("X-Forwarded-Proto") == "https") {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host
+}
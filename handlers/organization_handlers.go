@@ -0,0 +1,411 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"anonymail/models"
+	"anonymail/services"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func GetOrganizations(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(models.User)
+
+		memberships, err := services.ListUserOrganizations(db, user.ID)
+		if err != nil {
+			log.Printf("Failed to retrieve organizations for user %d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve organizations"})
+			return
+		}
+
+		response := make([]organizationResponse, 0, len(memberships))
+		for _, membership := range memberships {
+			response = append(response, newOrganizationResponse(membership.Organization, membership.Role))
+		}
+		c.JSON(http.StatusOK, gin.H{"organizations": response})
+	}
+}
+
+func CreateOrganization(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var organizationData struct {
+			Name string `json:"name" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&organizationData); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		user := c.MustGet("user").(models.User)
+		organization, err := services.CreateOrganization(db, user, organizationData.Name)
+		if err != nil {
+			if errors.Is(err, services.ErrInvalidOrganizationName) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			log.Printf("Failed to create organization for user %d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create organization"})
+			return
+		}
+
+		log.Printf("Organization %d created by user %d", organization.ID, user.ID)
+		recordAudit(c, db, services.AuditEntry{
+			Action:     models.AuditOrgCreated,
+			TargetType: "organization",
+			TargetID:   organization.ID,
+			After:      gin.H{"name": organization.Name},
+		})
+		c.JSON(http.StatusOK, gin.H{"organization": newOrganizationResponse(organization, models.OrganizationRoleOwner)})
+	}
+}
+
+func DeleteOrganization(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		member, ok := requireOrganizationMember(c, db, true)
+		if !ok {
+			return
+		}
+
+		if err := services.DeleteOrganization(db, member.OrganizationID); err != nil {
+			respondOrganizationError(c, err, "Failed to delete organization")
+			return
+		}
+
+		log.Printf("Organization %d deleted by user %d", member.OrganizationID, member.UserID)
+		recordAudit(c, db, services.AuditEntry{Action: models.AuditOrgDeleted, TargetType: "organization", TargetID: member.OrganizationID})
+		c.JSON(http.StatusOK, gin.H{"message": "Organization deleted successfully"})
+	}
+}
+
+func GetOrganizationMembers(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		member, ok := requireOrganizationMember(c, db, false)
+		if !ok {
+			return
+		}
+
+		members, err := services.ListOrganizationMembers(db, member.OrganizationID)
+		if err != nil {
+			respondOrganizationError(c, err, "Failed to retrieve members")
+			return
+		}
+
+		response := make([]organizationMemberResponse, 0, len(members))
+		for _, info := range members {
+			response = append(response, newOrganizationMemberResponse(info))
+		}
+		c.JSON(http.StatusOK, gin.H{"members": response})
+	}
+}
+
+func AddOrganizationMember(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		owner, ok := requireOrganizationMember(c, db, true)
+		if !ok {
+			return
+		}
+		var memberData struct {
+			Username string `json:"username" binding:"required"`
+			Role     string `json:"role"`
+		}
+		if err := c.ShouldBindJSON(&memberData); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if memberData.Role == "" {
+			memberData.Role = models.OrganizationRoleMember
+		}
+
+		member, err := services.AddOrganizationMember(db, owner.OrganizationID, memberData.Username, memberData.Role)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+				return
+			}
+			respondOrganizationError(c, err, "Failed to add member")
+			return
+		}
+
+		log.Printf("User %d added to organization %d by user %d", member.UserID, owner.OrganizationID, owner.UserID)
+		recordAudit(c, db, services.AuditEntry{
+			Action:     models.AuditOrgMemberAdded,
+			TargetType: "organization",
+			TargetID:   owner.OrganizationID,
+			UserID:     member.UserID,
+			After:      gin.H{"user_id": member.UserID, "role": member.Role},
+		})
+		c.JSON(http.StatusOK, gin.H{"message": "Member added successfully"})
+	}
+}
+
+func UpdateOrganizationMember(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		owner, ok := requireOrganizationMember(c, db, true)
+		if !ok {
+			return
+		}
+		userID, ok := parseUserIDParam(c)
+		if !ok {
+			return
+		}
+		var memberData struct {
+			Role string `json:"role" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&memberData); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		previous, err := services.SetOrganizationMemberRole(db, owner.OrganizationID, userID, memberData.Role)
+		if err != nil {
+			respondOrganizationError(c, err, "Failed to update member")
+			return
+		}
+
+		log.Printf("Role of user %d in organization %d set to %s by user %d", userID, owner.OrganizationID, memberData.Role, owner.UserID)
+		recordAudit(c, db, services.AuditEntry{
+			Action:     models.AuditOrgMemberUpdated,
+			TargetType: "organization",
+			TargetID:   owner.OrganizationID,
+			UserID:     userID,
+			Before:     gin.H{"user_id": userID, "role": previous.Role},
+			After:      gin.H{"user_id": userID, "role": memberData.Role},
+		})
+		c.JSON(http.StatusOK, gin.H{"message": "Member updated successfully"})
+	}
+}
+
+// 所有者可以移除任何成员，普通成员只能退出组织
+func RemoveOrganizationMember(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		member, ok := requireOrganizationMember(c, db, false)
+		if !ok {
+			return
+		}
+		userID, ok := parseUserIDParam(c)
+		if !ok {
+			return
+		}
+		if userID != member.UserID && member.Role != models.OrganizationRoleOwner {
+			respondOrganizationError(c, services.ErrOrganizationOwnerRequired, "Failed to remove member")
+			return
+		}
+
+		removed, err := services.RemoveOrganizationMember(db, member.OrganizationID, userID)
+		if err != nil {
+			respondOrganizationError(c, err, "Failed to remove member")
+			return
+		}
+
+		log.Printf("User %d removed from organization %d by user %d", userID, member.OrganizationID, member.UserID)
+		recordAudit(c, db, services.AuditEntry{
+			Action:     models.AuditOrgMemberRemoved,
+			TargetType: "organization",
+			TargetID:   member.OrganizationID,
+			UserID:     userID,
+			Before:     gin.H{"user_id": userID, "role": removed.Role},
+		})
+		c.JSON(http.StatusOK, gin.H{"message": "Member removed successfully"})
+	}
+}
+
+// 组织 Token 只返回描述，成员和所有者都看不到 Token 的值
+func GetOrganizationTokens(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		member, ok := requireOrganizationMember(c, db, false)
+		if !ok {
+			return
+		}
+
+		tokens, err := services.ListOrganizationTokens(db, member.OrganizationID)
+		if err != nil {
+			respondOrganizationError(c, err, "Failed to retrieve tokens")
+			return
+		}
+
+		response := make([]organizationTokenResponse, 0, len(tokens))
+		for _, token := range tokens {
+			response = append(response, newOrganizationTokenResponse(token))
+		}
+		c.JSON(http.StatusOK, gin.H{"tokens": response})
+	}
+}
+
+func AddOrganizationToken(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		owner, ok := requireOrganizationMember(c, db, true)
+		if !ok {
+			return
+		}
+		var tokenData struct {
+			Value       string `json:"value" binding:"required"`
+			Description string `json:"description"`
+		}
+		if err := c.ShouldBindJSON(&tokenData); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		token, err := services.AddOrganizationToken(db, owner.OrganizationID, tokenData.Value, tokenData.Description)
+		if err != nil {
+			respondOrganizationError(c, err, "Failed to add token")
+			return
+		}
+
+		log.Printf("Token %d added to organization %d by user %d", token.ID, owner.OrganizationID, owner.UserID)
+		recordAudit(c, db, services.AuditEntry{
+			Action:     models.AuditOrgTokenAdded,
+			TargetType: "token",
+			TargetID:   token.ID,
+			After:      gin.H{"organization_id": owner.OrganizationID, "description": token.Description, "masked_value": maskSecret(string(token.Value))},
+		})
+		c.JSON(http.StatusOK, gin.H{"message": "Token added successfully", "token": newOrganizationTokenResponse(token)})
+	}
+}
+
+func SetDefaultOrganizationToken(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		owner, ok := requireOrganizationMember(c, db, true)
+		if !ok {
+			return
+		}
+		tokenID, ok := parseTokenIDParam(c)
+		if !ok {
+			return
+		}
+
+		if err := services.SetDefaultOrganizationToken(db, owner.OrganizationID, tokenID); err != nil {
+			respondOrganizationError(c, err, "Failed to set default token")
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Default token updated successfully"})
+	}
+}
+
+func DeleteOrganizationToken(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		owner, ok := requireOrganizationMember(c, db, true)
+		if !ok {
+			return
+		}
+		tokenID, ok := parseTokenIDParam(c)
+		if !ok {
+			return
+		}
+
+		token, err := services.DeleteOrganizationToken(db, owner.OrganizationID, tokenID)
+		if err != nil {
+			respondOrganizationError(c, err, "Failed to delete token")
+			return
+		}
+
+		log.Printf("Token %d deleted from organization %d by user %d", tokenID, owner.OrganizationID, owner.UserID)
+		recordAudit(c, db, services.AuditEntry{
+			Action:     models.AuditOrgTokenDeleted,
+			TargetType: "token",
+			TargetID:   tokenID,
+			Before:     gin.H{"organization_id": owner.OrganizationID, "description": token.Description, "masked_value": maskSecret(string(token.Value))},
+		})
+		c.JSON(http.StatusOK, gin.H{"message": "Token deleted successfully"})
+	}
+}
+
+func GetOrganizationAddresses(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		member, ok := requireOrganizationMember(c, db, false)
+		if !ok {
+			return
+		}
+
+		addresses, err := services.ListOrganizationAddresses(db, member.OrganizationID)
+		if err != nil {
+			respondOrganizationError(c, err, "Failed to retrieve addresses")
+			return
+		}
+
+		response := make([]addressResponse, 0, len(addresses))
+		for _, address := range addresses {
+			response = append(response, newOrganizationAddressResponse(address, member))
+		}
+		c.JSON(http.StatusOK, gin.H{"addresses": response})
+	}
+}
+
+// 每个成员使用组织 Token 的统计，只有所有者可以查看
+func GetOrganizationUsage(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		owner, ok := requireOrganizationMember(c, db, true)
+		if !ok {
+			return
+		}
+
+		usage, err := services.GetOrganizationMemberUsage(db, owner.OrganizationID)
+		if err != nil {
+			respondOrganizationError(c, err, "Failed to retrieve usage")
+			return
+		}
+		response := make([]organizationUsageResponse, 0, len(usage))
+		for _, stats := range usage {
+			response = append(response, newOrganizationUsageResponse(stats))
+		}
+		c.JSON(http.StatusOK, gin.H{"usage": response})
+	}
+}
+
+// 检查当前用户是否是路径参数 id 指定组织的成员，失败时直接返回错误
+func requireOrganizationMember(c *gin.Context, db *gorm.DB, ownerRequired bool) (models.OrganizationMember, bool) {
+	organizationID, ok := parseIDParam(c)
+	if !ok {
+		return models.OrganizationMember{}, false
+	}
+	user := c.MustGet("user").(models.User)
+
+	member, err := services.GetOrganizationMembership(db, organizationID, user.ID, ownerRequired)
+	if err != nil {
+		respondOrganizationError(c, err, "Failed to check organization membership")
+		return models.OrganizationMember{}, false
+	}
+	return member, true
+}
+
+func parseUserIDParam(c *gin.Context) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("user_id"), 10, 64)
+	if err != nil || id == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return 0, false
+	}
+	return uint(id), true
+}
+
+func parseTokenIDParam(c *gin.Context) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("token_id"), 10, 64)
+	if err != nil || id == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid token ID"})
+		return 0, false
+	}
+	return uint(id), true
+}
+
+func respondOrganizationError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, services.ErrNotOrganizationMember):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+	case errors.Is(err, services.ErrOrganizationOwnerRequired):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrLastOrganizationOwner), errors.Is(err, services.ErrAlreadyOrganizationMember):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrInvalidOrganizationRole):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+	default:
+		log.Printf("%s: %v", message, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
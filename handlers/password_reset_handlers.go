@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+
+	"anonymail/models"
+	"anonymail/services"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// 管理员生成一次性重置密码链接，由用户自己设置新密码
+func CreatePasswordResetLink(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := parseIDParam(c)
+		if !ok {
+			return
+		}
+
+		var user models.User
+		if err := db.First(&user, userID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		admin := c.MustGet("user").(models.User)
+		token, record, err := services.CreatePasswordResetToken(db, user, admin.ID)
+		if errors.Is(err, services.ErrExternalAccount) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Password is managed by the user's identity provider"})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to create password reset link for user %d: %v", userID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create password reset link"})
+			return
+		}
+
+		log.Printf("Password reset link %d for user %d created by user %d", record.ID, userID, admin.ID)
+		c.JSON(http.StatusOK, gin.H{
+			"message":    "Password reset link created successfully",
+			"link":       requestBaseURL(c) + "/#reset_token=" + url.QueryEscape(token),
+			"expires_at": record.ExpiresAt,
+		})
+	}
+}
+
+// 查看用户的重置链接及其使用记录
+func GetPasswordResetLinks(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := parseIDParam(c)
+		if !ok {
+			return
+		}
+
+		tokens, err := services.ListPasswordResetTokens(db, userID)
+		if err != nil {
+			log.Printf("Failed to retrieve password reset links for user %d: %v", userID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve password reset links"})
+			return
+		}
+
+		response := make([]passwordResetLinkResponse, 0, len(tokens))
+		for _, token := range tokens {
+			response = append(response, newPasswordResetLinkResponse(token))
+		}
+		c.JSON(http.StatusOK, gin.H{"links": response})
+	}
+}
+
+// 用户使用重置链接设置新密码
+func RedeemPasswordResetLink(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var resetData struct {
+			Token       string `json:"token" binding:"required"`
+			NewPassword string `json:"new_password" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&resetData); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		user, err := services.RedeemPasswordResetToken(db, resetData.Token, resetData.NewPassword, c.ClientIP(), c.Request.UserAgent())
+		if err != nil {
+			var policyErr *services.PasswordPolicyError
+			switch {
+			case errors.Is(err, services.ErrInvalidResetToken), errors.Is(err, services.ErrExternalAccount):
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			case errors.As(err, &policyErr):
+				c.JSON(http.StatusBadRequest, gin.H{"error": policyErr.Reason})
+			default:
+				log.Printf("Failed to redeem password reset link: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+			}
+			return
+		}
+
+		log.Printf("Password reset link used for user %s from %s", user.Username, c.ClientIP())
+		c.JSON(http.StatusOK, gin.H{"message": "Password reset successfully, please log in with your new password"})
+	}
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"anonymail/models"
+	"anonymail/services"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// 当前用户的配额和用量
+func GetQuota(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(models.User)
+		usage, err := services.GetQuotaUsage(db, user)
+		if err != nil {
+			log.Printf("Failed to retrieve quota for user %d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve quota"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"quota": newQuotaResponse(usage)})
+	}
+}
+
+func GetUserQuota(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := parseIDParam(c)
+		if !ok {
+			return
+		}
+		var user models.User
+		if err := db.First(&user, userID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		usage, err := services.GetQuotaUsage(db, user)
+		if err != nil {
+			log.Printf("Failed to retrieve quota for user %d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve quota"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"quota": newQuotaResponse(usage)})
+	}
+}
+
+// 设置用户的配额，null 或缺少的项使用全局默认值，0 表示不限制
+func SetUserQuota(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := parseIDParam(c)
+		if !ok {
+			return
+		}
+		var quotaData struct {
+			MaxAddresses    *int `json:"max_addresses"`
+			AddressesPerDay *int `json:"addresses_per_day"`
+			MaxTokens       *int `json:"max_tokens"`
+		}
+		if err := c.ShouldBindJSON(&quotaData); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		user, err := services.SetUserQuotas(db, userID, quotaData.MaxAddresses, quotaData.AddressesPerDay, quotaData.MaxTokens)
+		if err != nil {
+			switch {
+			case errors.Is(err, services.ErrInvalidQuota):
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Quotas must not be negative"})
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			default:
+				log.Printf("Failed to set quota of user %d: %v", userID, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update quota"})
+			}
+			return
+		}
+
+		usage, err := services.GetQuotaUsage(db, user)
+		if err != nil {
+			log.Printf("Failed to retrieve quota for user %d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve quota"})
+			return
+		}
+		actor := c.MustGet("user").(models.User)
+		log.Printf("User %s updated quota of user %s", actor.Username, user.Username)
+		recordAudit(c, db, services.AuditEntry{
+			Action:     models.AuditQuotaChanged,
+			TargetType: "user",
+			TargetID:   user.ID,
+			UserID:     user.ID,
+			After:      quotaData,
+		})
+		c.JSON(http.StatusOK, gin.H{"message": "Quota updated successfully", "quota": newQuotaResponse(usage)})
+	}
+}
+
+// 超出配额时返回 403 和超出的配额项，其他错误返回 false 交给调用方处理
+func respondQuotaExceeded(c *gin.Context, err error) bool {
+	var quotaErr *services.QuotaExceededError
+	if !errors.As(err, &quotaErr) {
+		return false
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": quotaErr.Error(), "quota": quotaErr.Quota, "limit": quotaErr.Limit})
+	return true
+}
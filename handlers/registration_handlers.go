@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"anonymail/models"
+	"anonymail/services"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func GetInviteCodes(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		invites, err := services.ListInviteCodes(db)
+		if err != nil {
+			log.Printf("Failed to retrieve invite codes: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve invite codes"})
+			return
+		}
+
+		response := make([]inviteCodeResponse, 0, len(invites))
+		for _, invite := range invites {
+			response = append(response, newInviteCodeResponse(invite))
+		}
+		c.JSON(http.StatusOK, gin.H{"invites": response})
+	}
+}
+
+// 邀请码明文只在创建时返回一次
+func CreateInviteCode(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var inviteData struct {
+			Note      string     `json:"note"`
+			MaxUses   int        `json:"max_uses" binding:"min=0"`
+			ExpiresAt *time.Time `json:"expires_at"`
+		}
+		if err := c.ShouldBindJSON(&inviteData); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if inviteData.ExpiresAt != nil && inviteData.ExpiresAt.Before(time.Now()) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Expiry must be in the future"})
+			return
+		}
+
+		userInterface, _ := c.Get("user")
+		user := userInterface.(models.User)
+
+		code, invite, err := services.CreateInviteCode(db, user.ID, inviteData.Note, inviteData.MaxUses, inviteData.ExpiresAt)
+		if err != nil {
+			log.Printf("Failed to create invite code: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invite code"})
+			return
+		}
+
+		log.Printf("Invite code %d created by user %d", invite.ID, user.ID)
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Invite code created successfully",
+			"code":    code,
+			"invite":  newInviteCodeResponse(invite),
+		})
+	}
+}
+
+func DeleteInviteCode(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		inviteID, ok := parseIDParam(c)
+		if !ok {
+			return
+		}
+
+		if err := services.DeleteInviteCode(db, inviteID); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Invite code not found"})
+				return
+			}
+			log.Printf("Failed to delete invite code %d: %v", inviteID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete invite code"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Invite code deleted successfully"})
+	}
+}
+
+// 等待审批的注册
+func GetPendingUsers(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		users, err := services.ListPendingUsers(db)
+		if err != nil {
+			log.Printf("Failed to retrieve pending users: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve pending users"})
+			return
+		}
+
+		response := make([]pendingUserResponse, 0, len(users))
+		for _, user := range users {
+			response = append(response, pendingUserResponse{ID: user.ID, Username: user.Username, CreatedAt: user.CreatedAt})
+		}
+		c.JSON(http.StatusOK, gin.H{"users": response})
+	}
+}
+
+func ApproveUser(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := parseIDParam(c)
+		if !ok {
+			return
+		}
+
+		if err := services.ApproveUser(db, userID); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "No pending registration for this user"})
+				return
+			}
+			log.Printf("Failed to approve user %d: %v", userID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to approve user"})
+			return
+		}
+
+		log.Printf("Registration of user %d approved", userID)
+		recordAudit(c, db, services.AuditEntry{Action: models.AuditUserApproved, TargetType: "user", TargetID: userID, UserID: userID})
+		c.JSON(http.StatusOK, gin.H{"message": "User approved successfully"})
+	}
+}
+
+func RejectUser(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := parseIDParam(c)
+		if !ok {
+			return
+		}
+
+		if err := services.RejectUser(db, userID); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "No pending registration for this user"})
+				return
+			}
+			log.Printf("Failed to reject user %d: %v", userID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reject user"})
+			return
+		}
+
+		log.Printf("Registration of user %d rejected", userID)
+		recordAudit(c, db, services.AuditEntry{Action: models.AuditUserRejected, TargetType: "user", TargetID: userID, UserID: userID})
+		c.JSON(http.StatusOK, gin.H{"message": "User rejected successfully"})
+	}
+}
@@ -0,0 +1,573 @@
+package handlers
+
+import (
+	"strings"
+	"time"
+
+	"anonymail/models"
+	"anonymail/services"
+
+	"gorm.io/gorm"
+)
+
+// 返回给前端的数据结构，避免直接序列化模型导致敏感字段泄露
+
+type userResponse struct {
+	ID                  uint     `json:"id"`
+	Username            string   `json:"username"`
+	IsAdmin             bool     `json:"isAdmin"`
+	Role                string   `json:"role"`
+	Permissions         []string `json:"permissions"`
+	NeedsPasswordReset  bool     `json:"needsPasswordReset"`
+	TwoFactorEnabled    bool     `json:"twoFactorEnabled"`
+	NeedsTwoFactorSetup bool     `json:"needsTwoFactorSetup"`
+}
+
+type adminUserResponse struct {
+	ID                uint       `json:"ID"`
+	Username          string     `json:"Username"`
+	IsAdmin           bool       `json:"IsAdmin"`
+	Role              string     `json:"Role"`
+	TwoFactorEnabled  bool       `json:"TwoFactorEnabled"`
+	TwoFactorRequired bool       `json:"TwoFactorRequired"`
+	AuthProvider      string     `json:"AuthProvider"`
+	Disabled          bool       `json:"Disabled"`
+	DisabledReason    string     `json:"DisabledReason,omitempty"`
+	LockedUntil       *time.Time `json:"LockedUntil,omitempty"`
+}
+
+// 管理员用户列表中的一项，附带账户活动和数据量
+type adminUserListItem struct {
+	adminUserResponse
+	CreatedAt          time.Time  `json:"CreatedAt"`
+	LastLoginAt        *time.Time `json:"LastLoginAt"`
+	NeedsPasswordReset bool       `json:"NeedsPasswordReset"`
+	SessionCount       int64      `json:"SessionCount"`
+	AddressCount       int64      `json:"AddressCount"`
+	TokenCount         int64      `json:"TokenCount"`
+}
+
+// 配额为 0 表示不限制
+type quotaResponse struct {
+	MaxAddresses    int   `json:"MaxAddresses"`
+	AddressesPerDay int   `json:"AddressesPerDay"`
+	MaxTokens       int   `json:"MaxTokens"`
+	Custom          bool  `json:"Custom"`
+	Addresses       int64 `json:"Addresses"`
+	AddressesToday  int64 `json:"AddressesToday"`
+	Tokens          int64 `json:"Tokens"`
+}
+
+type auditEventResponse struct {
+	ID         uint      `json:"ID"`
+	CreatedAt  time.Time `json:"CreatedAt"`
+	ActorID    uint      `json:"ActorID"`
+	ActorName  string    `json:"ActorName"`
+	Action     string    `json:"Action"`
+	TargetType string    `json:"TargetType,omitempty"`
+	TargetID   uint      `json:"TargetID,omitempty"`
+	UserID     uint      `json:"UserID"`
+	IP         string    `json:"IP"`
+	UserAgent  string    `json:"UserAgent"`
+	RequestID  string    `json:"RequestID"`
+	Before     string    `json:"Before,omitempty"`
+	After      string    `json:"After,omitempty"`
+	Hash       string    `json:"Hash"`
+}
+
+// 用户查看自己账户的活动时，管理员操作只显示执行者，不显示其 IP 和设备
+type accountActivityResponse struct {
+	CreatedAt time.Time `json:"CreatedAt"`
+	Action    string    `json:"Action"`
+	ActorName string    `json:"ActorName"`
+	ByAdmin   bool      `json:"ByAdmin"`
+	IP        string    `json:"IP,omitempty"`
+	UserAgent string    `json:"UserAgent,omitempty"`
+}
+
+type tokenResponse struct {
+	ID          uint                `json:"ID"`
+	CreatedAt   time.Time           `json:"CreatedAt"`
+	Description string              `json:"Description"`
+	MaskedValue string              `json:"MaskedValue"`
+	IsDefault   bool                `json:"IsDefault"`
+	Stats       *tokenStatsResponse `json:"Stats,omitempty"`
+}
+
+type tokenStatsResponse struct {
+	TokenID          uint                       `json:"TokenID"`
+	Description      string                     `json:"Description,omitempty"`
+	GeneratedToday   int64                      `json:"GeneratedToday"`
+	GeneratedWeek    int64                      `json:"GeneratedWeek"`
+	GeneratedMonth   int64                      `json:"GeneratedMonth"`
+	GeneratedTotal   int64                      `json:"GeneratedTotal"`
+	FailuresMonth    int64                      `json:"FailuresMonth"`
+	FailuresTotal    int64                      `json:"FailuresTotal"`
+	AverageLatencyMs float64                    `json:"AverageLatencyMs"`
+	LastUsedAt       *time.Time                 `json:"LastUsedAt"`
+	Daily            []services.DailyTokenUsage `json:"Daily,omitempty"`
+}
+
+type tokenRevisionResponse struct {
+	ID          uint      `json:"ID"`
+	ReplacedAt  time.Time `json:"ReplacedAt"`
+	MaskedValue string    `json:"MaskedValue"`
+}
+
+type sessionResponse struct {
+	ID         uint      `json:"ID"`
+	CreatedAt  time.Time `json:"CreatedAt"`
+	LastSeenAt time.Time `json:"LastSeenAt"`
+	ExpiresAt  time.Time `json:"ExpiresAt"`
+	UserAgent  string    `json:"UserAgent"`
+	IP         string    `json:"IP"`
+	Current    bool      `json:"Current"`
+}
+
+type apiKeyResponse struct {
+	ID         uint       `json:"ID"`
+	CreatedAt  time.Time  `json:"CreatedAt"`
+	Name       string     `json:"Name"`
+	Prefix     string     `json:"Prefix"`
+	Scopes     []string   `json:"Scopes"`
+	AllowedIPs []string   `json:"AllowedIPs"`
+	ExpiresAt  *time.Time `json:"ExpiresAt"`
+	LastUsedAt *time.Time `json:"LastUsedAt"`
+	LastUsedIP string     `json:"LastUsedIP"`
+	RevokedAt  *time.Time `json:"RevokedAt"`
+}
+
+type inviteCodeResponse struct {
+	ID        uint       `json:"ID"`
+	CreatedAt time.Time  `json:"CreatedAt"`
+	Note      string     `json:"Note"`
+	Prefix    string     `json:"Prefix"`
+	MaxUses   int        `json:"MaxUses"`
+	Uses      int        `json:"Uses"`
+	ExpiresAt *time.Time `json:"ExpiresAt"`
+}
+
+type passwordResetLinkResponse struct {
+	ID            uint       `json:"ID"`
+	CreatedAt     time.Time  `json:"CreatedAt"`
+	CreatedByID   uint       `json:"CreatedByID"`
+	ExpiresAt     time.Time  `json:"ExpiresAt"`
+	UsedAt        *time.Time `json:"UsedAt"`
+	UsedIP        string     `json:"UsedIP"`
+	UsedUserAgent string     `json:"UsedUserAgent"`
+}
+
+type pendingUserResponse struct {
+	ID        uint      `json:"ID"`
+	Username  string    `json:"Username"`
+	CreatedAt time.Time `json:"CreatedAt"`
+}
+
+type webAuthnCredentialResponse struct {
+	ID         uint       `json:"ID"`
+	CreatedAt  time.Time  `json:"CreatedAt"`
+	Name       string     `json:"Name"`
+	LastUsedAt *time.Time `json:"LastUsedAt"`
+}
+
+type addressResponse struct {
+	ID               uint      `json:"ID"`
+	CreatedAt        time.Time `json:"CreatedAt"`
+	GeneratedAddress string    `json:"GeneratedAddress"`
+	RealAddress      string    `json:"RealAddress"`
+	ConvertedAddress string    `json:"ConvertedAddress"`
+	TokenID          uint      `json:"TokenID"`
+	TokenDescription string    `json:"TokenDescription"`
+	TokenMasked      string    `json:"TokenMasked"`
+	OrganizationID   uint      `json:"OrganizationID,omitempty"`
+	// 只有共享给当前用户的地址才有以下字段
+	Owner      string `json:"Owner,omitempty"`
+	Permission string `json:"Permission,omitempty"`
+}
+
+type addressShareResponse struct {
+	UserID     uint   `json:"UserID"`
+	Username   string `json:"Username"`
+	Permission string `json:"Permission"`
+}
+
+type transferPlanResponse struct {
+	FromUser  string                 `json:"FromUser"`
+	ToUser    string                 `json:"ToUser"`
+	Addresses []transferItemResponse `json:"Addresses"`
+	Tokens    []transferItemResponse `json:"Tokens"`
+}
+
+// 预览中只显示地址和 Token 的名称，不包含真实地址和 Token 值
+type transferItemResponse struct {
+	ID   uint   `json:"ID"`
+	Name string `json:"Name"`
+}
+
+type ownershipTransferResponse struct {
+	ID          uint      `json:"ID"`
+	CreatedAt   time.Time `json:"CreatedAt"`
+	FromUserID  uint      `json:"FromUserID"`
+	ToUserID    uint      `json:"ToUserID"`
+	PerformedBy uint      `json:"PerformedBy"`
+	AddressIDs  []uint    `json:"AddressIDs"`
+	TokenIDs    []uint    `json:"TokenIDs"`
+}
+
+type organizationResponse struct {
+	ID        uint      `json:"ID"`
+	CreatedAt time.Time `json:"CreatedAt"`
+	Name      string    `json:"Name"`
+	Role      string    `json:"Role"`
+}
+
+type organizationMemberResponse struct {
+	UserID   uint      `json:"UserID"`
+	Username string    `json:"Username"`
+	Role     string    `json:"Role"`
+	JoinedAt time.Time `json:"JoinedAt"`
+}
+
+type organizationUsageResponse struct {
+	UserID         uint   `json:"UserID"`
+	Username       string `json:"Username"`
+	GeneratedToday int64  `json:"GeneratedToday"`
+	GeneratedMonth int64  `json:"GeneratedMonth"`
+	GeneratedTotal int64  `json:"GeneratedTotal"`
+	FailuresTotal  int64  `json:"FailuresTotal"`
+}
+
+// 组织 Token 不返回任何部分的值
+type organizationTokenResponse struct {
+	ID             uint       `json:"ID"`
+	CreatedAt      time.Time  `json:"CreatedAt"`
+	OrganizationID uint       `json:"OrganizationID"`
+	Description    string     `json:"Description"`
+	IsDefault      bool       `json:"IsDefault"`
+	LastUsedAt     *time.Time `json:"LastUsedAt"`
+}
+
+// 当前登录用户的信息，包含需要查询全局设置的状态
+func newCurrentUserResponse(db *gorm.DB, user models.User) (userResponse, error) {
+	needsTwoFactorSetup, err := services.TwoFactorSetupPending(db, user)
+	if err != nil {
+		return userResponse{}, err
+	}
+	hasSecurityKeys, err := services.HasWebAuthnCredentials(db, user.ID)
+	if err != nil {
+		return userResponse{}, err
+	}
+	return userResponse{
+		ID:                  user.ID,
+		Username:            user.Username,
+		IsAdmin:             user.IsAdmin,
+		Role:                services.UserRole(user),
+		Permissions:         services.UserPermissions(user),
+		NeedsPasswordReset:  user.NeedsPasswordReset,
+		TwoFactorEnabled:    user.TOTPEnabled || hasSecurityKeys,
+		NeedsTwoFactorSetup: needsTwoFactorSetup,
+	}, nil
+}
+
+// hasSecurityKeys 表示用户是否注册了安全密钥，与当前用户信息一致地计入两步验证
+func newAdminUserResponse(user models.User, hasSecurityKeys bool) adminUserResponse {
+	return adminUserResponse{
+		ID:                user.ID,
+		Username:          user.Username,
+		IsAdmin:           user.IsAdmin,
+		Role:              services.UserRole(user),
+		TwoFactorEnabled:  user.TOTPEnabled || hasSecurityKeys,
+		TwoFactorRequired: user.TOTPRequired,
+		AuthProvider:      user.AuthProvider,
+		Disabled:          user.Disabled,
+		DisabledReason:    user.DisabledReason,
+	}
+}
+
+func newAdminUserListItem(summary services.UserSummary) adminUserListItem {
+	item := adminUserListItem{
+		adminUserResponse:  newAdminUserResponse(summary.User, summary.HasSecurityKeys),
+		CreatedAt:          summary.User.CreatedAt,
+		LastLoginAt:        summary.User.LastLoginAt,
+		NeedsPasswordReset: summary.User.NeedsPasswordReset,
+		SessionCount:       summary.SessionCount,
+		AddressCount:       summary.AddressCount,
+		TokenCount:         summary.TokenCount,
+	}
+	item.LockedUntil = summary.LockedUntil
+	return item
+}
+
+func newQuotaResponse(usage services.QuotaUsage) quotaResponse {
+	return quotaResponse{
+		MaxAddresses:    usage.MaxAddresses,
+		AddressesPerDay: usage.AddressesPerDay,
+		MaxTokens:       usage.MaxTokens,
+		Custom:          usage.Custom,
+		Addresses:       usage.Addresses,
+		AddressesToday:  usage.AddressesToday,
+		Tokens:          usage.Tokens,
+	}
+}
+
+func newAuditEventResponse(event models.AuditEvent) auditEventResponse {
+	return auditEventResponse{
+		ID:         event.ID,
+		CreatedAt:  event.CreatedAt,
+		ActorID:    event.ActorID,
+		ActorName:  event.ActorName,
+		Action:     event.Action,
+		TargetType: event.TargetType,
+		TargetID:   event.TargetID,
+		UserID:     event.UserID,
+		IP:         event.IP,
+		UserAgent:  event.UserAgent,
+		RequestID:  event.RequestID,
+		Before:     event.Before,
+		After:      event.After,
+		Hash:       event.Hash,
+	}
+}
+
+func newAccountActivityResponse(event models.AuditEvent, userID uint) accountActivityResponse {
+	response := accountActivityResponse{
+		CreatedAt: event.CreatedAt,
+		Action:    event.Action,
+		ActorName: event.ActorName,
+		ByAdmin:   event.ActorID != 0 && event.ActorID != userID,
+	}
+	if !response.ByAdmin {
+		response.IP = event.IP
+		response.UserAgent = event.UserAgent
+	}
+	return response
+}
+
+func newTokenResponse(token models.Token) tokenResponse {
+	return tokenResponse{
+		ID:          token.ID,
+		CreatedAt:   token.CreatedAt,
+		Description: token.Description,
+		MaskedValue: maskSecret(string(token.Value)),
+		IsDefault:   token.IsDefault,
+	}
+}
+
+func newTokenStatsResponse(stats *services.TokenStats) *tokenStatsResponse {
+	if stats == nil {
+		return nil
+	}
+	return &tokenStatsResponse{
+		TokenID:          stats.TokenID,
+		GeneratedToday:   stats.GeneratedToday,
+		GeneratedWeek:    stats.GeneratedWeek,
+		GeneratedMonth:   stats.GeneratedMonth,
+		GeneratedTotal:   stats.GeneratedTotal,
+		FailuresMonth:    stats.FailuresMonth,
+		FailuresTotal:    stats.FailuresTotal,
+		AverageLatencyMs: stats.AverageLatencyMs,
+		LastUsedAt:       stats.LastUsedAt,
+		Daily:            stats.Daily,
+	}
+}
+
+func newTokenRevisionResponse(revision models.TokenRevision) tokenRevisionResponse {
+	return tokenRevisionResponse{
+		ID:          revision.ID,
+		ReplacedAt:  revision.CreatedAt,
+		MaskedValue: maskSecret(string(revision.Value)),
+	}
+}
+
+func newSessionResponse(session models.Session, current bool) sessionResponse {
+	return sessionResponse{
+		ID:         session.ID,
+		CreatedAt:  session.CreatedAt,
+		LastSeenAt: session.LastSeenAt,
+		ExpiresAt:  session.ExpiresAt,
+		UserAgent:  session.UserAgent,
+		IP:         session.IP,
+		Current:    current,
+	}
+}
+
+func newAPIKeyResponse(key models.APIKey) apiKeyResponse {
+	return apiKeyResponse{
+		ID:         key.ID,
+		CreatedAt:  key.CreatedAt,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     splitList(key.Scopes),
+		AllowedIPs: splitList(key.AllowedIPs),
+		ExpiresAt:  key.ExpiresAt,
+		LastUsedAt: key.LastUsedAt,
+		LastUsedIP: key.LastUsedIP,
+		RevokedAt:  key.RevokedAt,
+	}
+}
+
+func newInviteCodeResponse(invite models.InviteCode) inviteCodeResponse {
+	return inviteCodeResponse{
+		ID:        invite.ID,
+		CreatedAt: invite.CreatedAt,
+		Note:      invite.Note,
+		Prefix:    invite.Prefix,
+		MaxUses:   invite.MaxUses,
+		Uses:      invite.Uses,
+		ExpiresAt: invite.ExpiresAt,
+	}
+}
+
+func newPasswordResetLinkResponse(token models.PasswordResetToken) passwordResetLinkResponse {
+	return passwordResetLinkResponse{
+		ID:            token.ID,
+		CreatedAt:     token.CreatedAt,
+		CreatedByID:   token.CreatedByID,
+		ExpiresAt:     token.ExpiresAt,
+		UsedAt:        token.UsedAt,
+		UsedIP:        token.UsedIP,
+		UsedUserAgent: token.UsedUserAgent,
+	}
+}
+
+func newWebAuthnCredentialResponse(credential models.WebAuthnCredential) webAuthnCredentialResponse {
+	return webAuthnCredentialResponse{
+		ID:         credential.ID,
+		CreatedAt:  credential.CreatedAt,
+		Name:       credential.Name,
+		LastUsedAt: credential.LastUsedAt,
+	}
+}
+
+func newAddressResponse(address models.Address) addressResponse {
+	response := addressResponse{
+		ID:               address.ID,
+		CreatedAt:        address.CreatedAt,
+		GeneratedAddress: address.GeneratedAddress,
+		RealAddress:      string(address.RealAddress),
+		ConvertedAddress: string(address.ConvertedAddress),
+		TokenID:          address.TokenID,
+		TokenDescription: address.TokenDescription,
+		TokenMasked:      maskSecret(string(address.TokenValue)),
+		OrganizationID:   address.OrganizationID,
+	}
+	// 组织 Token 连最后几位也不显示
+	if address.OrganizationID != 0 {
+		response.TokenMasked = maskSecret("")
+	}
+	return response
+}
+
+// 共享的地址不显示 Token 的任何部分
+func newSharedAddressResponse(shared services.SharedAddress) addressResponse {
+	response := newAddressResponse(shared.Address)
+	response.TokenMasked = maskSecret("")
+	response.Owner = shared.Owner
+	response.Permission = shared.Permission
+	return response
+}
+
+func newAddressShareResponse(share services.AddressShareInfo) addressShareResponse {
+	return addressShareResponse{
+		UserID:     share.UserID,
+		Username:   share.Username,
+		Permission: share.Permission,
+	}
+}
+
+func newTransferPlanResponse(plan services.TransferPlan) transferPlanResponse {
+	response := transferPlanResponse{
+		FromUser:  plan.From.Username,
+		ToUser:    plan.To.Username,
+		Addresses: make([]transferItemResponse, 0, len(plan.Addresses)),
+		Tokens:    make([]transferItemResponse, 0, len(plan.Tokens)),
+	}
+	for _, address := range plan.Addresses {
+		response.Addresses = append(response.Addresses, transferItemResponse{ID: address.ID, Name: address.GeneratedAddress})
+	}
+	for _, token := range plan.Tokens {
+		response.Tokens = append(response.Tokens, transferItemResponse{ID: token.ID, Name: token.Description})
+	}
+	return response
+}
+
+func newOwnershipTransferResponse(transfer models.OwnershipTransfer) ownershipTransferResponse {
+	addressIDs, _ := services.ParseIDList(transfer.AddressIDs)
+	tokenIDs, _ := services.ParseIDList(transfer.TokenIDs)
+	return ownershipTransferResponse{
+		ID:          transfer.ID,
+		CreatedAt:   transfer.CreatedAt,
+		FromUserID:  transfer.FromUserID,
+		ToUserID:    transfer.ToUserID,
+		PerformedBy: transfer.PerformedBy,
+		AddressIDs:  addressIDs,
+		TokenIDs:    tokenIDs,
+	}
+}
+
+func newOrganizationResponse(organization models.Organization, role string) organizationResponse {
+	return organizationResponse{
+		ID:        organization.ID,
+		CreatedAt: organization.CreatedAt,
+		Name:      organization.Name,
+		Role:      role,
+	}
+}
+
+func newOrganizationMemberResponse(member services.OrganizationMemberInfo) organizationMemberResponse {
+	return organizationMemberResponse{
+		UserID:   member.UserID,
+		Username: member.Username,
+		Role:     member.Role,
+		JoinedAt: member.JoinedAt,
+	}
+}
+
+func newOrganizationUsageResponse(usage services.OrganizationMemberUsage) organizationUsageResponse {
+	return organizationUsageResponse{
+		UserID:         usage.UserID,
+		Username:       usage.Username,
+		GeneratedToday: usage.GeneratedToday,
+		GeneratedMonth: usage.GeneratedMonth,
+		GeneratedTotal: usage.GeneratedTotal,
+		FailuresTotal:  usage.FailuresTotal,
+	}
+}
+
+// 其他成员生成的地址不显示真实邮箱（转换后的地址也包含真实邮箱），只有所有者可以看到
+func newOrganizationAddressResponse(address models.Address, member models.OrganizationMember) addressResponse {
+	response := newAddressResponse(address)
+	if member.Role != models.OrganizationRoleOwner && address.UserID != member.UserID {
+		response.RealAddress = ""
+		response.ConvertedAddress = ""
+	}
+	return response
+}
+
+func newOrganizationTokenResponse(token models.Token) organizationTokenResponse {
+	return organizationTokenResponse{
+		ID:             token.ID,
+		CreatedAt:      token.CreatedAt,
+		OrganizationID: token.OrganizationID,
+		Description:    token.Description,
+		IsDefault:      token.IsDefault,
+		LastUsedAt:     token.LastUsedAt,
+	}
+}
+
+// 只保留最后 4 个字符
+func maskSecret(value string) string {
+	const visible = 4
+	if len(value) <= visible {
+		return strings.Repeat("•", 8)
+	}
+	return strings.Repeat("•", 8) + value[len(value)-visible:]
+}
+
+// 拆分以逗号分隔的字段，空字符串返回空列表
+func splitList(value string) []string {
+	if value == "" {
+		return []string{}
+	}
+	return strings.Split(value, ",")
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"anonymail/models"
+	"anonymail/services"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func GetRoles() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"roles": services.RolePermissions()})
+	}
+}
+
+// 分配角色，role 为 admin 时设为完整管理员，为空时移除角色
+func SetUserRole(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := parseIDParam(c)
+		if !ok {
+			return
+		}
+		var roleData struct {
+			Role string `json:"role"`
+		}
+		if err := c.ShouldBindJSON(&roleData); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var before models.User
+		if err := db.First(&before, userID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		user, err := services.SetUserRole(db, userID, roleData.Role)
+		if err != nil {
+			switch {
+			case errors.Is(err, services.ErrInvalidRole):
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+			case errors.Is(err, services.ErrLastAdmin):
+				c.JSON(http.StatusConflict, gin.H{"error": "Cannot remove the last administrator"})
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			default:
+				log.Printf("Failed to set role of user %d: %v", userID, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update role"})
+			}
+			return
+		}
+
+		actor := c.MustGet("user").(models.User)
+		log.Printf("User %s set role of user %s to %q", actor.Username, user.Username, services.UserRole(user))
+		recordAudit(c, db, services.AuditEntry{
+			Action:     models.AuditRoleChanged,
+			TargetType: "user",
+			TargetID:   user.ID,
+			UserID:     user.ID,
+			Before:     gin.H{"role": services.UserRole(before)},
+			After:      gin.H{"role": services.UserRole(user)},
+		})
+		hasSecurityKeys, err := services.HasWebAuthnCredentials(db, user.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Role updated successfully", "user": newAdminUserResponse(user, hasSecurityKeys)})
+	}
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"anonymail/models"
+	"anonymail/services"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func Logout(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userInterface, _ := c.Get("user")
+		user := userInterface.(models.User)
+		sessionInterface, _ := c.Get("session")
+		session := sessionInterface.(models.Session)
+
+		if err := services.RevokeSession(db, user.ID, session.ID); err != nil {
+			log.Printf("Failed to log out session %d for user %d: %v", session.ID, user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+			return
+		}
+
+		log.Printf("User %d logged out session %d", user.ID, session.ID)
+		recordAudit(c, db, services.AuditEntry{Action: models.AuditLogout, TargetType: "session", TargetID: session.ID})
+		c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+	}
+}
+
+// 注销所有设备上的会话，包括当前会话
+func LogoutAll(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userInterface, _ := c.Get("user")
+		user := userInterface.(models.User)
+
+		if err := services.RevokeUserSessions(db, user.ID, 0); err != nil {
+			log.Printf("Failed to log out all sessions for user %d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+			return
+		}
+
+		log.Printf("User %d logged out everywhere", user.ID)
+		recordAudit(c, db, services.AuditEntry{Action: models.AuditLogout, After: gin.H{"all_sessions": true}})
+		c.JSON(http.StatusOK, gin.H{"message": "Logged out from all devices"})
+	}
+}
+
+func GetSessions(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userInterface, _ := c.Get("user")
+		user := userInterface.(models.User)
+		sessionInterface, _ := c.Get("session")
+		current := sessionInterface.(models.Session)
+
+		sessions, err := services.ListSessions(db, user.ID)
+		if err != nil {
+			log.Printf("Failed to retrieve sessions for user %d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sessions"})
+			return
+		}
+
+		response := make([]sessionResponse, 0, len(sessions))
+		for _, session := range sessions {
+			response = append(response, newSessionResponse(session, session.ID == current.ID))
+		}
+		c.JSON(http.StatusOK, gin.H{"sessions": response})
+	}
+}
+
+func RevokeSession(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sessionID, ok := parseIDParam(c)
+		if !ok {
+			return
+		}
+
+		userInterface, _ := c.Get("user")
+		user := userInterface.(models.User)
+
+		if err := services.RevokeSession(db, user.ID, sessionID); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+				return
+			}
+			log.Printf("Failed to revoke session %d for user %d: %v", sessionID, user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+			return
+		}
+
+		log.Printf("Session %d revoked for user %d", sessionID, user.ID)
+		c.JSON(http.StatusOK, gin.H{"message": "Session revoked successfully"})
+	}
+}
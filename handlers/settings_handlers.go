@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"anonymail/models"
+	"anonymail/services"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func GetSettings(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		require2FA, err := services.GetBoolSetting(db, services.SettingRequire2FA)
+		if err != nil {
+			log.Printf("Failed to retrieve settings: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve settings"})
+			return
+		}
+
+		registrationMode, err := services.GetRegistrationMode(db)
+		if err != nil {
+			log.Printf("Failed to retrieve settings: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve settings"})
+			return
+		}
+
+		quotas, err := services.DefaultQuotas(db)
+		if err != nil {
+			log.Printf("Failed to retrieve settings: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve settings"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"settings": gin.H{
+			"require_2fa":             require2FA,
+			"registration_mode":       registrationMode,
+			"quota_max_addresses":     quotas.MaxAddresses,
+			"quota_addresses_per_day": quotas.AddressesPerDay,
+			"quota_max_tokens":        quotas.MaxTokens,
+		}})
+	}
+}
+
+// 只更新请求中出现的设置项
+func UpdateSettings(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var settingsData struct {
+			Require2FA           *bool   `json:"require_2fa"`
+			RegistrationMode     *string `json:"registration_mode"`
+			QuotaMaxAddresses    *int    `json:"quota_max_addresses"`
+			QuotaAddressesPerDay *int    `json:"quota_addresses_per_day"`
+			QuotaMaxTokens       *int    `json:"quota_max_tokens"`
+		}
+		if err := c.ShouldBindJSON(&settingsData); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if settingsData.RegistrationMode != nil && !services.ValidRegistrationMode(*settingsData.RegistrationMode) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Registration mode must be one of open, invite, approval, closed"})
+			return
+		}
+		quotaSettings := map[string]*int{
+			services.SettingQuotaMaxAddresses:    settingsData.QuotaMaxAddresses,
+			services.SettingQuotaAddressesPerDay: settingsData.QuotaAddressesPerDay,
+			services.SettingQuotaMaxTokens:       settingsData.QuotaMaxTokens,
+		}
+		for _, value := range quotaSettings {
+			if value != nil && *value < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Quotas must not be negative"})
+				return
+			}
+		}
+
+		if settingsData.Require2FA != nil {
+			// 避免管理员开启全局要求后把自己锁在外面
+			userInterface, _ := c.Get("user")
+			if *settingsData.Require2FA && !userInterface.(models.User).TOTPEnabled {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Enable two-factor authentication for your own account first"})
+				return
+			}
+			if err := services.SetSetting(db, services.SettingRequire2FA, strconv.FormatBool(*settingsData.Require2FA)); err != nil {
+				log.Printf("Failed to update settings: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update settings"})
+				return
+			}
+		}
+
+		if settingsData.RegistrationMode != nil {
+			if err := services.SetSetting(db, services.SettingRegistrationMode, *settingsData.RegistrationMode); err != nil {
+				log.Printf("Failed to update settings: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update settings"})
+				return
+			}
+		}
+
+		// 默认配额只影响没有单独设置配额的用户
+		for key, value := range quotaSettings {
+			if value == nil {
+				continue
+			}
+			if err := services.SetSetting(db, key, strconv.Itoa(*value)); err != nil {
+				log.Printf("Failed to update settings: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update settings"})
+				return
+			}
+		}
+
+		log.Println("Settings updated")
+		recordAudit(c, db, services.AuditEntry{Action: models.AuditSettingsChanged, TargetType: "settings", After: settingsData})
+		c.JSON(http.StatusOK, gin.H{"message": "Settings updated successfully"})
+	}
+}
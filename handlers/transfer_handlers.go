@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"anonymail/models"
+	"anonymail/services"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type transferRequest struct {
+	FromUserID uint   `json:"from_user_id" binding:"required"`
+	ToUserID   uint   `json:"to_user_id" binding:"required"`
+	AddressIDs []uint `json:"address_ids"`
+	TokenIDs   []uint `json:"token_ids"`
+}
+
+// 预览转移的地址和 Token，不修改数据
+func PreviewTransfer(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		request, ok := bindTransferRequest(c)
+		if !ok {
+			return
+		}
+
+		plan, err := services.PlanTransfer(db, request)
+		if err != nil {
+			respondTransferError(c, err, "Failed to preview transfer")
+			return
+		}
+		if !canTransfer(c, plan) {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"preview": newTransferPlanResponse(plan)})
+	}
+}
+
+func ExecuteTransfer(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		request, ok := bindTransferRequest(c)
+		if !ok {
+			return
+		}
+
+		plan, err := services.PlanTransfer(db, request)
+		if err != nil {
+			respondTransferError(c, err, "Failed to transfer")
+			return
+		}
+		if !canTransfer(c, plan) {
+			return
+		}
+
+		actor := c.MustGet("user").(models.User)
+		plan, record, err := services.ExecuteTransfer(db, request, actor.ID)
+		if err != nil {
+			respondTransferError(c, err, "Failed to transfer")
+			return
+		}
+
+		log.Printf("User %s transferred %d addresses and %d tokens from user %d to user %d (transfer %d)",
+			actor.Username, len(plan.Addresses), len(plan.Tokens), request.FromUserID, request.ToUserID, record.ID)
+		recordAudit(c, db, services.AuditEntry{
+			Action:     models.AuditOwnershipTransfer,
+			TargetType: "transfer",
+			TargetID:   record.ID,
+			UserID:     request.FromUserID,
+			After: gin.H{
+				"to_user_id":  request.ToUserID,
+				"address_ids": record.AddressIDs,
+				"token_ids":   record.TokenIDs,
+			},
+		})
+		c.JSON(http.StatusOK, gin.H{"message": "Transfer completed successfully", "transfer": newOwnershipTransferResponse(record)})
+	}
+}
+
+// 转移记录，可以用 user_id 筛选涉及某个用户的记录
+func GetTransfers(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var query struct {
+			UserID uint `form:"user_id"`
+		}
+		if err := c.ShouldBindQuery(&query); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		transfers, err := services.ListOwnershipTransfers(db, query.UserID)
+		if err != nil {
+			log.Printf("Failed to retrieve transfers: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve transfers"})
+			return
+		}
+
+		response := make([]ownershipTransferResponse, 0, len(transfers))
+		for _, transfer := range transfers {
+			response = append(response, newOwnershipTransferResponse(transfer))
+		}
+		c.JSON(http.StatusOK, gin.H{"transfers": response})
+	}
+}
+
+func bindTransferRequest(c *gin.Context) (services.TransferRequest, bool) {
+	var req transferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return services.TransferRequest{}, false
+	}
+	return services.TransferRequest{
+		FromUserID: req.FromUserID,
+		ToUserID:   req.ToUserID,
+		AddressIDs: req.AddressIDs,
+		TokenIDs:   req.TokenIDs,
+	}, true
+}
+
+// 拥有管理角色的账户只能由完整管理员操作
+func canTransfer(c *gin.Context, plan services.TransferPlan) bool {
+	actor := c.MustGet("user").(models.User)
+	if !services.CanManageUser(actor, plan.From) || !services.CanManageUser(actor, plan.To) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only administrators can manage accounts with admin roles"})
+		return false
+	}
+	return true
+}
+
+func respondTransferError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	case errors.Is(err, services.ErrTransferSameUser), errors.Is(err, services.ErrTransferSelection), errors.Is(err, services.ErrTransferEmpty):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		log.Printf("%s: %v", message, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"anonymail/models"
+	"anonymail/services"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func GetTwoFactorStatus(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userInterface, _ := c.Get("user")
+		user := userInterface.(models.User)
+
+		required, err := services.TwoFactorRequired(db, user)
+		if err != nil {
+			log.Printf("Failed to check two-factor requirement for user %d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve two-factor status"})
+			return
+		}
+		remaining, err := services.CountRecoveryCodes(db, user.ID)
+		if err != nil {
+			log.Printf("Failed to count recovery codes for user %d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve two-factor status"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"enabled":                  user.TOTPEnabled,
+			"required":                 required,
+			"recovery_codes_remaining": remaining,
+		})
+	}
+}
+
+// 开始设置两步验证，返回密钥和用于生成二维码的 otpauth URI
+func SetupTwoFactor(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var setupData struct {
+			Password string `json:"password"`
+		}
+		if err := c.ShouldBindJSON(&setupData); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		userInterface, _ := c.Get("user")
+		user := userInterface.(models.User)
+
+		if !reauthenticate(c, user, setupData.Password) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Re-authentication failed"})
+			return
+		}
+		if user.TOTPEnabled {
+			c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+			return
+		}
+
+		secret, uri, err := services.BeginTOTPEnrollment(db, user)
+		if err != nil {
+			log.Printf("Failed to start two-factor setup for user %d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start two-factor setup"})
+			return
+		}
+
+		log.Printf("Two-factor setup started for user %d", user.ID)
+		c.JSON(http.StatusOK, gin.H{"secret": secret, "provisioning_uri": uri})
+	}
+}
+
+// 提交第一个验证码确认设置，返回一次性恢复码
+func EnableTwoFactor(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var enableData struct {
+			Code string `json:"code" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&enableData); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		userInterface, _ := c.Get("user")
+		user := userInterface.(models.User)
+
+		if user.TOTPEnabled {
+			c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+			return
+		}
+
+		codes, err := services.ConfirmTOTPEnrollment(db, user, enableData.Code)
+		if err != nil {
+			respondTwoFactorError(c, user, err, "Failed to enable two-factor authentication")
+			return
+		}
+
+		log.Printf("Two-factor authentication enabled for user %d", user.ID)
+		recordAudit(c, db, services.AuditEntry{Action: models.AuditTwoFactorEnabled, TargetType: "user", TargetID: user.ID})
+		c.JSON(http.StatusOK, gin.H{
+			"message":        "Two-factor authentication enabled",
+			"recovery_codes": codes,
+		})
+	}
+}
+
+func DisableTwoFactor(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var disableData struct {
+			Password string `json:"password"`
+			Code     string `json:"code" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&disableData); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		userInterface, _ := c.Get("user")
+		user := userInterface.(models.User)
+
+		if !reauthenticate(c, user, disableData.Password) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Re-authentication failed"})
+			return
+		}
+
+		if err := services.DisableTOTP(db, user, disableData.Code); err != nil {
+			respondTwoFactorError(c, user, err, "Failed to disable two-factor authentication")
+			return
+		}
+
+		log.Printf("Two-factor authentication disabled for user %d", user.ID)
+		recordAudit(c, db, services.AuditEntry{Action: models.AuditTwoFactorDisabled, TargetType: "user", TargetID: user.ID})
+		c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+	}
+}
+
+func RegenerateRecoveryCodes(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var regenerateData struct {
+			Code string `json:"code" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&regenerateData); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		userInterface, _ := c.Get("user")
+		user := userInterface.(models.User)
+
+		codes, err := services.RegenerateRecoveryCodes(db, user, regenerateData.Code)
+		if err != nil {
+			respondTwoFactorError(c, user, err, "Failed to regenerate recovery codes")
+			return
+		}
+
+		log.Printf("Recovery codes regenerated for user %d", user.ID)
+		c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+	}
+}
+
+// 管理员重置用户的两步验证，例如用户丢失了手机和恢复码
+func AdminResetTwoFactor(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := parseIDParam(c)
+		if !ok {
+			return
+		}
+
+		if err := services.ResetTwoFactor(db, userID); err != nil {
+			log.Printf("Failed to reset two-factor for user %d: %v", userID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset two-factor authentication"})
+			return
+		}
+
+		log.Printf("Two-factor authentication reset for user %d", userID)
+		recordAudit(c, db, services.AuditEntry{Action: models.AuditTwoFactorReset, TargetType: "user", TargetID: userID, UserID: userID})
+		c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication reset successfully"})
+	}
+}
+
+// 管理员要求指定用户必须开启两步验证
+func AdminRequireTwoFactor(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := parseIDParam(c)
+		if !ok {
+			return
+		}
+		var requireData struct {
+			Required bool `json:"required"`
+		}
+		if err := c.ShouldBindJSON(&requireData); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		result := db.Model(&models.User{}).Where("id = ?", userID).Update("totp_required", requireData.Required)
+		if result.Error != nil {
+			log.Printf("Failed to update two-factor requirement for user %d: %v", userID, result.Error)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+			return
+		}
+		if result.RowsAffected == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		log.Printf("Two-factor requirement for user %d set to %s", userID, strconv.FormatBool(requireData.Required))
+		recordAudit(c, db, services.AuditEntry{
+			Action:     models.AuditUserUpdated,
+			TargetType: "user",
+			TargetID:   userID,
+			UserID:     userID,
+			After:      gin.H{"two_factor_required": requireData.Required},
+		})
+		c.JSON(http.StatusOK, gin.H{"message": "User updated successfully"})
+	}
+}
+
+func respondTwoFactorError(c *gin.Context, user models.User, err error, message string) {
+	switch {
+	case errors.Is(err, services.ErrInvalidTwoFactorCode):
+		log.Printf("Invalid two-factor code for user %d", user.ID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid two-factor code"})
+	case errors.Is(err, services.ErrTwoFactorNotSetup), errors.Is(err, services.ErrTwoFactorRequired):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		log.Printf("%s for user %d: %v", message, user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
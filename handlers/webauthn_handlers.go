@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"anonymail/models"
+	"anonymail/services"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// 登录时获取安全密钥的认证参数：带 mfa_token 时用于第二步验证，否则用于无密码登录
+func WebAuthnLoginOptions(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var optionsData struct {
+			MFAToken string `json:"mfa_token"`
+		}
+		if err := c.ShouldBindJSON(&optionsData); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var userID uint
+		if optionsData.MFAToken != "" {
+			_, user, err := services.FindLoginChallenge(db, optionsData.MFAToken, models.LoginChallengeMFA)
+			if err != nil {
+				log.Printf("Invalid login challenge: %v", err)
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Login expired, please sign in again"})
+				return
+			}
+			userID = user.ID
+		}
+
+		options, err := services.BeginWebAuthnLogin(db, services.ResolveWebAuthnRP(c.Request.Host), userID)
+		if errors.Is(err, services.ErrWebAuthnNoCredentials) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No security keys registered"})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to start security key login: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start security key login"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"publicKey": options})
+	}
+}
+
+// 使用通行密钥直接登录，认证器已验证用户身份，不再要求密码和第二步验证
+func PasskeyLogin(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var assertion services.WebAuthnAssertion
+		if err := c.ShouldBindJSON(&assertion); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		user, err := services.FinishWebAuthnLogin(db, services.ResolveWebAuthnRP(c.Request.Host), 0, assertion)
+		if err != nil {
+			log.Printf("Passkey login failed: %v", err)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+			return
+		}
+
+		respondLoginSuccess(c, db, user)
+	}
+}
+
+func GetWebAuthnCredentials(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userInterface, _ := c.Get("user")
+		user := userInterface.(models.User)
+
+		credentials, err := services.ListWebAuthnCredentials(db, user.ID)
+		if err != nil {
+			log.Printf("Failed to retrieve security keys for user %d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve security keys"})
+			return
+		}
+
+		response := make([]webAuthnCredentialResponse, 0, len(credentials))
+		for _, credential := range credentials {
+			response = append(response, newWebAuthnCredentialResponse(credential))
+		}
+		c.JSON(http.StatusOK, gin.H{"credentials": response})
+	}
+}
+
+// 注册新的安全密钥前需要再次输入密码
+func BeginWebAuthnRegistration(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var registerData struct {
+			Password string `json:"password"`
+		}
+		if err := c.ShouldBindJSON(&registerData); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		userInterface, _ := c.Get("user")
+		user := userInterface.(models.User)
+
+		if !reauthenticate(c, user, registerData.Password) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Re-authentication failed"})
+			return
+		}
+
+		options, err := services.BeginWebAuthnRegistration(db, services.ResolveWebAuthnRP(c.Request.Host), user)
+		if err != nil {
+			log.Printf("Failed to start security key registration for user %d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start security key registration"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"publicKey": options})
+	}
+}
+
+func FinishWebAuthnRegistration(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var registerData struct {
+			Name       string                       `json:"name" binding:"required"`
+			Credential services.WebAuthnAttestation `json:"credential" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&registerData); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		userInterface, _ := c.Get("user")
+		user := userInterface.(models.User)
+
+		credential, err := services.FinishWebAuthnRegistration(db, services.ResolveWebAuthnRP(c.Request.Host), user, registerData.Name, registerData.Credential)
+		if errors.Is(err, services.ErrWebAuthnVerification) {
+			log.Printf("Security key registration rejected for user %d: %v", user.ID, err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Security key verification failed"})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to register security key for user %d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register security key"})
+			return
+		}
+
+		log.Printf("Security key %d registered for user %d", credential.ID, user.ID)
+		c.JSON(http.StatusOK, gin.H{
+			"message":    "Security key registered successfully",
+			"credential": newWebAuthnCredentialResponse(credential),
+		})
+	}
+}
+
+func RenameWebAuthnCredential(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		credentialID, ok := parseIDParam(c)
+		if !ok {
+			return
+		}
+		var renameData struct {
+			Name string `json:"name" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&renameData); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		userInterface, _ := c.Get("user")
+		user := userInterface.(models.User)
+
+		err := services.RenameWebAuthnCredential(db, user.ID, credentialID, renameData.Name)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Security key not found"})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to rename security key %d: %v", credentialID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update security key"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Security key updated successfully"})
+	}
+}
+
+func DeleteWebAuthnCredential(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		credentialID, ok := parseIDParam(c)
+		if !ok {
+			return
+		}
+
+		userInterface, _ := c.Get("user")
+		user := userInterface.(models.User)
+
+		err := services.DeleteWebAuthnCredential(db, user, credentialID)
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Security key not found"})
+			return
+		case errors.Is(err, services.ErrTwoFactorRequired):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		case err != nil:
+			log.Printf("Failed to delete security key %d: %v", credentialID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete security key"})
+			return
+		}
+
+		log.Printf("Security key %d deleted for user %d", credentialID, user.ID)
+		c.JSON(http.StatusOK, gin.H{"message": "Security key deleted successfully"})
+	}
+}
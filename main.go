@@ -7,16 +7,19 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"anonymail/handlers"
 	"anonymail/middleware"
 	"anonymail/models"
+	"anonymail/services"
 
 	"github.com/gin-gonic/gin"
 	"github.com/glebarez/sqlite"
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
@@ -29,9 +32,45 @@ func main() {
 	// 初始化数据库
 	initDB()
 
+	// 初始化字段加密
+	keyring := initEncryption()
+
+	// 初始化会话配置
+	initSessions(keyring)
+
+	// 初始化两步验证配置
+	initTwoFactor()
+
+	// 初始化单点登录配置
+	initExternalAuth()
+
+	// 初始化登录失败限制
+	initLoginThrottle()
+
+	// 初始化密码策略
+	initPasswordPolicy()
+
+	// 初始化注册模式
+	initRegistration()
+
+	// 初始化默认配额
+	initQuotas()
+
+	// 密钥轮换命令：./main rotate-keys
+	if len(os.Args) > 1 && os.Args[1] == "rotate-keys" {
+		if err := services.RotateEncryptionKeys(db, keyring); err != nil {
+			log.Fatal("Failed to rotate encryption keys:", err)
+		}
+		log.Println("Encryption keys rotated successfully")
+		return
+	}
+
 	// 检查是否需要创建管理员账户
 	createAdminIfNotExists()
 
+	// 定期与 LDAP 目录同步，停用已从目录中删除的账户
+	startDirectorySync()
+
 	// 设置路由
 	r := setupRouter()
 
@@ -72,8 +111,18 @@ func main() {
 func setupRouter() *gin.Engine {
 	r := gin.New()
 	r.Use(gin.Recovery())
+	r.Use(middleware.RequestID())
 	r.Use(middleware.Logger())
 
+	// 只信任 TRUSTED_PROXIES 中列出的反向代理转发的客户端 IP，API Key 的 IP 限制依赖于此
+	trustedProxies := getEnvList("TRUSTED_PROXIES")
+	if err := r.SetTrustedProxies(trustedProxies); err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES:", err)
+	}
+	if len(trustedProxies) == 0 {
+		r.Use(middleware.UntrustedProxyWarning())
+	}
+
 	// 加载HTML模板
 	r.LoadHTMLGlob("templates/*")
 
@@ -95,55 +144,476 @@ func setupRouter() *gin.Engine {
 	// 公开路由
 	r.POST("/register", handlers.RegisterUser(db))
 	r.POST("/login", handlers.LoginUser(db))
+	r.POST("/login/2fa", handlers.LoginSecondFactor(db))
+	r.POST("/login/webauthn/options", handlers.WebAuthnLoginOptions(db))
+	r.POST("/login/passkey", handlers.PasskeyLogin(db))
+	r.POST("/login/sso", handlers.SSOLogin(db))
+	r.POST("/login/proxy", handlers.ProxyLogin(db))
+	r.POST("/password-reset", handlers.RedeemPasswordResetLink(db))
+	r.GET("/auth/providers", handlers.GetAuthProviders(db))
+	r.GET("/oidc/login", handlers.OIDCLogin(db))
+	r.GET("/oidc/callback", handlers.OIDCCallback(db))
 
-	// 需要认证的路由
+	// 需要认证的路由，使用 API Key 访问时需要具备对应的权限范围
 	auth := r.Group("/")
-	auth.Use(middleware.AuthRequired(db))
+	auth.Use(middleware.AuthRequired(db), middleware.PasswordResetRequired(), middleware.TwoFactorSetupRequired(db))
 	{
-		auth.POST("/change-password", handlers.ChangePassword(db))
-		auth.POST("/save-token", handlers.SaveToken(db))
-		auth.POST("/generate-address", handlers.GenerateAddress(db))
-		auth.GET("/addresses", handlers.GetAddresses(db))
-		auth.DELETE("/address/:id", handlers.DeleteAddress(db))
-		auth.GET("/get-token", handlers.GetToken(db))
-		auth.GET("/get-tokens", handlers.GetTokens(db))
-		auth.POST("/add-token", handlers.AddToken(db))
-		auth.DELETE("/delete-token/:id", handlers.DeleteToken(db))
 		auth.GET("/check-auth", handlers.CheckAuth(db))
+
+		addresses := auth.Group("/", middleware.RequireScope(models.ScopeReadAddresses))
+		addresses.GET("/addresses", handlers.GetAddresses(db))
+		addresses.GET("/quota", handlers.GetQuota(db))
+		addresses.GET("/organizations", handlers.GetOrganizations(db))
+		addresses.GET("/organization/:id/members", handlers.GetOrganizationMembers(db))
+		addresses.GET("/organization/:id/addresses", handlers.GetOrganizationAddresses(db))
+		addresses.GET("/organization/:id/usage", handlers.GetOrganizationUsage(db))
+
+		generate := auth.Group("/", middleware.RequireScope(models.ScopeGenerate))
+		generate.POST("/generate-address", handlers.GenerateAddress(db))
+		generate.DELETE("/address/:id", handlers.DeleteAddress(db))
+		generate.PUT("/address/:id", handlers.UpdateAddress(db))
+
+		tokens := auth.Group("/", middleware.RequireScope(models.ScopeManageTokens))
+		tokens.POST("/save-token", handlers.SaveToken(db))
+		tokens.GET("/get-token", handlers.GetToken(db))
+		tokens.GET("/get-tokens", handlers.GetTokens(db))
+		tokens.GET("/token-stats", handlers.GetTokenStats(db))
+		tokens.POST("/add-token", handlers.AddToken(db))
+		tokens.POST("/set-default-token/:id", handlers.SetDefaultToken(db))
+		tokens.PUT("/update-token/:id", handlers.UpdateToken(db))
+		tokens.POST("/replace-token/:id", handlers.ReplaceToken(db))
+		tokens.GET("/token-history/:id", handlers.GetTokenHistory(db))
+		tokens.POST("/reassign-token-addresses", handlers.ReassignTokenAddresses(db))
+		tokens.DELETE("/delete-token/:id", handlers.DeleteToken(db))
+		tokens.GET("/organization/:id/tokens", handlers.GetOrganizationTokens(db))
+		tokens.POST("/organization/:id/tokens", handlers.AddOrganizationToken(db))
+		tokens.POST("/organization/:id/default-token/:token_id", handlers.SetDefaultOrganizationToken(db))
+		tokens.DELETE("/organization/:id/token/:token_id", handlers.DeleteOrganizationToken(db))
+
+		// 只允许通过登录会话访问
+		session := auth.Group("/", middleware.SessionRequired())
+		session.POST("/change-password", handlers.ChangePassword(db))
+		session.POST("/reveal-token/:id", handlers.RevealToken(db))
+		session.POST("/logout", handlers.Logout(db))
+		session.POST("/logout-all", handlers.LogoutAll(db))
+		session.GET("/sessions", handlers.GetSessions(db))
+		session.GET("/account/activity", handlers.GetAccountActivity(db))
+		session.DELETE("/session/:id", handlers.RevokeSession(db))
+		session.GET("/api-keys", handlers.GetAPIKeys(db))
+		session.POST("/api-keys", handlers.CreateAPIKey(db))
+		session.DELETE("/api-key/:id", handlers.RevokeAPIKey(db))
+		session.GET("/2fa/status", handlers.GetTwoFactorStatus(db))
+		session.POST("/2fa/setup", handlers.SetupTwoFactor(db))
+		session.POST("/2fa/enable", handlers.EnableTwoFactor(db))
+		session.POST("/2fa/disable", handlers.DisableTwoFactor(db))
+		session.POST("/2fa/recovery-codes", handlers.RegenerateRecoveryCodes(db))
+		session.GET("/webauthn/credentials", handlers.GetWebAuthnCredentials(db))
+		session.POST("/webauthn/register/options", handlers.BeginWebAuthnRegistration(db))
+		session.POST("/webauthn/register", handlers.FinishWebAuthnRegistration(db))
+		session.PUT("/webauthn/credential/:id", handlers.RenameWebAuthnCredential(db))
+		session.DELETE("/webauthn/credential/:id", handlers.DeleteWebAuthnCredential(db))
+		session.GET("/address/:id/shares", handlers.GetAddressShares(db))
+		session.POST("/address/:id/shares", handlers.ShareAddress(db))
+		session.DELETE("/address/:id/share/:user_id", handlers.RevokeAddressShare(db))
+		session.POST("/organizations", handlers.CreateOrganization(db))
+		session.DELETE("/organization/:id", handlers.DeleteOrganization(db))
+		session.POST("/organization/:id/members", handlers.AddOrganizationMember(db))
+		session.PUT("/organization/:id/member/:user_id", handlers.UpdateOrganizationMember(db))
+		session.DELETE("/organization/:id/member/:user_id", handlers.RemoveOrganizationMember(db))
 	}
 
-	// 管理员路由
+	// 管理路由，每个接口按角色权限检查
 	admin := r.Group("/admin")
-	admin.Use(middleware.AuthRequired(db), middleware.AdminRequired())
+	admin.Use(middleware.AuthRequired(db), middleware.PasswordResetRequired(), middleware.TwoFactorSetupRequired(db), middleware.RequireScope(models.ScopeAdmin), middleware.StaffRequired())
 	{
-		admin.POST("/create-user", handlers.CreateUser(db))
-		admin.DELETE("/delete-user/:id", handlers.DeleteUser(db))
-		admin.POST("/reset-password/:id", handlers.ResetPassword(db))
-		admin.GET("/users", handlers.GetUsers(db))
+		manageable := middleware.ManageableUserRequired(db)
+
+		usersRead := admin.Group("/", middleware.RequirePermission(models.PermissionUsersRead))
+		usersRead.GET("/users", handlers.GetUsers(db))
+		usersRead.GET("/roles", handlers.GetRoles())
+		usersRead.GET("/reset-links/:id", handlers.GetPasswordResetLinks(db))
+		usersRead.GET("/invites", handlers.GetInviteCodes(db))
+		usersRead.GET("/pending-users", handlers.GetPendingUsers(db))
+		usersRead.GET("/user-quota/:id", handlers.GetUserQuota(db))
+
+		usersManage := admin.Group("/", middleware.RequirePermission(models.PermissionUsersManage))
+		usersManage.POST("/create-user", handlers.CreateUser(db))
+		usersManage.POST("/reset-password/:id", manageable, handlers.ResetPassword(db))
+		usersManage.POST("/reset-link/:id", manageable, handlers.CreatePasswordResetLink(db))
+		usersManage.POST("/unlock-user/:id", manageable, handlers.UnlockUser(db))
+		usersManage.PUT("/user/:id", manageable, handlers.UpdateUser(db))
+		usersManage.PUT("/user-quota/:id", manageable, handlers.SetUserQuota(db))
+		usersManage.POST("/suspend-user/:id", manageable, handlers.SuspendUser(db))
+		usersManage.POST("/reactivate-user/:id", manageable, handlers.ReactivateUser(db))
+		usersManage.POST("/reset-2fa/:id", manageable, handlers.AdminResetTwoFactor(db))
+		usersManage.POST("/require-2fa/:id", manageable, handlers.AdminRequireTwoFactor(db))
+		usersManage.POST("/invites", handlers.CreateInviteCode(db))
+		usersManage.DELETE("/invite/:id", handlers.DeleteInviteCode(db))
+		usersManage.POST("/approve-user/:id", handlers.ApproveUser(db))
+		usersManage.POST("/reject-user/:id", handlers.RejectUser(db))
+
+		tokensManage := admin.Group("/", middleware.RequirePermission(models.PermissionTokensManage))
+		tokensManage.POST("/transfer/preview", handlers.PreviewTransfer(db))
+		tokensManage.POST("/transfer", handlers.ExecuteTransfer(db))
+		tokensManage.GET("/transfers", handlers.GetTransfers(db))
+
+		admin.DELETE("/delete-user/:id", middleware.RequirePermission(models.PermissionUsersDelete), handlers.DeleteUser(db))
+		admin.PUT("/user-role/:id", middleware.RequirePermission(models.PermissionRolesManage), handlers.SetUserRole(db))
+
+		auditRead := admin.Group("/", middleware.RequirePermission(models.PermissionAuditRead))
+		auditRead.GET("/audit", handlers.GetAuditEvents(db))
+		auditRead.GET("/audit/verify", handlers.VerifyAuditLog(db))
+
+		admin.GET("/settings", middleware.RequirePermission(models.PermissionSettingsRead), handlers.GetSettings(db))
+		admin.PUT("/settings", middleware.RequirePermission(models.PermissionSettingsManage), handlers.UpdateSettings(db))
 	}
 
 	return r
 }
 
-func initDB() {
-	var err error
+// 读取以逗号分隔的环境变量，未设置时返回 nil
+func getEnvList(name string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(name), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// 读取布尔型环境变量，未设置时返回 false
+func getEnvBool(name string) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return false
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("Invalid %s %q", name, value)
+	}
+	return parsed
+}
+
+func getDBPath() string {
 	dbPath := os.Getenv("DB_PATH")
 	if dbPath == "" {
 		dbPath = "email_manager.db"
 	}
-	db, err = gorm.Open(sqlite.Open(dbPath), &gorm.Config{})
+	return dbPath
+}
+
+// 判断两个路径是否位于同一目录
+func sameDir(a, b string) bool {
+	dirA, errA := filepath.Abs(filepath.Dir(a))
+	dirB, errB := filepath.Abs(filepath.Dir(b))
+	return errA == nil && errB == nil && dirA == dirB
+}
+
+func initDB() {
+	var err error
+	db, err = gorm.Open(sqlite.Open(getDBPath()), &gorm.Config{})
 	if err != nil {
 		log.Fatal("Failed to connect database:", err)
 	}
 
 	// 自动迁移模式
-	err = db.AutoMigrate(&models.User{}, &models.Address{}, &models.Token{})
+	err = db.AutoMigrate(&models.User{}, &models.Address{}, &models.Token{}, &models.DataKey{}, &models.HashKey{}, &models.TokenRevision{}, &models.TokenUsage{}, &models.Session{}, &models.APIKey{}, &models.Setting{}, &models.RecoveryCode{}, &models.LoginChallenge{}, &models.WebAuthnCredential{}, &models.WebAuthnChallenge{}, &models.OIDCState{}, &models.LoginThrottle{}, &models.PasswordHistory{}, &models.InviteCode{}, &models.PasswordResetToken{}, &models.Organization{}, &models.OrganizationMember{}, &models.OrganizationUsage{}, &models.AddressShare{}, &models.OwnershipTransfer{}, &models.AuditEvent{})
 	if err != nil {
 		log.Fatal("Failed to auto migrate:", err)
 	}
+	if err := services.DropLegacySessionTokens(db); err != nil {
+		log.Fatal("Failed to remove legacy session tokens:", err)
+	}
+	if err := services.EnsureAuditLogAppendOnly(db); err != nil {
+		log.Fatal("Failed to protect audit log:", err)
+	}
 	log.Println("Database migration completed successfully")
 }
 
+func initEncryption() *services.Keyring {
+	// 主密钥优先从 ENCRYPTION_KEY 读取，其次是密钥文件（默认与数据库放在同一目录）
+	keyFile := os.Getenv("ENCRYPTION_KEY_FILE")
+	if keyFile == "" {
+		keyFile = filepath.Join(filepath.Dir(getDBPath()), "master.key")
+	}
+	if os.Getenv("ENCRYPTION_KEY") == "" && sameDir(keyFile, getDBPath()) {
+		log.Printf("WARNING: the master key file %s is stored next to the database. Anyone with a copy of this directory can decrypt all tokens and addresses. Set ENCRYPTION_KEY or point ENCRYPTION_KEY_FILE outside the data directory.", keyFile)
+	}
+	masterKey, err := services.LoadMasterKey(os.Getenv("ENCRYPTION_KEY"), keyFile)
+	if err != nil {
+		log.Fatal("Failed to load master key:", err)
+	}
+	previousKeys, err := services.ParseMasterKeys(os.Getenv("ENCRYPTION_PREVIOUS_KEYS"))
+	if err != nil {
+		log.Fatal("Failed to parse previous master keys:", err)
+	}
+
+	keyring, err := services.InitEncryption(db, masterKey, previousKeys)
+	if err != nil {
+		log.Fatal("Failed to initialize encryption:", err)
+	}
+	models.SetFieldCipher(keyring)
+
+	// ENCRYPTION_MIGRATE_PLAINTEXT=true 时重新加密导入的明文数据
+	if err := services.EncryptPlaintextFields(db, getEnvBool("ENCRYPTION_MIGRATE_PLAINTEXT")); err != nil {
+		log.Fatal("Failed to encrypt existing data:", err)
+	}
+	if err := services.MigrateTokenData(db); err != nil {
+		log.Fatal("Failed to migrate token data:", err)
+	}
+	return keyring
+}
+
+func initSessions(keyring *services.Keyring) {
+	// 会话有效期，例如 SESSION_TTL=72h
+	if ttl := os.Getenv("SESSION_TTL"); ttl != "" {
+		duration, err := time.ParseDuration(ttl)
+		if err != nil || duration <= 0 {
+			log.Fatalf("Invalid SESSION_TTL %q", ttl)
+		}
+		services.SetSessionTTL(duration)
+	}
+
+	// 会话 token 的哈希密钥随机生成后由主密钥包装保存，更换主密钥不会使会话失效
+	sessionKey, err := keyring.HashKey(db, "session-token")
+	if err != nil {
+		log.Fatal("Failed to load session hash key:", err)
+	}
+	services.SetSessionHashKey(sessionKey)
+
+	// API Key 的哈希密钥同样单独保存，更换主密钥后已有的 API Key 仍然可用
+	apiKeyKey, err := keyring.HashKey(db, "api-key")
+	if err != nil {
+		log.Fatal("Failed to load API key hash key:", err)
+	}
+	services.SetAPIKeyHashKey(apiKeyKey)
+
+	recoveryCodeKey, err := keyring.HashKey(db, "recovery-code")
+	if err != nil {
+		log.Fatal("Failed to load recovery code hash key:", err)
+	}
+	services.SetRecoveryCodeHashKey(recoveryCodeKey)
+}
+
+func initTwoFactor() {
+	// REQUIRE_2FA 作为全局设置的默认值，管理员可以在运行时修改
+	if require := os.Getenv("REQUIRE_2FA"); require != "" {
+		if _, err := strconv.ParseBool(require); err != nil {
+			log.Fatalf("Invalid REQUIRE_2FA %q", require)
+		}
+		services.SetSettingDefault(services.SettingRequire2FA, require)
+	}
+	if issuer := os.Getenv("TOTP_ISSUER"); issuer != "" {
+		services.SetTOTPIssuer(issuer)
+	}
+
+	// 未配置 WEBAUTHN_RP_ID 时使用请求的域名，生产环境建议显式配置
+	rpID := os.Getenv("WEBAUTHN_RP_ID")
+	origins := getEnvList("WEBAUTHN_ORIGINS")
+	if rpID != "" && len(origins) == 0 {
+		origins = []string{"https://" + rpID}
+	}
+	services.SetWebAuthnConfig(rpID, os.Getenv("WEBAUTHN_RP_NAME"), origins)
+}
+
+func initPasswordPolicy() {
+	policy := services.GetPasswordPolicy()
+	for name, target := range map[string]*int{
+		"PASSWORD_MIN_LENGTH":  &policy.MinLength,
+		"PASSWORD_MIN_CLASSES": &policy.MinCharClasses,
+		"PASSWORD_HISTORY":     &policy.HistorySize,
+	} {
+		if value := os.Getenv(name); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				log.Fatalf("Invalid %s %q", name, value)
+			}
+			*target = parsed
+		}
+	}
+	if policy.MinCharClasses > 4 {
+		log.Fatalf("Invalid PASSWORD_MIN_CLASSES %d", policy.MinCharClasses)
+	}
+	services.SetPasswordPolicy(policy)
+
+	// 已泄露密码列表，每行一个密码或 SHA-1 值
+	if path := os.Getenv("PASSWORD_BREACHED_LIST"); path != "" {
+		count, err := services.LoadBreachedPasswords(path)
+		if err != nil {
+			log.Fatal("Failed to load PASSWORD_BREACHED_LIST:", err)
+		}
+		log.Printf("Loaded %d breached passwords", count)
+	}
+
+	// 管理员生成的重置密码链接的有效期
+	if value := os.Getenv("PASSWORD_RESET_TTL"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			log.Fatalf("Invalid PASSWORD_RESET_TTL %q", value)
+		}
+		services.SetPasswordResetTTL(duration)
+	}
+
+	// 新密码的哈希算法，已有的 bcrypt 哈希在用户下次登录时自动升级
+	algorithm := os.Getenv("PASSWORD_HASH_ALGORITHM")
+	if algorithm == "" {
+		algorithm = services.PasswordHashArgon2id
+	}
+	params := services.GetArgon2Params()
+	for name, target := range map[string]*uint32{
+		"ARGON2_MEMORY":     &params.Memory,
+		"ARGON2_ITERATIONS": &params.Iterations,
+	} {
+		if value := os.Getenv(name); value != "" {
+			parsed, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				log.Fatalf("Invalid %s %q", name, value)
+			}
+			*target = uint32(parsed)
+		}
+	}
+	if value := os.Getenv("ARGON2_PARALLELISM"); value != "" {
+		parsed, err := strconv.ParseUint(value, 10, 8)
+		if err != nil {
+			log.Fatalf("Invalid ARGON2_PARALLELISM %q", value)
+		}
+		params.Parallelism = uint8(parsed)
+	}
+	if err := services.SetPasswordHashing(algorithm, params); err != nil {
+		log.Fatal("Invalid password hashing configuration: ", err)
+	}
+}
+
+func initRegistration() {
+	// REGISTRATION_MODE 作为全局设置的默认值，管理员可以在运行时修改
+	if mode := os.Getenv("REGISTRATION_MODE"); mode != "" {
+		if !services.ValidRegistrationMode(mode) {
+			log.Fatalf("Invalid REGISTRATION_MODE %q", mode)
+		}
+		services.SetSettingDefault(services.SettingRegistrationMode, mode)
+	}
+}
+
+func initQuotas() {
+	// 作为全局设置的默认值，管理员可以在运行时修改，0 表示不限制
+	for name, key := range map[string]string{
+		"QUOTA_MAX_ADDRESSES":     services.SettingQuotaMaxAddresses,
+		"QUOTA_ADDRESSES_PER_DAY": services.SettingQuotaAddressesPerDay,
+		"QUOTA_MAX_TOKENS":        services.SettingQuotaMaxTokens,
+	} {
+		if value := os.Getenv(name); value != "" {
+			if parsed, err := strconv.Atoi(value); err != nil || parsed < 0 {
+				log.Fatalf("Invalid %s %q", name, value)
+			}
+			services.SetSettingDefault(key, value)
+		}
+	}
+}
+
+func initLoginThrottle() {
+	// 账户连续登录失败 LOGIN_MAX_FAILURES 次后锁定 LOGIN_LOCKOUT_DURATION，设置为 0 关闭锁定
+	maxFailures, lockout := 10, 15*time.Minute
+	if value := os.Getenv("LOGIN_MAX_FAILURES"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			log.Fatalf("Invalid LOGIN_MAX_FAILURES %q", value)
+		}
+		maxFailures = parsed
+	}
+	if value := os.Getenv("LOGIN_LOCKOUT_DURATION"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			log.Fatalf("Invalid LOGIN_LOCKOUT_DURATION %q", value)
+		}
+		lockout = duration
+	}
+	services.SetAccountLockout(maxFailures, lockout)
+}
+
+func initExternalAuth() {
+	services.SetOIDCConfig(services.OIDCConfig{
+		Issuer:        os.Getenv("OIDC_ISSUER"),
+		ClientID:      os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:   os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:        strings.Fields(os.Getenv("OIDC_SCOPES")),
+		UsernameClaim: os.Getenv("OIDC_USERNAME_CLAIM"),
+		GroupsClaim:   os.Getenv("OIDC_GROUPS_CLAIM"),
+		AdminGroup:    os.Getenv("OIDC_ADMIN_GROUP"),
+		DisplayName:   os.Getenv("OIDC_PROVIDER_NAME"),
+	})
+	if services.OIDCEnabled() {
+		if services.OIDCRedirectURL() == "" {
+			log.Fatal("OIDC_REDIRECT_URL is required when OpenID Connect is enabled")
+		}
+		log.Printf("OpenID Connect login enabled for issuer %s", os.Getenv("OIDC_ISSUER"))
+	}
+
+	services.SetLDAPConfig(services.LDAPConfig{
+		URL:                os.Getenv("LDAP_URL"),
+		StartTLS:           getEnvBool("LDAP_STARTTLS"),
+		InsecureSkipVerify: getEnvBool("LDAP_INSECURE_SKIP_VERIFY"),
+		BindDN:             os.Getenv("LDAP_BIND_DN"),
+		BindPassword:       os.Getenv("LDAP_BIND_PASSWORD"),
+		BaseDN:             os.Getenv("LDAP_BASE_DN"),
+		UserFilter:         os.Getenv("LDAP_USER_FILTER"),
+		UsernameAttribute:  os.Getenv("LDAP_USERNAME_ATTRIBUTE"),
+		IDAttribute:        os.Getenv("LDAP_ID_ATTRIBUTE"),
+		GroupAttribute:     os.Getenv("LDAP_GROUP_ATTRIBUTE"),
+		AdminGroup:         os.Getenv("LDAP_ADMIN_GROUP"),
+	})
+	if services.LDAPEnabled() {
+		log.Printf("LDAP login enabled for %s", os.Getenv("LDAP_URL"))
+	}
+
+	// 只有来自 TRUSTED_AUTH_PROXIES 的请求才会信任其中的用户名请求头
+	err := services.SetProxyAuthConfig(services.ProxyAuthConfig{
+		TrustedProxies: getEnvList("TRUSTED_AUTH_PROXIES"),
+		UserHeader:     os.Getenv("PROXY_AUTH_USER_HEADER"),
+		GroupsHeader:   os.Getenv("PROXY_AUTH_GROUPS_HEADER"),
+		AdminGroup:     os.Getenv("PROXY_AUTH_ADMIN_GROUP"),
+	})
+	if err != nil {
+		log.Fatal("Invalid TRUSTED_AUTH_PROXIES:", err)
+	}
+	if services.ProxyAuthEnabled() {
+		log.Println("Reverse proxy authentication enabled")
+	}
+
+	// 默认按注册模式处理外部身份源的新用户，*_AUTO_PROVISION=true 时总是直接创建
+	services.SetExternalAutoProvision(models.AuthProviderOIDC, getEnvBool("OIDC_AUTO_PROVISION"))
+	services.SetExternalAutoProvision(models.AuthProviderLDAP, getEnvBool("LDAP_AUTO_PROVISION"))
+	services.SetExternalAutoProvision(models.AuthProviderProxy, getEnvBool("PROXY_AUTH_AUTO_PROVISION"))
+
+	if disable := os.Getenv("DISABLE_PASSWORD_LOGIN"); disable != "" {
+		disabled, err := strconv.ParseBool(disable)
+		if err != nil {
+			log.Fatalf("Invalid DISABLE_PASSWORD_LOGIN %q", disable)
+		}
+		if disabled && !services.OIDCEnabled() && !services.LDAPEnabled() && !services.ProxyAuthEnabled() {
+			log.Println("Warning: password login is disabled but no single sign-on provider is configured")
+		}
+		services.SetPasswordLoginDisabled(disabled)
+	}
+}
+
+func startDirectorySync() {
+	if !services.LDAPEnabled() {
+		return
+	}
+	// 同步间隔，例如 LDAP_SYNC_INTERVAL=1h，设置为 0 关闭同步
+	interval := time.Hour
+	if value := os.Getenv("LDAP_SYNC_INTERVAL"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration < 0 {
+			log.Fatalf("Invalid LDAP_SYNC_INTERVAL %q", value)
+		}
+		interval = duration
+	}
+	services.StartLDAPSync(db, interval)
+}
+
 func createAdminIfNotExists() {
 	var count int64
 	if err := db.Model(&models.User{}).Count(&count).Error; err != nil {
@@ -151,20 +621,28 @@ func createAdminIfNotExists() {
 		return
 	}
 	if count == 0 {
+		// 未设置 ADMIN_PASSWORD 时生成随机密码，只在日志中显示一次，首次登录后必须修改
 		adminPassword := os.Getenv("ADMIN_PASSWORD")
-		if adminPassword == "" {
-			adminPassword = "admin" // 默认密码
-			log.Println("Warning: ADMIN_PASSWORD not set. Using default password 'admin'. Please change it immediately.")
+		generated := adminPassword == ""
+		if generated {
+			password, err := services.GenerateRandomPassword()
+			if err != nil {
+				log.Printf("Error generating admin password: %v", err)
+				return
+			}
+			adminPassword = password
 		}
 		err := db.Transaction(func(tx *gorm.DB) error {
-			hashedPassword, err := bcrypt.GenerateFromPassword([]byte(adminPassword), bcrypt.DefaultCost)
+			hashedPassword, err := services.HashPassword(adminPassword)
 			if err != nil {
 				return fmt.Errorf("failed to hash admin password: %w", err)
 			}
 			admin := models.User{
 				Username:     "admin",
-				PasswordHash: string(hashedPassword),
+				PasswordHash: hashedPassword,
 				IsAdmin:      true,
+				// 生成的密码出现在日志里，首次登录后必须修改
+				NeedsPasswordReset: generated,
 			}
 			if err := tx.Create(&admin).Error; err != nil {
 				return fmt.Errorf("failed to create admin user: %w", err)
@@ -175,6 +653,10 @@ func createAdminIfNotExists() {
 			log.Printf("Error creating admin user: %v", err)
 			return
 		}
+		if generated {
+			log.Printf("ADMIN_PASSWORD not set. Created default admin account. Username: admin, password: %s", adminPassword)
+			return
+		}
 		log.Println("Created default admin account. Username: admin")
 	}
 }
@@ -2,8 +2,11 @@ package middleware
 
 import (
 	"anonymail/models"
+	"anonymail/services"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
@@ -12,6 +15,31 @@ import (
 func AuthRequired(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		token := c.GetHeader("Authorization")
+		proxyUser, proxyGroups, fromProxy := services.ProxyIdentity(c.Request)
+
+		// 可信代理已经完成认证，没有携带 token 时直接使用代理转发的身份
+		if token == "" && fromProxy {
+			user, err := services.ProxyAuthLogin(db, proxyUser, proxyGroups)
+			if err != nil {
+				log.Printf("Proxy authentication failed for %s: %v", proxyUser, err)
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Proxy authentication failed"})
+				c.Abort()
+				return
+			}
+			if user.Disabled {
+				log.Printf("Proxy authentication for disabled user: %s", user.Username)
+				c.JSON(http.StatusForbidden, gin.H{"error": "Account is disabled"})
+				c.Abort()
+				return
+			}
+
+			log.Printf("User authenticated by proxy: %s (ID: %d)", user.Username, user.ID)
+			c.Set("user", user)
+			c.Set("proxy_auth", true)
+			c.Next()
+			return
+		}
+
 		if token == "" {
 			log.Println("No Authorization token provided")
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization token required"})
@@ -19,21 +47,48 @@ func AuthRequired(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		var user models.User
-		if err := db.Where("token = ?", token).First(&user).Error; err != nil {
+		token = strings.TrimPrefix(token, "Bearer ")
+
+		// 以 API Key 前缀开头的按 API Key 校验
+		if strings.HasPrefix(token, services.APIKeyPrefix) {
+			apiKey, user, err := services.ValidateAPIKey(db, token, c.ClientIP())
+			if err != nil {
+				log.Printf("Invalid API key: %v", err)
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+				c.Abort()
+				return
+			}
+
+			log.Printf("User authenticated with API key %d: %s (ID: %d)", apiKey.ID, user.Username, user.ID)
+			c.Set("user", user)
+			c.Set("api_key", apiKey)
+			c.Next()
+			return
+		}
+
+		session, user, err := services.ValidateSession(db, token, c.ClientIP())
+		if err != nil {
 			log.Printf("Invalid token: %v", err)
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 			c.Abort()
 			return
 		}
+		if fromProxy && !services.ProxyIdentityMatches(user, proxyUser) {
+			log.Printf("Session of user %d does not match proxy user %s", user.ID, proxyUser)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			c.Abort()
+			return
+		}
 
 		log.Printf("User authenticated: %s (ID: %d)", user.Username, user.ID)
 		c.Set("user", user)
+		c.Set("session", session)
 		c.Next()
 	}
 }
 
-func AdminRequired() gin.HandlerFunc {
+// 拥有任意管理权限的用户才能访问管理接口，具体操作再按权限检查
+func StaffRequired() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		user, exists := c.Get("user")
 		if !exists {
@@ -42,7 +97,7 @@ func AdminRequired() gin.HandlerFunc {
 			return
 		}
 
-		if !user.(models.User).IsAdmin {
+		if !services.IsStaff(user.(models.User)) {
 			c.JSON(http.StatusForbidden, gin.H{"error": "Admin privileges required"})
 			c.Abort()
 			return
@@ -51,3 +106,120 @@ func AdminRequired() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+func RequirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !services.HasPermission(c.MustGet("user").(models.User), permission) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Missing permission: " + permission})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// 路径参数 id 指向的用户必须是当前用户可以管理的账户，拥有管理角色的账户只能由完整管理员操作
+func ManageableUserRequired(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil || id == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+			c.Abort()
+			return
+		}
+		var target models.User
+		if err := db.First(&target, uint(id)).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			c.Abort()
+			return
+		}
+		if !services.CanManageUser(c.MustGet("user").(models.User), target) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only administrators can manage accounts with admin roles"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// 使用 API Key 访问时要求具有指定的权限范围，会话登录不受限制
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if apiKey, ok := c.Get("api_key"); ok && !services.APIKeyHasScope(apiKey.(models.APIKey), scope) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "API key lacks required scope: " + scope})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// 只允许通过登录会话访问，例如修改密码、管理会话和 API Key
+func SessionRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get("session"); !ok {
+			c.JSON(http.StatusForbidden, gin.H{"error": "This endpoint requires an interactive session"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// 被要求开启两步验证但尚未设置的用户，只能访问设置两步验证所需的接口
+var twoFactorSetupPaths = map[string]bool{
+	"/check-auth":      true,
+	"/logout":          true,
+	"/change-password": true,
+	"/2fa/status":      true,
+	"/2fa/setup":       true,
+	"/2fa/enable":      true,
+
+	"/webauthn/credentials":      true,
+	"/webauthn/register/options": true,
+	"/webauthn/register":         true,
+}
+
+func TwoFactorSetupRequired(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// API Key 只能在完成登录后创建，不受此限制
+		if _, ok := c.Get("session"); !ok {
+			c.Next()
+			return
+		}
+
+		user := c.MustGet("user").(models.User)
+		pending, err := services.TwoFactorSetupPending(db, user)
+		if err != nil {
+			log.Printf("Failed to check two-factor requirement for user %d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check two-factor requirement"})
+			c.Abort()
+			return
+		}
+		if pending && !twoFactorSetupPaths[c.FullPath()] {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Two-factor authentication setup required"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// 管理员重置密码后，用户在修改密码之前只能访问修改密码所需的接口
+var passwordResetPaths = map[string]bool{
+	"/check-auth":      true,
+	"/logout":          true,
+	"/change-password": true,
+}
+
+func PasswordResetRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(models.User)
+		if user.NeedsPasswordReset && !passwordResetPaths[c.FullPath()] {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Password change required"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
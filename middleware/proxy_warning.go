@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"log"
+	"net"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 未配置可信代理时使用。请求经由本机或内网的代理转发时，所有客户端都会共用代理的 IP，
+// 登录限速会互相影响，因此在第一次发现这种请求时输出警告
+func UntrustedProxyWarning() gin.HandlerFunc {
+	var once sync.Once
+	return func(c *gin.Context) {
+		if c.GetHeader("X-Forwarded-For") != "" {
+			host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+			if ip := net.ParseIP(host); err == nil && ip != nil && (ip.IsLoopback() || ip.IsPrivate()) {
+				once.Do(func() {
+					log.Printf("WARNING: received a request with X-Forwarded-For from %s, but TRUSTED_PROXIES is not set. All clients behind this proxy share its IP address, so failed logins from anyone throttle everyone. Set TRUSTED_PROXIES to the proxy's address.", host)
+				})
+			}
+		}
+		c.Next()
+	}
+}
@@ -8,8 +8,12 @@ type Address struct {
 	gorm.Model
 	UserID           uint
 	GeneratedAddress string
-	RealAddress      string
-	ConvertedAddress string // 添加这个字段
-	TokenValue       string
+	RealAddress      EncryptedString
+	ConvertedAddress EncryptedString
+	TokenID          uint `gorm:"index"`
+	// 组织 Token 生成的地址不保存 Token 值
+	TokenValue       EncryptedString
 	TokenDescription string
+	// 使用组织 Token 生成的地址属于该组织
+	OrganizationID uint `gorm:"index"`
 }
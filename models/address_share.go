@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+)
+
+// 共享地址的权限
+const (
+	SharePermissionView = "view"
+	SharePermissionEdit = "edit"
+)
+
+// AddressShare 把单个地址共享给其他用户，地址的所有者不变。撤销时直接删除记录
+type AddressShare struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	AddressID uint `gorm:"uniqueIndex:idx_address_share"`
+	UserID    uint `gorm:"uniqueIndex:idx_address_share;index"`
+	// 授权人，即地址的所有者
+	GrantedBy  uint
+	Permission string
+}
@@ -0,0 +1,30 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// API Key 的权限范围
+const (
+	ScopeReadAddresses = "addresses:read"
+	ScopeGenerate      = "addresses:generate"
+	ScopeManageTokens  = "tokens:manage"
+	ScopeAdmin         = "admin"
+)
+
+// APIKey 是供脚本和集成使用的长期凭证，数据库中只保存其哈希
+type APIKey struct {
+	gorm.Model
+	UserID     uint `gorm:"index"`
+	Name       string
+	Prefix     string
+	KeyHash    string `gorm:"uniqueIndex"`
+	Scopes     string
+	AllowedIPs string
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	LastUsedIP string
+	RevokedAt  *time.Time
+}
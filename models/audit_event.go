@@ -0,0 +1,69 @@
+package models
+
+import (
+	"time"
+)
+
+// 审计事件类型
+const (
+	AuditLogin             = "auth.login"
+	AuditLoginFailed       = "auth.login_failed"
+	AuditLogout            = "auth.logout"
+	AuditPasswordChanged   = "account.password_changed"
+	AuditTwoFactorEnabled  = "account.2fa_enabled"
+	AuditTwoFactorDisabled = "account.2fa_disabled"
+	AuditAPIKeyCreated     = "account.api_key_created"
+	AuditAPIKeyRevoked     = "account.api_key_revoked"
+	AuditTokenAdded        = "token.added"
+	AuditTokenReplaced     = "token.replaced"
+	AuditTokenRevealed     = "token.revealed"
+	AuditTokenDeleted      = "token.deleted"
+	AuditAddressCreated    = "address.created"
+	AuditAddressDeleted    = "address.deleted"
+	AuditAddressUpdated    = "address.updated"
+	AuditAddressShared     = "address.shared"
+	AuditAddressUnshared   = "address.unshared"
+	AuditOrgCreated        = "organization.created"
+	AuditOrgDeleted        = "organization.deleted"
+	AuditOrgMemberAdded    = "organization.member_added"
+	AuditOrgMemberUpdated  = "organization.member_updated"
+	AuditOrgMemberRemoved  = "organization.member_removed"
+	AuditOrgTokenAdded     = "organization.token_added"
+	AuditOrgTokenDeleted   = "organization.token_deleted"
+	AuditUserCreated       = "admin.user_created"
+	AuditUserApproved      = "admin.user_approved"
+	AuditUserRejected      = "admin.user_rejected"
+	AuditUserUpdated       = "admin.user_updated"
+	AuditUserDeleted       = "admin.user_deleted"
+	AuditUserSuspended     = "admin.user_suspended"
+	AuditUserReactivated   = "admin.user_reactivated"
+	AuditUserUnlocked      = "admin.user_unlocked"
+	AuditPasswordReset     = "admin.password_reset"
+	AuditTwoFactorReset    = "admin.2fa_reset"
+	AuditRoleChanged       = "admin.role_changed"
+	AuditQuotaChanged      = "admin.quota_changed"
+	AuditSettingsChanged   = "admin.settings_changed"
+	AuditOwnershipTransfer = "admin.ownership_transferred"
+)
+
+// AuditEvent 只追加不修改，每条记录的哈希包含上一条记录的哈希，修改或删除记录后校验会失败
+type AuditEvent struct {
+	ID        uint      `gorm:"primarykey"`
+	CreatedAt time.Time `gorm:"index"`
+	// 执行操作的用户，登录失败等匿名事件为 0，ActorName 保存当时的用户名
+	ActorID    uint `gorm:"index"`
+	ActorName  string
+	Action     string `gorm:"index"`
+	TargetType string
+	TargetID   uint
+	// 事件涉及的账户，用户可以查看自己账户的活动
+	UserID    uint `gorm:"index"`
+	IP        string
+	UserAgent string
+	RequestID string
+	// 操作前后的摘要（JSON），不包含密码和 Token 值
+	Before   string
+	After    string
+	PrevHash string
+	Hash     string `gorm:"uniqueIndex"`
+}
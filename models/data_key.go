@@ -0,0 +1,13 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+// DataKey 是用主密钥包装后的数据加密密钥
+type DataKey struct {
+	gorm.Model
+	MasterKeyID string
+	WrappedKey  string
+	Active      bool
+}
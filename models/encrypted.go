@@ -0,0 +1,84 @@
+package models
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+)
+
+// 加密字段在数据库中的前缀，没有该前缀的非空值是尚未迁移的明文数据
+const EncryptedPrefix = "enc:"
+
+type FieldCipher interface {
+	Encrypt(plaintext string) (string, error)
+	Decrypt(ciphertext string) (string, error)
+}
+
+var (
+	fieldCipher FieldCipher
+	// 只在加密旧明文数据的迁移过程中允许读取没有前缀的值
+	allowPlaintext bool
+)
+
+// 在初始化数据库之后、读写任何加密字段之前调用
+func SetFieldCipher(c FieldCipher) {
+	fieldCipher = c
+}
+
+// 迁移旧明文数据前开启，迁移完成后关闭，之后直接写入数据库的明文值会被拒绝
+func AllowPlaintextFields(allow bool) {
+	allowPlaintext = allow
+}
+
+// EncryptedString 写入数据库时自动加密，读取时自动解密
+type EncryptedString string
+
+func (s EncryptedString) Value() (driver.Value, error) {
+	if s == "" {
+		return "", nil
+	}
+	if fieldCipher == nil {
+		return nil, fmt.Errorf("field cipher not configured")
+	}
+	return fieldCipher.Encrypt(string(s))
+}
+
+func (s *EncryptedString) Scan(value interface{}) error {
+	var raw string
+	switch v := value.(type) {
+	case nil:
+		*s = ""
+		return nil
+	case string:
+		raw = v
+	case []byte:
+		raw = string(v)
+	default:
+		return fmt.Errorf("unsupported type %T for encrypted field", value)
+	}
+
+	if !strings.HasPrefix(raw, EncryptedPrefix) {
+		if raw != "" && !allowPlaintext {
+			return fmt.Errorf("unencrypted value in encrypted field")
+		}
+		*s = EncryptedString(raw)
+		return nil
+	}
+	if fieldCipher == nil {
+		return fmt.Errorf("field cipher not configured")
+	}
+	plaintext, err := fieldCipher.Decrypt(raw)
+	if err != nil {
+		return err
+	}
+	*s = EncryptedString(plaintext)
+	return nil
+}
+
+func (EncryptedString) GormDataType() string {
+	return "text"
+}
+
+func (s EncryptedString) String() string {
+	return string(s)
+}
@@ -0,0 +1,13 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+// HashKey 是用主密钥包装后的 HMAC 密钥，每种用途一个，更换主密钥时只重新包装
+type HashKey struct {
+	gorm.Model
+	Purpose     string `gorm:"uniqueIndex"`
+	MasterKeyID string
+	WrappedKey  string
+}
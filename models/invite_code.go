@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// InviteCode 是管理员生成的注册邀请码，数据库中只保存其哈希
+type InviteCode struct {
+	gorm.Model
+	CreatedByID uint
+	Note        string
+	Prefix      string
+	CodeHash    string `gorm:"uniqueIndex"`
+	// MaxUses 为 0 表示不限次数
+	MaxUses   int
+	Uses      int
+	ExpiresAt *time.Time
+}
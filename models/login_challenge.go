@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 待完成登录的类型
+const (
+	LoginChallengeMFA = "mfa"
+	LoginChallengeSSO = "sso"
+)
+
+// LoginChallenge 记录已通过第一步验证、等待客户端完成的登录：
+// 密码登录后等待第二步验证，或单点登录回调后等待前端换取会话
+type LoginChallenge struct {
+	gorm.Model
+	UserID    uint `gorm:"index"`
+	Purpose   string
+	TokenHash string `gorm:"uniqueIndex"`
+	ExpiresAt time.Time
+	Attempts  int
+}
@@ -0,0 +1,15 @@
+package models
+
+import (
+	"time"
+)
+
+// LoginThrottle 记录某个来源 IP 或账户最近的失败次数，用于限速和临时锁定。
+// 按用户名而不是用户 ID 记录，不存在的用户名也会被同样限制，避免泄露账户是否存在
+type LoginThrottle struct {
+	ID            uint   `gorm:"primarykey"`
+	Key           string `gorm:"uniqueIndex"`
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// OIDCState 记录已跳转到身份提供方、等待回调的单点登录请求
+type OIDCState struct {
+	gorm.Model
+	StateHash    string `gorm:"uniqueIndex"`
+	Nonce        string
+	CodeVerifier string
+	RedirectURL  string
+	ExpiresAt    time.Time
+}
@@ -0,0 +1,35 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+// 组织成员的角色
+const (
+	OrganizationRoleOwner  = "owner"
+	OrganizationRoleMember = "member"
+)
+
+// Organization 拥有共享的 Token，成员可以用它们生成地址，但看不到 Token 的值
+type Organization struct {
+	gorm.Model
+	Name string `gorm:"unique"`
+}
+
+type OrganizationMember struct {
+	gorm.Model
+	OrganizationID uint `gorm:"uniqueIndex:idx_organization_member"`
+	UserID         uint `gorm:"uniqueIndex:idx_organization_member;index"`
+	Role           string
+}
+
+// OrganizationUsage 按天汇总每个成员使用组织 Token 的情况
+type OrganizationUsage struct {
+	ID             uint   `gorm:"primarykey"`
+	OrganizationID uint   `gorm:"index"`
+	UserID         uint   `gorm:"uniqueIndex:idx_organization_usage_day"`
+	TokenID        uint   `gorm:"uniqueIndex:idx_organization_usage_day"`
+	Day            string `gorm:"uniqueIndex:idx_organization_usage_day"`
+	Generated      int64
+	Failures       int64
+}
@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+)
+
+// OwnershipTransfer 记录管理员把地址和 Token 从一个用户转移给另一个用户
+type OwnershipTransfer struct {
+	ID          uint `gorm:"primarykey"`
+	CreatedAt   time.Time
+	FromUserID  uint `gorm:"index"`
+	ToUserID    uint `gorm:"index"`
+	PerformedBy uint
+	// 以逗号分隔的 ID 列表
+	AddressIDs string
+	TokenIDs   string
+}
@@ -0,0 +1,12 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+// PasswordHistory 保存用户以前使用过的密码哈希，用于禁止重复使用最近的密码
+type PasswordHistory struct {
+	gorm.Model
+	UserID       uint `gorm:"index"`
+	PasswordHash string
+}
@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PasswordResetToken 是管理员生成的一次性重置密码链接，数据库中只保存其哈希。
+// 使用后保留记录，便于查看链接何时从哪里被使用
+type PasswordResetToken struct {
+	gorm.Model
+	UserID        uint `gorm:"index"`
+	CreatedByID   uint
+	TokenHash     string `gorm:"uniqueIndex"`
+	ExpiresAt     time.Time
+	UsedAt        *time.Time
+	UsedIP        string
+	UsedUserAgent string
+}
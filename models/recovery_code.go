@@ -0,0 +1,15 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RecoveryCode 是两步验证的一次性恢复码，只保存哈希
+type RecoveryCode struct {
+	gorm.Model
+	UserID   uint `gorm:"index"`
+	CodeHash string
+	UsedAt   *time.Time
+}
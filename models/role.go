@@ -0,0 +1,23 @@
+package models
+
+// 管理权限，完整管理员（IsAdmin）拥有全部权限
+const (
+	PermissionUsersRead      = "users:read"
+	PermissionUsersManage    = "users:manage"
+	PermissionUsersDelete    = "users:delete"
+	PermissionRolesManage    = "roles:manage"
+	PermissionSettingsRead   = "settings:read"
+	PermissionSettingsManage = "settings:manage"
+	PermissionTokensManage   = "tokens:manage-all"
+	PermissionAuditRead      = "audit:read"
+)
+
+// 可以分配给非管理员用户的角色，普通用户为空
+const (
+	RoleNone         = ""
+	RoleAdmin        = "admin"
+	RoleUserManager  = "user-manager"
+	RoleAuditor      = "auditor"
+	RoleTokenManager = "token-manager"
+	RoleSupport      = "support"
+)
@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Session 每次登录创建一个会话，每个设备互不影响
+type Session struct {
+	gorm.Model
+	UserID     uint   `gorm:"index"`
+	TokenHash  string `gorm:"uniqueIndex"`
+	UserAgent  string
+	IP         string
+	LastSeenAt time.Time
+	ExpiresAt  time.Time `gorm:"index"`
+}
@@ -0,0 +1,7 @@
+package models
+
+// Setting 保存管理员可在运行时修改的全局设置
+type Setting struct {
+	Key   string `gorm:"primarykey"`
+	Value string
+}
@@ -1,13 +1,18 @@
 package models
 
 import (
+	"time"
+
 	"gorm.io/gorm"
 )
 
 type Token struct {
 	gorm.Model
 	UserID      uint
-	Value       string
+	Value       EncryptedString
 	Description string
 	IsDefault   bool
+	LastUsedAt  *time.Time
+	// 组织共享的 Token 不属于任何用户，UserID 为 0
+	OrganizationID uint `gorm:"index"`
 }
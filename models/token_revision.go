@@ -0,0 +1,13 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+// TokenRevision 记录 Token 被替换之前的值
+type TokenRevision struct {
+	gorm.Model
+	TokenID uint `gorm:"index"`
+	UserID  uint
+	Value   EncryptedString
+}
@@ -0,0 +1,12 @@
+package models
+
+// TokenUsage 按天汇总单个 Token 的调用情况
+type TokenUsage struct {
+	ID             uint   `gorm:"primarykey"`
+	TokenID        uint   `gorm:"uniqueIndex:idx_token_usage_day"`
+	Day            string `gorm:"uniqueIndex:idx_token_usage_day"`
+	Generated      int64
+	Failures       int64
+	LatencyTotalMs int64
+	LatencyCount   int64
+}
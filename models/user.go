@@ -1,14 +1,48 @@
 package models
 
 import (
+	"time"
+
 	"gorm.io/gorm"
 )
 
+// 账户来源，本地账户为空
+const (
+	AuthProviderLocal = ""
+	AuthProviderOIDC  = "oidc"
+	AuthProviderLDAP  = "ldap"
+	AuthProviderProxy = "proxy"
+)
+
+// 账户被停用的原因
+const (
+	DisabledByDirectorySync = "directory_sync"
+	DisabledPendingApproval = "pending_approval"
+	DisabledSuspended       = "suspended"
+)
+
 type User struct {
 	gorm.Model
 	Username           string `gorm:"unique"`
 	PasswordHash       string
 	IsAdmin            bool
-	Token              string
 	NeedsPasswordReset bool
+	TOTPSecret         EncryptedString
+	TOTPEnabled        bool
+	TOTPRequired       bool
+	TOTPLastStep       int64
+	AuthProvider       string `gorm:"index:idx_users_external"`
+	ExternalID         string `gorm:"index:idx_users_external"`
+	// 非管理员用户的管理角色，完整管理员以 IsAdmin 为准
+	Role string
+	// 停用的账户不能登录，已有的会话和 API Key 也会失效
+	Disabled       bool
+	DisabledReason string
+	// 注册时使用的邀请码
+	InviteCodeID *uint
+	LastLoginAt  *time.Time
+	// 单独设置的配额，为空时使用全局默认值，0 表示不限制
+	QuotaMaxAddresses    *int
+	QuotaAddressesPerDay *int
+	QuotaMaxTokens       *int
 }
@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// WebAuthnCredential 是用户注册的安全密钥或通行密钥
+type WebAuthnCredential struct {
+	gorm.Model
+	UserID       uint `gorm:"index"`
+	Name         string
+	CredentialID string `gorm:"uniqueIndex"`
+	PublicKey    []byte
+	SignCount    uint32
+	Transports   string
+	LastUsedAt   *time.Time
+}
+
+// WebAuthnChallenge 记录进行中的注册或认证流程，使用后即删除
+type WebAuthnChallenge struct {
+	gorm.Model
+	UserID        uint `gorm:"index"`
+	Purpose       string
+	ChallengeHash string `gorm:"uniqueIndex"`
+	ExpiresAt     time.Time
+}
@@ -0,0 +1,132 @@
+package services
+
+import (
+	"errors"
+
+	"anonymail/models"
+
+	"gorm.io/gorm"
+)
+
+// 删除用户时如何处理其地址和 Token
+const (
+	// 保留地址和 Token，之后可以转移给其他用户
+	DeleteModeArchive = "archive"
+	// 连同地址和 Token 一起删除
+	DeleteModeCascade = "cascade"
+)
+
+var (
+	ErrSelfAction        = errors.New("cannot do this to your own account")
+	ErrNotSuspended      = errors.New("account is not suspended")
+	ErrAlreadyDisabled   = errors.New("account is already disabled")
+	ErrInvalidDeleteMode = errors.New("invalid delete mode")
+)
+
+// 暂停账户：保留所有数据，但不能登录，会话立即失效，API Key 在恢复前无法使用
+func SuspendUser(db *gorm.DB, actorID uint, userID uint) (models.User, error) {
+	if actorID == userID {
+		return models.User{}, ErrSelfAction
+	}
+	var user models.User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&user, userID).Error; err != nil {
+			return err
+		}
+		if user.Disabled {
+			return ErrAlreadyDisabled
+		}
+		if user.IsAdmin {
+			if err := EnsureOtherAdminExists(tx, user.ID); err != nil {
+				return err
+			}
+		}
+		user.Disabled = true
+		user.DisabledReason = models.DisabledSuspended
+		if err := tx.Model(&user).Updates(map[string]interface{}{"disabled": true, "disabled_reason": models.DisabledSuspended}).Error; err != nil {
+			return err
+		}
+		return RevokeUserSessions(tx, user.ID, 0)
+	})
+	return user, err
+}
+
+// 恢复被暂停的账户，其他原因停用的账户（待审批、目录同步）不受影响
+func ReactivateUser(db *gorm.DB, userID uint) (models.User, error) {
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		return models.User{}, err
+	}
+	if !user.Disabled || user.DisabledReason != models.DisabledSuspended {
+		return models.User{}, ErrNotSuspended
+	}
+	user.Disabled = false
+	user.DisabledReason = ""
+	err := db.Model(&user).Updates(map[string]interface{}{"disabled": false, "disabled_reason": ""}).Error
+	return user, err
+}
+
+// 在一个事务中删除用户及其凭证、会话和成员关系，地址和 Token 按 mode 保留或删除
+func DeleteUserAccount(db *gorm.DB, actorID uint, userID uint, mode string) error {
+	if mode != DeleteModeArchive && mode != DeleteModeCascade {
+		return ErrInvalidDeleteMode
+	}
+	if actorID == userID {
+		return ErrSelfAction
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := tx.First(&user, userID).Error; err != nil {
+			return err
+		}
+		if user.IsAdmin {
+			if err := EnsureOtherAdminExists(tx, user.ID); err != nil {
+				return err
+			}
+		}
+
+		// 登录凭证和会话一律删除
+		for _, model := range []interface{}{
+			&models.Session{},
+			&models.APIKey{},
+			&models.RecoveryCode{},
+			&models.WebAuthnCredential{},
+			&models.WebAuthnChallenge{},
+			&models.LoginChallenge{},
+			&models.PasswordResetToken{},
+			&models.PasswordHistory{},
+			&models.AddressShare{},
+		} {
+			if err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		if err := removeUserFromOrganizations(tx, user.ID); err != nil {
+			return err
+		}
+
+		if mode == DeleteModeCascade {
+			var addressIDs []uint
+			if err := tx.Model(&models.Address{}).Where("user_id = ?", user.ID).Pluck("id", &addressIDs).Error; err != nil {
+				return err
+			}
+			if len(addressIDs) > 0 {
+				if err := tx.Where("address_id IN ?", addressIDs).Delete(&models.AddressShare{}).Error; err != nil {
+					return err
+				}
+			}
+			if err := tx.Where("user_id = ?", user.ID).Delete(&models.Address{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("user_id = ?", user.ID).Delete(&models.TokenRevision{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("user_id = ? AND organization_id = 0", user.ID).Delete(&models.Token{}).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Delete(&user).Error
+	})
+}
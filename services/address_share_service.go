@@ -0,0 +1,185 @@
+package services
+
+import (
+	"errors"
+
+	"anonymail/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrInvalidSharePermission = errors.New("invalid share permission")
+	ErrShareWithSelf          = errors.New("cannot share an address with yourself")
+	ErrAddressNotEditable     = errors.New("no permission to edit this address")
+	ErrShareUserNotFound      = errors.New("user not found")
+)
+
+type AddressShareInfo struct {
+	UserID     uint
+	Username   string
+	Permission string
+}
+
+// SharedAddress 是别人共享给当前用户的地址
+type SharedAddress struct {
+	Address    models.Address
+	Permission string
+	Owner      string
+}
+
+func validSharePermission(permission string) bool {
+	return permission == models.SharePermissionView || permission == models.SharePermissionEdit
+}
+
+// 查找用户自己的地址
+func FindUserAddress(db *gorm.DB, userID uint, addressID uint) (models.Address, error) {
+	var address models.Address
+	err := db.Where("id = ? AND user_id = ?", addressID, userID).First(&address).Error
+	return address, err
+}
+
+// 把地址共享给指定用户，已经共享过时更新权限。previous 是更新前的权限，新共享时为空
+func ShareAddress(db *gorm.DB, ownerID uint, addressID uint, username string, permission string) (share models.AddressShare, previous string, err error) {
+	if !validSharePermission(permission) {
+		return models.AddressShare{}, "", ErrInvalidSharePermission
+	}
+	address, err := FindUserAddress(db, ownerID, addressID)
+	if err != nil {
+		return models.AddressShare{}, "", err
+	}
+	var user models.User
+	err = db.Where("username = ?", username).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return models.AddressShare{}, "", ErrShareUserNotFound
+	}
+	if err != nil {
+		return models.AddressShare{}, "", err
+	}
+	if user.ID == ownerID {
+		return models.AddressShare{}, "", ErrShareWithSelf
+	}
+
+	var existing models.AddressShare
+	err = db.Where("address_id = ? AND user_id = ?", address.ID, user.ID).First(&existing).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return models.AddressShare{}, "", err
+	}
+
+	share = models.AddressShare{
+		AddressID:  address.ID,
+		UserID:     user.ID,
+		GrantedBy:  ownerID,
+		Permission: permission,
+	}
+	err = db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "address_id"}, {Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"permission", "granted_by", "updated_at"}),
+	}).Create(&share).Error
+	return share, existing.Permission, err
+}
+
+func ListAddressShares(db *gorm.DB, ownerID uint, addressID uint) ([]AddressShareInfo, error) {
+	if _, err := FindUserAddress(db, ownerID, addressID); err != nil {
+		return nil, err
+	}
+	var shares []AddressShareInfo
+	err := db.Model(&models.AddressShare{}).
+		Select("address_shares.user_id, users.username, address_shares.permission").
+		Joins("JOIN users ON users.id = address_shares.user_id AND users.deleted_at IS NULL").
+		Where("address_shares.address_id = ?", addressID).
+		Order("address_shares.id").
+		Scan(&shares).Error
+	return shares, err
+}
+
+// 撤销共享。所有者可以撤销任何人的权限，被共享的用户可以放弃自己的权限。返回被撤销的共享
+func RevokeAddressShare(db *gorm.DB, actorID uint, addressID uint, userID uint) (models.AddressShare, error) {
+	if actorID != userID {
+		if _, err := FindUserAddress(db, actorID, addressID); err != nil {
+			return models.AddressShare{}, err
+		}
+	}
+	var share models.AddressShare
+	if err := db.Where("address_id = ? AND user_id = ?", addressID, userID).First(&share).Error; err != nil {
+		return models.AddressShare{}, err
+	}
+	result := db.Delete(&share)
+	if result.Error != nil {
+		return models.AddressShare{}, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return models.AddressShare{}, gorm.ErrRecordNotFound
+	}
+	return share, nil
+}
+
+// 别人共享给用户的地址，已删除的地址不会出现
+func ListSharedAddresses(db *gorm.DB, userID uint) ([]SharedAddress, error) {
+	var shares []models.AddressShare
+	if err := db.Where("user_id = ?", userID).Order("id").Find(&shares).Error; err != nil {
+		return nil, err
+	}
+
+	result := make([]SharedAddress, 0, len(shares))
+	for _, share := range shares {
+		var address models.Address
+		err := db.First(&address, share.AddressID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var owner models.User
+		if err := db.Unscoped().Select("username").First(&owner, address.UserID).Error; err != nil {
+			return nil, err
+		}
+		result = append(result, SharedAddress{Address: address, Permission: share.Permission, Owner: owner.Username})
+	}
+	return result, nil
+}
+
+// 修改地址转发到的真实地址，所有者和拥有编辑权限的用户可以修改
+func UpdateAddressRecipient(db *gorm.DB, userID uint, addressID uint, realAddress string) (models.Address, error) {
+	var address models.Address
+	if err := db.First(&address, addressID).Error; err != nil {
+		return models.Address{}, err
+	}
+	if address.UserID != userID {
+		var share models.AddressShare
+		err := db.Where("address_id = ? AND user_id = ?", addressID, userID).First(&share).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.Address{}, gorm.ErrRecordNotFound
+		}
+		if err != nil {
+			return models.Address{}, err
+		}
+		if share.Permission != models.SharePermissionEdit {
+			return models.Address{}, ErrAddressNotEditable
+		}
+	}
+
+	address.RealAddress = models.EncryptedString(realAddress)
+	address.ConvertedAddress = models.EncryptedString(convertRealAddress(realAddress, address.GeneratedAddress))
+	err := db.Model(&address).Updates(map[string]interface{}{
+		"real_address":      address.RealAddress,
+		"converted_address": address.ConvertedAddress,
+	}).Error
+	return address, err
+}
+
+// 删除地址及其共享记录
+func DeleteUserAddress(db *gorm.DB, userID uint, addressID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		address, err := FindUserAddress(tx, userID, addressID)
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("address_id = ?", address.ID).Delete(&models.AddressShare{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&address).Error
+	})
+}
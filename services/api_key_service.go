@@ -0,0 +1,206 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"anonymail/models"
+
+	"gorm.io/gorm"
+)
+
+// API Key 以固定前缀开头，便于和会话 token 区分
+const APIKeyPrefix = "ddgm_"
+
+var (
+	ErrAPIKeyRevoked    = errors.New("api key revoked")
+	ErrAPIKeyExpired    = errors.New("api key expired")
+	ErrAPIKeyIPRejected = errors.New("api key not allowed from this address")
+	ErrInvalidScope     = errors.New("invalid scope")
+	ErrInvalidIP        = errors.New("invalid IP address or CIDR")
+)
+
+var validScopes = map[string]bool{
+	models.ScopeReadAddresses: true,
+	models.ScopeGenerate:      true,
+	models.ScopeManageTokens:  true,
+	models.ScopeAdmin:         true,
+}
+
+var apiKeyHashKey []byte
+
+func SetAPIKeyHashKey(key []byte) {
+	apiKeyHashKey = key
+}
+
+func hashAPIKey(key string) string {
+	mac := hmac.New(sha256.New, apiKeyHashKey)
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type APIKeyOptions struct {
+	Name       string
+	Scopes     []string
+	AllowedIPs []string
+	ExpiresAt  *time.Time
+}
+
+// 创建 API Key，返回的明文 key 只在创建时出现一次
+func CreateAPIKey(db *gorm.DB, user models.User, options APIKeyOptions) (string, models.APIKey, error) {
+	if len(options.Scopes) == 0 {
+		return "", models.APIKey{}, ErrInvalidScope
+	}
+	for _, scope := range options.Scopes {
+		if !validScopes[scope] {
+			return "", models.APIKey{}, fmt.Errorf("%w: %s", ErrInvalidScope, scope)
+		}
+		if scope == models.ScopeAdmin && !IsStaff(user) {
+			return "", models.APIKey{}, fmt.Errorf("%w: %s requires admin privileges", ErrInvalidScope, scope)
+		}
+	}
+	for _, allowed := range options.AllowedIPs {
+		if parseIPOrCIDR(allowed) == nil {
+			return "", models.APIKey{}, fmt.Errorf("%w: %s", ErrInvalidIP, allowed)
+		}
+	}
+
+	secret, err := GenerateRandomToken()
+	if err != nil {
+		return "", models.APIKey{}, err
+	}
+	key := APIKeyPrefix + secret
+
+	apiKey := models.APIKey{
+		UserID:     user.ID,
+		Name:       options.Name,
+		Prefix:     key[:len(APIKeyPrefix)+8],
+		KeyHash:    hashAPIKey(key),
+		Scopes:     strings.Join(options.Scopes, ","),
+		AllowedIPs: strings.Join(options.AllowedIPs, ","),
+		ExpiresAt:  options.ExpiresAt,
+	}
+	if err := db.Create(&apiKey).Error; err != nil {
+		return "", models.APIKey{}, err
+	}
+	return key, apiKey, nil
+}
+
+// 校验 API Key，检查撤销、过期和来源 IP，并记录最后使用时间
+func ValidateAPIKey(db *gorm.DB, key string, ip string) (models.APIKey, models.User, error) {
+	keyHash := hashAPIKey(key)
+	var apiKey models.APIKey
+	if err := db.Where("key_hash = ?", keyHash).First(&apiKey).Error; err != nil {
+		return models.APIKey{}, models.User{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(apiKey.KeyHash), []byte(keyHash)) != 1 {
+		return models.APIKey{}, models.User{}, gorm.ErrRecordNotFound
+	}
+
+	now := time.Now()
+	if apiKey.RevokedAt != nil {
+		return models.APIKey{}, models.User{}, ErrAPIKeyRevoked
+	}
+	if apiKey.ExpiresAt != nil && now.After(*apiKey.ExpiresAt) {
+		return models.APIKey{}, models.User{}, ErrAPIKeyExpired
+	}
+	if !apiKeyAllowsIP(apiKey, ip) {
+		return models.APIKey{}, models.User{}, ErrAPIKeyIPRejected
+	}
+
+	var user models.User
+	if err := db.First(&user, apiKey.UserID).Error; err != nil {
+		return models.APIKey{}, models.User{}, err
+	}
+	if user.Disabled {
+		return models.APIKey{}, models.User{}, ErrAccountDisabled
+	}
+
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > sessionTouchInterval || apiKey.LastUsedIP != ip {
+		apiKey.LastUsedAt = &now
+		apiKey.LastUsedIP = ip
+		if err := db.Model(&apiKey).UpdateColumns(map[string]interface{}{
+			"last_used_at": now,
+			"last_used_ip": ip,
+		}).Error; err != nil {
+			return models.APIKey{}, models.User{}, err
+		}
+	}
+	return apiKey, user, nil
+}
+
+func APIKeyHasScope(apiKey models.APIKey, scope string) bool {
+	for _, s := range strings.Split(apiKey.Scopes, ",") {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func ListAPIKeys(db *gorm.DB, userID uint) ([]models.APIKey, error) {
+	var keys []models.APIKey
+	err := db.Where("user_id = ?", userID).Order("id DESC").Find(&keys).Error
+	return keys, err
+}
+
+func RevokeAPIKey(db *gorm.DB, userID uint, keyID uint) error {
+	result := db.Model(&models.APIKey{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", keyID, userID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// 撤销用户所有未撤销的 API Key，例如管理员重置密码时
+func RevokeUserAPIKeys(db *gorm.DB, userID uint) error {
+	return db.Model(&models.APIKey{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
+
+func apiKeyAllowsIP(apiKey models.APIKey, ip string) bool {
+	if apiKey.AllowedIPs == "" {
+		return true
+	}
+	clientIP := net.ParseIP(ip)
+	if clientIP == nil {
+		return false
+	}
+	for _, allowed := range strings.Split(apiKey.AllowedIPs, ",") {
+		if network := parseIPOrCIDR(allowed); network != nil && network.Contains(clientIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// 单个 IP 视为只包含自身的网段
+func parseIPOrCIDR(value string) *net.IPNet {
+	value = strings.TrimSpace(value)
+	if _, network, err := net.ParseCIDR(value); err == nil {
+		return network
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil
+	}
+	bits := 128
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
@@ -0,0 +1,75 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"anonymail/models"
+
+	"gorm.io/gorm"
+)
+
+func randomMasterKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// 模拟一次启动：加载密钥，设置字段加密和 API Key 的哈希密钥
+func startWithMasterKey(t *testing.T, db *gorm.DB, masterKey []byte, previousKeys ...[]byte) []byte {
+	t.Helper()
+	keyring, err := InitEncryption(db, masterKey, previousKeys)
+	if err != nil {
+		t.Fatalf("init encryption: %v", err)
+	}
+	models.SetFieldCipher(keyring)
+	hashKey, err := keyring.HashKey(db, "api-key")
+	if err != nil {
+		t.Fatalf("load hash key: %v", err)
+	}
+	SetAPIKeyHashKey(hashKey)
+	return hashKey
+}
+
+func TestAPIKeyValidAfterMasterKeyRotation(t *testing.T) {
+	db := openTestDB(t)
+	oldMaster := randomMasterKey(t)
+	oldHashKey := startWithMasterKey(t, db, oldMaster)
+
+	user := models.User{Username: "automation"}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	key, _, err := CreateAPIKey(db, user, APIKeyOptions{Name: "ci", Scopes: []string{models.ScopeReadAddresses}})
+	if err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+
+	// 更换主密钥后启动一次，再去掉旧主密钥启动一次
+	newMaster := randomMasterKey(t)
+	if hashKey := startWithMasterKey(t, db, newMaster, oldMaster); !bytes.Equal(hashKey, oldHashKey) {
+		t.Fatal("hash key changed with the master key")
+	}
+	startWithMasterKey(t, db, newMaster)
+
+	if _, got, err := ValidateAPIKey(db, key, "127.0.0.1"); err != nil || got.ID != user.ID {
+		t.Fatalf("api key rejected after master key rotation: %v", err)
+	}
+	if _, _, err := ValidateAPIKey(db, key+"x", "127.0.0.1"); err == nil {
+		t.Fatal("wrong api key accepted")
+	}
+}
+
+func TestHashKeyRequiresKnownMasterKey(t *testing.T) {
+	db := openTestDB(t)
+	startWithMasterKey(t, db, randomMasterKey(t))
+
+	// 没有提供旧主密钥时启动应当失败，而不是重新生成哈希密钥
+	if _, err := InitEncryption(db, randomMasterKey(t), nil); err == nil {
+		t.Fatal("expected an error for an unknown master key")
+	}
+}
@@ -0,0 +1,212 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"anonymail/models"
+
+	"gorm.io/gorm"
+)
+
+const (
+	DefaultAuditPageSize = 50
+	MaxAuditPageSize     = 500
+)
+
+// 审计日志的写入需要串行，保证每条记录都链接到上一条
+var auditMutex sync.Mutex
+
+// 要记录的审计事件，Before 和 After 会被编码为 JSON
+type AuditEntry struct {
+	ActorID    uint
+	ActorName  string
+	Action     string
+	TargetType string
+	TargetID   uint
+	UserID     uint
+	IP         string
+	UserAgent  string
+	RequestID  string
+	Before     interface{}
+	After      interface{}
+}
+
+// 追加一条审计事件，哈希由上一条记录的哈希和本条记录的内容计算
+func RecordAuditEvent(db *gorm.DB, entry AuditEntry) (models.AuditEvent, error) {
+	before, err := auditSummary(entry.Before)
+	if err != nil {
+		return models.AuditEvent{}, err
+	}
+	after, err := auditSummary(entry.After)
+	if err != nil {
+		return models.AuditEvent{}, err
+	}
+	event := models.AuditEvent{
+		CreatedAt:  time.Now().UTC(),
+		ActorID:    entry.ActorID,
+		ActorName:  entry.ActorName,
+		Action:     entry.Action,
+		TargetType: entry.TargetType,
+		TargetID:   entry.TargetID,
+		UserID:     entry.UserID,
+		IP:         entry.IP,
+		UserAgent:  entry.UserAgent,
+		RequestID:  entry.RequestID,
+		Before:     before,
+		After:      after,
+	}
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var last models.AuditEvent
+		err := tx.Order("id DESC").Select("hash").First(&last).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		event.PrevHash = last.Hash
+		event.Hash = auditEventHash(event)
+		return tx.Create(&event).Error
+	})
+	return event, err
+}
+
+func auditSummary(value interface{}) (string, error) {
+	if value == nil {
+		return "", nil
+	}
+	encoded, err := json.Marshal(value)
+	return string(encoded), err
+}
+
+func auditEventHash(event models.AuditEvent) string {
+	// 字段顺序固定，修改任何字段都会改变哈希
+	content, _ := json.Marshal([]interface{}{
+		event.PrevHash,
+		event.CreatedAt.UTC().Format(time.RFC3339Nano),
+		event.ActorID,
+		event.ActorName,
+		event.Action,
+		event.TargetType,
+		event.TargetID,
+		event.UserID,
+		event.IP,
+		event.UserAgent,
+		event.RequestID,
+		event.Before,
+		event.After,
+	})
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// 审计日志查询条件，为空的条件不筛选
+type AuditQuery struct {
+	ActorID   uint
+	UserID    uint
+	Action    string
+	RequestID string
+	Since     *time.Time
+	Until     *time.Time
+	Page      int
+	PageSize  int
+}
+
+// 补全默认的页码和每页数量
+func (query AuditQuery) Normalized() AuditQuery {
+	if query.PageSize <= 0 {
+		query.PageSize = DefaultAuditPageSize
+	}
+	if query.PageSize > MaxAuditPageSize {
+		query.PageSize = MaxAuditPageSize
+	}
+	if query.Page <= 0 {
+		query.Page = 1
+	}
+	return query
+}
+
+// 按时间倒序列出审计事件；action 以 . 结尾时按前缀匹配，例如 admin.
+func ListAuditEvents(db *gorm.DB, query AuditQuery) ([]models.AuditEvent, int64, error) {
+	query = query.Normalized()
+	q := db.Model(&models.AuditEvent{})
+	if query.ActorID != 0 {
+		q = q.Where("actor_id = ?", query.ActorID)
+	}
+	if query.UserID != 0 {
+		q = q.Where("user_id = ?", query.UserID)
+	}
+	if strings.HasSuffix(query.Action, ".") {
+		q = q.Where(`action LIKE ? ESCAPE '\'`, escapeLike(query.Action)+"%")
+	} else if query.Action != "" {
+		q = q.Where("action = ?", query.Action)
+	}
+	if query.RequestID != "" {
+		q = q.Where("request_id = ?", query.RequestID)
+	}
+	if query.Since != nil {
+		q = q.Where("created_at >= ?", query.Since.UTC())
+	}
+	if query.Until != nil {
+		q = q.Where("created_at < ?", query.Until.UTC())
+	}
+
+	var total int64
+	if err := q.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var events []models.AuditEvent
+	err := q.Order("id DESC").Limit(query.PageSize).Offset((query.Page - 1) * query.PageSize).Find(&events).Error
+	return events, total, err
+}
+
+// 校验结果，Valid 为 false 时 BrokenAt 是第一条校验失败的记录
+type AuditVerification struct {
+	Valid    bool
+	Checked  int64
+	BrokenAt uint
+	LastHash string
+}
+
+// 从头校验整条哈希链，检测记录被修改、删除或插入
+func VerifyAuditLog(db *gorm.DB) (AuditVerification, error) {
+	result := AuditVerification{Valid: true}
+	var batch []models.AuditEvent
+	err := db.Order("id").FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+		for _, event := range batch {
+			if !result.Valid {
+				return nil
+			}
+			result.Checked++
+			if event.PrevHash != result.LastHash || event.Hash != auditEventHash(event) {
+				result.Valid = false
+				result.BrokenAt = event.ID
+				return nil
+			}
+			result.LastHash = event.Hash
+		}
+		return nil
+	}).Error
+	return result, err
+}
+
+// 在数据库层面禁止修改和删除审计日志
+func EnsureAuditLogAppendOnly(db *gorm.DB) error {
+	for _, statement := range []string{
+		`CREATE TRIGGER IF NOT EXISTS audit_events_no_update BEFORE UPDATE ON audit_events
+			BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END`,
+		`CREATE TRIGGER IF NOT EXISTS audit_events_no_delete BEFORE DELETE ON audit_events
+			BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END`,
+	} {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package services
+
+import (
+	"errors"
+	"math"
+)
+
+// 只实现 WebAuthn 需要的 CBOR 子集：整数、字节串、文本串、数组、映射、标签和简单值
+var (
+	errCBORTruncated   = errors.New("cbor: unexpected end of data")
+	errCBORUnsupported = errors.New("cbor: unsupported encoding")
+)
+
+const cborMaxDepth = 16
+
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+// 解码第一个 CBOR 数据项，同时返回其占用的字节数
+func decodeCBOR(data []byte) (interface{}, int, error) {
+	d := &cborDecoder{data: data}
+	value, err := d.decode(0)
+	if err != nil {
+		return nil, 0, err
+	}
+	return value, d.pos, nil
+}
+
+func (d *cborDecoder) readHead() (byte, uint64, error) {
+	if d.pos >= len(d.data) {
+		return 0, 0, errCBORTruncated
+	}
+	b := d.data[d.pos]
+	d.pos++
+	major, info := b>>5, b&0x1f
+
+	if info < 24 {
+		return major, uint64(info), nil
+	}
+	if info > 27 {
+		// 不支持不定长编码
+		return 0, 0, errCBORUnsupported
+	}
+	n := 1 << (info - 24)
+	if d.pos+n > len(d.data) {
+		return 0, 0, errCBORTruncated
+	}
+	var arg uint64
+	for i := 0; i < n; i++ {
+		arg = arg<<8 | uint64(d.data[d.pos+i])
+	}
+	d.pos += n
+	return major, arg, nil
+}
+
+func (d *cborDecoder) decode(depth int) (interface{}, error) {
+	if depth > cborMaxDepth {
+		return nil, errCBORUnsupported
+	}
+	major, arg, err := d.readHead()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, errCBORUnsupported
+		}
+		return int64(arg), nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, errCBORUnsupported
+		}
+		return -1 - int64(arg), nil
+	case 2, 3:
+		if arg > uint64(len(d.data)-d.pos) {
+			return nil, errCBORTruncated
+		}
+		raw := d.data[d.pos : d.pos+int(arg)]
+		d.pos += int(arg)
+		if major == 3 {
+			return string(raw), nil
+		}
+		return append([]byte(nil), raw...), nil
+	case 4:
+		// 每个元素至少占一个字节，避免恶意长度导致过大的内存分配
+		if arg > uint64(len(d.data)-d.pos) {
+			return nil, errCBORTruncated
+		}
+		items := make([]interface{}, 0, int(arg))
+		for i := uint64(0); i < arg; i++ {
+			item, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	case 5:
+		if arg > uint64(len(d.data)-d.pos) {
+			return nil, errCBORTruncated
+		}
+		entries := make(map[interface{}]interface{}, int(arg))
+		for i := uint64(0); i < arg; i++ {
+			key, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, errCBORUnsupported
+			}
+			value, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			entries[key] = value
+		}
+		return entries, nil
+	case 6:
+		return d.decode(depth + 1)
+	default:
+		switch arg {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		}
+		// null、undefined 和浮点数都不会用到
+		return nil, nil
+	}
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// 测试用的 CBOR 编码，只包含测试需要的类型
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= 0xff:
+		return []byte{major<<5 | 24, byte(n)}
+	case n <= 0xffff:
+		return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+	case n <= 0xffffffff:
+		return []byte{major<<5 | 26, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+	}
+	head := []byte{major<<5 | 27}
+	for shift := 56; shift >= 0; shift -= 8 {
+		head = append(head, byte(n>>uint(shift)))
+	}
+	return head
+}
+
+func cborInt(v int64) []byte {
+	if v < 0 {
+		return cborHead(1, uint64(-1-v))
+	}
+	return cborHead(0, uint64(v))
+}
+
+func cborBytes(b []byte) []byte {
+	return append(cborHead(2, uint64(len(b))), b...)
+}
+
+func cborText(s string) []byte {
+	return append(cborHead(3, uint64(len(s))), s...)
+}
+
+// 参数依次为已编码的键和值
+func cborMap(pairs ...[]byte) []byte {
+	encoded := cborHead(5, uint64(len(pairs)/2))
+	for _, item := range pairs {
+		encoded = append(encoded, item...)
+	}
+	return encoded
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	encoded := cborMap(
+		cborText("fmt"), cborText("none"),
+		cborInt(-7), cborBytes([]byte{1, 2, 3}),
+		cborInt(1000), append(cborHead(4, 2), append([]byte{0xf5}, cborInt(-300)...)...),
+	)
+	// 末尾多余的数据不属于第一个数据项
+	value, consumed, err := decodeCBOR(append(encoded, 0xff, 0xff))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if consumed != len(encoded) {
+		t.Fatalf("consumed %d bytes, want %d", consumed, len(encoded))
+	}
+	m := value.(map[interface{}]interface{})
+	if m["fmt"] != "none" || !bytes.Equal(m[int64(-7)].([]byte), []byte{1, 2, 3}) {
+		t.Fatalf("unexpected map %v", m)
+	}
+	items := m[int64(1000)].([]interface{})
+	if len(items) != 2 || items[0] != true || items[1] != int64(-300) {
+		t.Fatalf("unexpected array %v", items)
+	}
+}
+
+func TestDecodeCBORRejectsMalformedInput(t *testing.T) {
+	nested := []byte{}
+	for i := 0; i <= cborMaxDepth+1; i++ {
+		nested = append(nested, cborHead(4, 1)...)
+	}
+	nested = append(nested, cborInt(0)...)
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  error
+	}{
+		{"empty", nil, errCBORTruncated},
+		{"truncated head", []byte{0x19, 0x01}, errCBORTruncated},
+		{"truncated byte string", append(cborHead(2, 10), 1, 2, 3), errCBORTruncated},
+		{"truncated text string", append(cborHead(3, 5), 'a'), errCBORTruncated},
+		{"truncated map value", append(cborHead(5, 1), cborText("a")...), errCBORTruncated},
+		{"byte string longer than input", cborHead(2, 1<<62), errCBORTruncated},
+		{"array longer than input", cborHead(4, 1<<40), errCBORTruncated},
+		{"map longer than input", cborHead(5, 0xffffffff), errCBORTruncated},
+		{"integer overflow", cborHead(0, 1<<63), errCBORUnsupported},
+		{"negative integer overflow", cborHead(1, 1<<63), errCBORUnsupported},
+		{"indefinite length", []byte{0x5f, 0x41, 0x00, 0xff}, errCBORUnsupported},
+		{"reserved additional info", []byte{0x1c}, errCBORUnsupported},
+		{"array map key", cborMap(cborHead(4, 0), cborInt(1)), errCBORUnsupported},
+		{"nesting too deep", nested, errCBORUnsupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := decodeCBOR(tt.input); !errors.Is(err, tt.want) {
+				t.Fatalf("got error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
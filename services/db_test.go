@@ -0,0 +1,31 @@
+package services
+
+import (
+	"path/filepath"
+	"testing"
+
+	"anonymail/models"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// 每个测试使用独立的临时数据库
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	err = db.AutoMigrate(&models.User{}, &models.Address{}, &models.Token{}, &models.DataKey{}, &models.HashKey{}, &models.Session{}, &models.APIKey{}, &models.Setting{}, &models.WebAuthnCredential{}, &models.WebAuthnChallenge{}, &models.AuditEvent{})
+	if err != nil {
+		t.Fatalf("migrate database: %v", err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
@@ -5,14 +5,64 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"gorm.io/gorm"
 )
 
-func GenerateEmailAddress(db *gorm.DB, userID uint, realAddress string, tokenValue string, tokenDescription string) (string, error) {
-	// 使用DuckDuckGo API生成邮箱地址
+func GenerateEmailAddress(db *gorm.DB, userID uint, realAddress string, token models.Token) (models.Address, error) {
+	// 在调用 DuckDuckGo 之前预留配额，请求失败时归还
+	reservation, err := reserveAddressQuota(db, userID, token.OrganizationID)
+	if err != nil {
+		return models.Address{}, err
+	}
+	defer reservation.release()
+
+	// 记录每次调用 DuckDuckGo API 的结果和耗时
+	start := time.Now()
+	generatedAddress, err := requestDuckAddress(string(token.Value))
+	if recordErr := RecordTokenUsage(db, token.ID, err == nil, time.Since(start)); recordErr != nil {
+		log.Printf("Failed to record usage of token %d: %v", token.ID, recordErr)
+	}
+	if token.OrganizationID != 0 {
+		if recordErr := RecordOrganizationUsage(db, token, userID, err == nil); recordErr != nil {
+			log.Printf("Failed to record organization usage of token %d: %v", token.ID, recordErr)
+		}
+	}
+	if err != nil {
+		return models.Address{}, err
+	}
+
+	// 转换实际地址
+	convertedAddress := convertRealAddress(realAddress, generatedAddress)
+
+	// 保存到数据库
+	address := models.Address{
+		UserID:           userID,
+		GeneratedAddress: generatedAddress,
+		RealAddress:      models.EncryptedString(realAddress),
+		ConvertedAddress: models.EncryptedString(convertedAddress),
+		TokenID:          token.ID,
+		TokenDescription: token.Description,
+		OrganizationID:   token.OrganizationID,
+	}
+	// 组织 Token 不能复制到成员自己的地址记录中，需要时通过 TokenID 查找
+	if token.OrganizationID == 0 {
+		address.TokenValue = token.Value
+	}
+
+	if err := reservation.commit(func() error { return db.Create(&address).Error }); err != nil {
+		return models.Address{}, err
+	}
+
+	return address, nil
+}
+
+// 使用DuckDuckGo API生成邮箱地址
+func requestDuckAddress(tokenValue string) (string, error) {
 	url := "https://quack.duckduckgo.com/api/email/addresses"
 	payload := strings.NewReader(`{}`)
 	req, err := http.NewRequest("POST", url, payload)
@@ -45,25 +95,7 @@ func GenerateEmailAddress(db *gorm.DB, userID uint, realAddress string, tokenVal
 	if result.Address == "" {
 		return "", fmt.Errorf("failed to generate address: %s", string(body))
 	}
-
-	// 转换实际地址
-	convertedAddress := convertRealAddress(realAddress, result.Address)
-
-	// 保存到数据库
-	address := models.Address{
-		UserID:           userID,
-		GeneratedAddress: result.Address,
-		RealAddress:      realAddress,
-		ConvertedAddress: convertedAddress,
-		TokenValue:       tokenValue,
-		TokenDescription: tokenDescription,
-	}
-
-	if err := db.Create(&address).Error; err != nil {
-		return "", err
-	}
-
-	return convertedAddress, nil
+	return result.Address, nil
 }
 
 func convertRealAddress(realAddress, generatedAddress string) string {
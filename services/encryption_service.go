@@ -0,0 +1,428 @@
+package services
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"anonymail/models"
+
+	"gorm.io/gorm"
+)
+
+const encryptionVersion = "v1"
+
+// 需要加密存储的字段，新增加密字段时需要在这里登记，密钥轮换时会一并重新加密
+var encryptedColumns = []struct {
+	model   interface{}
+	columns []string
+}{
+	{&models.User{}, []string{"totp_secret"}},
+	{&models.Token{}, []string{"value"}},
+	{&models.TokenRevision{}, []string{"value"}},
+	{&models.Address{}, []string{"token_value", "real_address", "converted_address"}},
+}
+
+// Keyring 使用信封加密：字段由数据密钥加密，数据密钥由主密钥包装后存入数据库
+type Keyring struct {
+	mu              sync.RWMutex
+	masterKeys      map[string][]byte
+	currentMasterID string
+	dataKeys        map[uint]cipher.AEAD
+	activeKeyID     uint
+}
+
+// 优先使用环境变量中的主密钥，否则读取密钥文件，文件不存在时生成新的密钥
+func LoadMasterKey(encoded string, keyFile string) ([]byte, error) {
+	if encoded != "" {
+		return ParseMasterKey(encoded)
+	}
+
+	content, err := ioutil.ReadFile(keyFile)
+	if err == nil {
+		return ParseMasterKey(strings.TrimSpace(string(content)))
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read master key file: %w", err)
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate master key: %w", err)
+	}
+	if err := ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write master key file: %w", err)
+	}
+	log.Printf("Warning: generated a new master key at %s. Back it up and keep it away from the database file.", keyFile)
+	return key, nil
+}
+
+func ParseMasterKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("master key must be base64 encoded: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// 解析以逗号分隔的旧主密钥列表
+func ParseMasterKeys(encoded string) ([][]byte, error) {
+	var keys [][]byte
+	for _, part := range strings.Split(encoded, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		key, err := ParseMasterKey(part)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func masterKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// 加载数据密钥，用旧主密钥包装的数据密钥会被重新包装到当前主密钥下
+func InitEncryption(db *gorm.DB, masterKey []byte, previousKeys [][]byte) (*Keyring, error) {
+	k := &Keyring{
+		masterKeys:      map[string][]byte{},
+		currentMasterID: masterKeyID(masterKey),
+		dataKeys:        map[uint]cipher.AEAD{},
+	}
+	k.masterKeys[k.currentMasterID] = masterKey
+	for _, key := range previousKeys {
+		k.masterKeys[masterKeyID(key)] = key
+	}
+
+	var dataKeys []models.DataKey
+	if err := db.Find(&dataKeys).Error; err != nil {
+		return nil, fmt.Errorf("failed to load data keys: %w", err)
+	}
+
+	for _, dk := range dataKeys {
+		master, ok := k.masterKeys[dk.MasterKeyID]
+		if !ok {
+			return nil, fmt.Errorf("data key %d is wrapped with unknown master key %s", dk.ID, dk.MasterKeyID)
+		}
+		raw, err := unwrapKey(master, dk.WrappedKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unwrap data key %d: %w", dk.ID, err)
+		}
+		if dk.MasterKeyID != k.currentMasterID {
+			wrapped, err := wrapKey(masterKey, raw)
+			if err != nil {
+				return nil, err
+			}
+			if err := db.Model(&dk).Updates(map[string]interface{}{
+				"master_key_id": k.currentMasterID,
+				"wrapped_key":   wrapped,
+			}).Error; err != nil {
+				return nil, fmt.Errorf("failed to rewrap data key %d: %w", dk.ID, err)
+			}
+			log.Printf("Rewrapped data key %d with the current master key", dk.ID)
+		}
+		aead, err := newAEAD(raw)
+		if err != nil {
+			return nil, err
+		}
+		k.dataKeys[dk.ID] = aead
+		if dk.Active {
+			k.activeKeyID = dk.ID
+		}
+	}
+
+	if err := k.rewrapHashKeys(db); err != nil {
+		return nil, err
+	}
+
+	if k.activeKeyID == 0 {
+		if _, err := k.createDataKey(db); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// 将用旧主密钥包装的哈希密钥重新包装到当前主密钥下，密钥本身不变
+func (k *Keyring) rewrapHashKeys(db *gorm.DB) error {
+	var hashKeys []models.HashKey
+	if err := db.Where("master_key_id <> ?", k.currentMasterID).Find(&hashKeys).Error; err != nil {
+		return fmt.Errorf("failed to load hash keys: %w", err)
+	}
+	for _, hk := range hashKeys {
+		master, ok := k.masterKeys[hk.MasterKeyID]
+		if !ok {
+			return fmt.Errorf("hash key %q is wrapped with unknown master key %s", hk.Purpose, hk.MasterKeyID)
+		}
+		raw, err := unwrapKey(master, hk.WrappedKey)
+		if err != nil {
+			return fmt.Errorf("failed to unwrap hash key %q: %w", hk.Purpose, err)
+		}
+		wrapped, err := wrapKey(k.masterKeys[k.currentMasterID], raw)
+		if err != nil {
+			return err
+		}
+		if err := db.Model(&hk).Updates(map[string]interface{}{
+			"master_key_id": k.currentMasterID,
+			"wrapped_key":   wrapped,
+		}).Error; err != nil {
+			return fmt.Errorf("failed to rewrap hash key %q: %w", hk.Purpose, err)
+		}
+		log.Printf("Rewrapped hash key %q with the current master key", hk.Purpose)
+	}
+	return nil
+}
+
+// 返回指定用途的 HMAC 密钥，不存在时生成并包装后保存。
+// 密钥不随主密钥变化，更换主密钥后已有的哈希仍然有效
+func (k *Keyring) HashKey(db *gorm.DB, purpose string) ([]byte, error) {
+	var hk models.HashKey
+	err := db.Where("purpose = ?", purpose).First(&hk).Error
+	if err == nil {
+		master, ok := k.masterKeys[hk.MasterKeyID]
+		if !ok {
+			return nil, fmt.Errorf("hash key %q is wrapped with unknown master key %s", purpose, hk.MasterKeyID)
+		}
+		return unwrapKey(master, hk.WrappedKey)
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("failed to load hash key %q: %w", purpose, err)
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("failed to generate hash key: %w", err)
+	}
+	wrapped, err := wrapKey(k.masterKeys[k.currentMasterID], raw)
+	if err != nil {
+		return nil, err
+	}
+	hk = models.HashKey{Purpose: purpose, MasterKeyID: k.currentMasterID, WrappedKey: wrapped}
+	if err := db.Create(&hk).Error; err != nil {
+		return nil, fmt.Errorf("failed to save hash key %q: %w", purpose, err)
+	}
+	return raw, nil
+}
+
+// 生成新的数据密钥并设为当前使用的密钥
+func (k *Keyring) createDataKey(tx *gorm.DB) (uint, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return 0, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	wrapped, err := wrapKey(k.masterKeys[k.currentMasterID], raw)
+	if err != nil {
+		return 0, err
+	}
+	aead, err := newAEAD(raw)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Model(&models.DataKey{}).Where("active = ?", true).Update("active", false).Error; err != nil {
+		return 0, fmt.Errorf("failed to deactivate data keys: %w", err)
+	}
+	dk := models.DataKey{
+		MasterKeyID: k.currentMasterID,
+		WrappedKey:  wrapped,
+		Active:      true,
+	}
+	if err := tx.Create(&dk).Error; err != nil {
+		return 0, fmt.Errorf("failed to save data key: %w", err)
+	}
+
+	k.mu.Lock()
+	k.dataKeys[dk.ID] = aead
+	k.activeKeyID = dk.ID
+	k.mu.Unlock()
+	return dk.ID, nil
+}
+
+func (k *Keyring) Encrypt(plaintext string) (string, error) {
+	k.mu.RLock()
+	keyID := k.activeKeyID
+	aead := k.dataKeys[keyID]
+	k.mu.RUnlock()
+	if aead == nil {
+		return "", errors.New("no active data key")
+	}
+
+	sealed, err := sealBytes(aead, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%s:%d:%s", models.EncryptedPrefix, encryptionVersion, keyID, sealed), nil
+}
+
+func (k *Keyring) Decrypt(ciphertext string) (string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(ciphertext, models.EncryptedPrefix), ":", 3)
+	if len(parts) != 3 || parts[0] != encryptionVersion {
+		return "", errors.New("malformed encrypted value")
+	}
+	keyID, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return "", errors.New("malformed encrypted value")
+	}
+
+	k.mu.RLock()
+	aead := k.dataKeys[uint(keyID)]
+	k.mu.RUnlock()
+	if aead == nil {
+		return "", fmt.Errorf("unknown data key %d", keyID)
+	}
+
+	plaintext, err := openBytes(aead, parts[2])
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// 加密升级前遗留的明文数据，只在第一次启动时执行；force 为 true 时再次执行，
+// 用于导入了明文数据的情况。迁移完成后读取到明文值会报错
+func EncryptPlaintextFields(db *gorm.DB, force bool) error {
+	done, err := GetBoolSetting(db, SettingPlaintextEncrypted)
+	if err != nil {
+		return err
+	}
+	if done && !force {
+		return nil
+	}
+
+	models.AllowPlaintextFields(true)
+	defer models.AllowPlaintextFields(false)
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := reencryptColumns(tx, true); err != nil {
+			return err
+		}
+		return SetSetting(tx, SettingPlaintextEncrypted, "true")
+	})
+}
+
+// 生成新的数据密钥，用它重新加密所有字段，然后删除旧的数据密钥
+func RotateEncryptionKeys(db *gorm.DB, k *Keyring) error {
+	k.mu.RLock()
+	previousActive := k.activeKeyID
+	k.mu.RUnlock()
+
+	var newKeyID uint
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		newKeyID, err = k.createDataKey(tx)
+		if err != nil {
+			return err
+		}
+		if err := reencryptColumns(tx, false); err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("id <> ?", newKeyID).Delete(&models.DataKey{}).Error; err != nil {
+			return fmt.Errorf("failed to delete old data keys: %w", err)
+		}
+		return nil
+	})
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err != nil {
+		if newKeyID != 0 {
+			delete(k.dataKeys, newKeyID)
+		}
+		k.activeKeyID = previousActive
+		return err
+	}
+	for id := range k.dataKeys {
+		if id != newKeyID {
+			delete(k.dataKeys, id)
+		}
+	}
+	return nil
+}
+
+func reencryptColumns(tx *gorm.DB, onlyPlaintext bool) error {
+	for _, table := range encryptedColumns {
+		for _, column := range table.columns {
+			var rows []struct {
+				ID    uint
+				Value models.EncryptedString
+			}
+			query := tx.Unscoped().Model(table.model).Select("id, " + column + " AS value").Where(column + " <> ''")
+			if onlyPlaintext {
+				query = query.Where(column+" NOT LIKE ?", models.EncryptedPrefix+"%")
+			}
+			if err := query.Find(&rows).Error; err != nil {
+				return fmt.Errorf("failed to read %s: %w", column, err)
+			}
+
+			for _, row := range rows {
+				if err := tx.Unscoped().Model(table.model).Where("id = ?", row.ID).UpdateColumn(column, row.Value).Error; err != nil {
+					return fmt.Errorf("failed to re-encrypt %s of row %d: %w", column, row.ID, err)
+				}
+			}
+			if len(rows) > 0 {
+				log.Printf("Encrypted %d values in column %s", len(rows), column)
+			}
+		}
+	}
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func wrapKey(masterKey, raw []byte) (string, error) {
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return "", err
+	}
+	return sealBytes(aead, raw)
+}
+
+func unwrapKey(masterKey []byte, wrapped string) ([]byte, error) {
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return openBytes(aead, wrapped)
+}
+
+func sealBytes(aead cipher.AEAD, plaintext []byte) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+func openBytes(aead cipher.AEAD, encoded string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+}
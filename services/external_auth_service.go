@@ -0,0 +1,106 @@
+package services
+
+import (
+	"errors"
+	"log"
+
+	"anonymail/models"
+
+	"gorm.io/gorm"
+)
+
+var ErrUsernameTaken = errors.New("username is already used by another account")
+
+// 关闭后只能通过单点登录等外部方式登录
+var passwordLoginDisabled bool
+
+func SetPasswordLoginDisabled(disabled bool) {
+	passwordLoginDisabled = disabled
+}
+
+func PasswordLoginDisabled() bool {
+	return passwordLoginDisabled
+}
+
+// 开启后该身份源的新用户总是直接创建为启用状态，不受注册模式限制
+var externalAutoProvision = map[string]bool{}
+
+func SetExternalAutoProvision(provider string, enabled bool) {
+	externalAutoProvision[provider] = enabled
+}
+
+// 按外部身份查找用户，首次登录时按注册模式创建。isAdmin 为 nil 时不修改管理员状态
+func ProvisionExternalUser(db *gorm.DB, provider string, externalID string, username string, isAdmin *bool) (models.User, error) {
+	var user models.User
+	err := db.Where("auth_provider = ? AND external_id = ?", provider, externalID).First(&user).Error
+	if err == nil {
+		if isAdmin != nil && user.IsAdmin != *isAdmin {
+			// 组的变化不能降级最后一个管理员
+			if !*isAdmin && !user.Disabled {
+				if err := EnsureOtherAdminExists(db, user.ID); errors.Is(err, ErrLastAdmin) {
+					log.Printf("Keeping admin rights of %s, the last administrator", user.Username)
+					return user, nil
+				} else if err != nil {
+					return models.User{}, err
+				}
+			}
+			if err := db.Model(&user).Update("is_admin", *isAdmin).Error; err != nil {
+				return models.User{}, err
+			}
+			user.IsAdmin = *isAdmin
+		}
+		return user, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return models.User{}, err
+	}
+
+	// 不自动关联同名的本地账户，否则外部身份源可以接管本地账户
+	var count int64
+	if err := db.Unscoped().Model(&models.User{}).Where("username = ?", username).Count(&count).Error; err != nil {
+		return models.User{}, err
+	}
+	if count > 0 {
+		return models.User{}, ErrUsernameTaken
+	}
+
+	user = models.User{
+		Username:     username,
+		AuthProvider: provider,
+		ExternalID:   externalID,
+	}
+	// 外部登录无法提交邀请码，邀请模式下与关闭注册相同；需要审批时创建停用的账户
+	if !externalAutoProvision[provider] {
+		mode, err := GetRegistrationMode(db)
+		if err != nil {
+			return models.User{}, err
+		}
+		switch mode {
+		case RegistrationClosed, RegistrationInvite:
+			return models.User{}, ErrRegistrationClosed
+		case RegistrationApproval:
+			user.Disabled = true
+			user.DisabledReason = models.DisabledPendingApproval
+		}
+	}
+	if isAdmin != nil {
+		user.IsAdmin = *isAdmin
+	}
+	if err := db.Create(&user).Error; err != nil {
+		return models.User{}, err
+	}
+	// 外部登录创建的账户没有管理员参与，由这里记录审计事件，登录事件由调用方记录
+	_, err = RecordAuditEvent(db, AuditEntry{
+		ActorID:    user.ID,
+		ActorName:  user.Username,
+		Action:     models.AuditUserCreated,
+		TargetType: "user",
+		TargetID:   user.ID,
+		UserID:     user.ID,
+		After:      map[string]interface{}{"auth_provider": provider, "is_admin": user.IsAdmin, "disabled": user.Disabled, "disabled_reason": user.DisabledReason},
+	})
+	if err != nil {
+		log.Printf("Failed to record audit event for new %s user %s: %v", provider, user.Username, err)
+	}
+	return user, nil
+}
@@ -0,0 +1,72 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"anonymail/models"
+)
+
+func TestProvisionExternalUserFollowsRegistrationMode(t *testing.T) {
+	tests := []struct {
+		mode          string
+		autoProvision bool
+		wantErr       error
+		wantDisabled  bool
+	}{
+		{RegistrationOpen, false, nil, false},
+		{RegistrationApproval, false, nil, true},
+		{RegistrationInvite, false, ErrRegistrationClosed, false},
+		{RegistrationClosed, false, ErrRegistrationClosed, false},
+		{RegistrationClosed, true, nil, false},
+	}
+	for _, tt := range tests {
+		name := tt.mode
+		if tt.autoProvision {
+			name += " with auto provisioning"
+		}
+		t.Run(name, func(t *testing.T) {
+			db := openTestDB(t)
+			if err := SetSetting(db, SettingRegistrationMode, tt.mode); err != nil {
+				t.Fatal(err)
+			}
+			SetExternalAutoProvision(models.AuthProviderOIDC, tt.autoProvision)
+			defer SetExternalAutoProvision(models.AuthProviderOIDC, false)
+
+			user, err := ProvisionExternalUser(db, models.AuthProviderOIDC, "subject-1", "sso-alice", nil)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if user.Disabled != tt.wantDisabled || (tt.wantDisabled && user.DisabledReason != models.DisabledPendingApproval) {
+				t.Fatalf("unexpected user state disabled=%v reason=%q", user.Disabled, user.DisabledReason)
+			}
+
+			// 已存在的用户再次登录不受注册模式影响
+			if err := SetSetting(db, SettingRegistrationMode, RegistrationClosed); err != nil {
+				t.Fatal(err)
+			}
+			again, err := ProvisionExternalUser(db, models.AuthProviderOIDC, "subject-1", "sso-alice", nil)
+			if err != nil || again.ID != user.ID {
+				t.Fatalf("existing user rejected: %v", err)
+			}
+		})
+	}
+}
+
+func TestProvisionExternalUserKeepsLastAdmin(t *testing.T) {
+	db := openTestDB(t)
+	isAdmin := true
+	admin, err := ProvisionExternalUser(db, models.AuthProviderOIDC, "subject-1", "sso-admin", &isAdmin)
+	if err != nil || !admin.IsAdmin {
+		t.Fatalf("admin not created: %v", err)
+	}
+
+	isAdmin = false
+	admin, err = ProvisionExternalUser(db, models.AuthProviderOIDC, "subject-1", "sso-admin", &isAdmin)
+	if err != nil || !admin.IsAdmin {
+		t.Fatalf("last admin demoted: %v", err)
+	}
+}
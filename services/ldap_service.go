@@ -0,0 +1,276 @@
+package services
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"anonymail/models"
+
+	"github.com/go-ldap/ldap/v3"
+	"gorm.io/gorm"
+)
+
+const ldapTimeout = 10 * time.Second
+
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+type LDAPConfig struct {
+	URL                string
+	StartTLS           bool
+	InsecureSkipVerify bool
+	BindDN             string
+	BindPassword       string
+	BaseDN             string
+	UserFilter         string
+	UsernameAttribute  string
+	IDAttribute        string
+	GroupAttribute     string
+	AdminGroup         string
+}
+
+var ldapConfig LDAPConfig
+
+// ldapUser 是目录中查到的用户
+type ldapUser struct {
+	DN         string
+	ExternalID string
+	Username   string
+	Groups     []string
+}
+
+func SetLDAPConfig(config LDAPConfig) {
+	if config.UserFilter == "" {
+		config.UserFilter = "(&(objectClass=person)(uid={username}))"
+	}
+	if config.UsernameAttribute == "" {
+		config.UsernameAttribute = "uid"
+	}
+	if config.IDAttribute == "" {
+		config.IDAttribute = "entryUUID"
+	}
+	if config.GroupAttribute == "" {
+		config.GroupAttribute = "memberOf"
+	}
+	ldapConfig = config
+}
+
+func LDAPEnabled() bool {
+	return ldapConfig.URL != ""
+}
+
+// 在目录中验证用户名和密码，成功后查找或创建对应的本地用户
+func LDAPLogin(db *gorm.DB, username string, password string) (models.User, error) {
+	// 空密码会被 LDAP 服务器当作匿名绑定而成功，必须拒绝
+	if username == "" || password == "" {
+		return models.User{}, ErrInvalidCredentials
+	}
+
+	conn, err := ldapConnect()
+	if err != nil {
+		return models.User{}, err
+	}
+	defer conn.Close()
+
+	entries, err := ldapSearchUsers(conn, ldap.EscapeFilter(username))
+	if err != nil {
+		return models.User{}, err
+	}
+	if len(entries) != 1 {
+		return models.User{}, ErrInvalidCredentials
+	}
+	entry := entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return models.User{}, ErrInvalidCredentials
+		}
+		return models.User{}, fmt.Errorf("ldap bind failed: %w", err)
+	}
+
+	user, err := ProvisionExternalUser(db, models.AuthProviderLDAP, entry.ExternalID, entry.Username, ldapAdminStatus(entry))
+	if err != nil {
+		return models.User{}, err
+	}
+	// 同步时暂时找不到而被停用的账户，能在目录中登录说明已经恢复
+	if user.Disabled && user.DisabledReason == models.DisabledByDirectorySync {
+		if err := db.Model(&user).Updates(map[string]interface{}{"disabled": false, "disabled_reason": ""}).Error; err != nil {
+			return models.User{}, err
+		}
+	}
+	return user, nil
+}
+
+// 定期与目录同步：停用目录中已不存在的账户，重新启用重新出现的账户，并更新管理员状态
+func SyncLDAPUsers(db *gorm.DB) error {
+	conn, err := ldapConnect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	entries, err := ldapSearchUsers(conn, "*")
+	if err != nil {
+		return err
+	}
+	// 目录返回空结果更可能是配置或权限问题，不能据此停用所有账户
+	if len(entries) == 0 {
+		return errors.New("ldap search returned no users, skipping sync")
+	}
+	byID := make(map[string]ldapUser, len(entries))
+	for _, entry := range entries {
+		byID[entry.ExternalID] = entry
+	}
+
+	var users []models.User
+	if err := db.Where("auth_provider = ?", models.AuthProviderLDAP).Find(&users).Error; err != nil {
+		return err
+	}
+
+	disabled, enabled := 0, 0
+	for _, user := range users {
+		entry, found := byID[user.ExternalID]
+		updates := map[string]interface{}{}
+		switch {
+		case !found && !user.Disabled:
+			updates["disabled"] = true
+			updates["disabled_reason"] = models.DisabledByDirectorySync
+			disabled++
+		case found && user.Disabled && user.DisabledReason == models.DisabledByDirectorySync:
+			updates["disabled"] = false
+			updates["disabled_reason"] = ""
+			enabled++
+		}
+		if found {
+			if isAdmin := ldapAdminStatus(entry); isAdmin != nil && *isAdmin != user.IsAdmin {
+				updates["is_admin"] = *isAdmin
+			}
+		}
+		if len(updates) == 0 {
+			continue
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			// 目录或组的变化不能停用或降级最后一个管理员
+			if user.IsAdmin && !user.Disabled && (updates["disabled"] == true || updates["is_admin"] == false) {
+				if err := EnsureOtherAdminExists(tx, user.ID); err != nil {
+					return err
+				}
+			}
+			if err := tx.Model(&user).Updates(updates).Error; err != nil {
+				return err
+			}
+			if updates["disabled"] == true {
+				return RevokeUserSessions(tx, user.ID, 0)
+			}
+			return nil
+		})
+		if errors.Is(err, ErrLastAdmin) {
+			log.Printf("LDAP sync: keeping %s, the last administrator, enabled and an admin", user.Username)
+			if updates["disabled"] == true {
+				disabled--
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to sync user %d: %w", user.ID, err)
+		}
+	}
+
+	if disabled > 0 || enabled > 0 {
+		log.Printf("LDAP sync: disabled %d and re-enabled %d accounts", disabled, enabled)
+	}
+	return nil
+}
+
+// 后台定期同步，启动后立即同步一次，interval 为 0 时不启动
+func StartLDAPSync(db *gorm.DB, interval time.Duration) {
+	if !LDAPEnabled() || interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := SyncLDAPUsers(db); err != nil {
+				log.Printf("LDAP sync failed: %v", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+func ldapConnect() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: ldapConfig.InsecureSkipVerify}
+	conn, err := ldap.DialURL(ldapConfig.URL, ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ldap: %w", err)
+	}
+	conn.SetTimeout(ldapTimeout)
+
+	if ldapConfig.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("ldap starttls failed: %w", err)
+		}
+	}
+	if ldapConfig.BindDN != "" {
+		if err := conn.Bind(ldapConfig.BindDN, ldapConfig.BindPassword); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("ldap service bind failed: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// usernameFilter 必须已经转义，同步时传入 * 以列出所有用户
+func ldapSearchUsers(conn *ldap.Conn, usernameFilter string) ([]ldapUser, error) {
+	request := ldap.NewSearchRequest(
+		ldapConfig.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(ldapTimeout.Seconds()), false,
+		strings.ReplaceAll(ldapConfig.UserFilter, "{username}", usernameFilter),
+		[]string{ldapConfig.UsernameAttribute, ldapConfig.IDAttribute, ldapConfig.GroupAttribute},
+		nil,
+	)
+	result, err := conn.SearchWithPaging(request, 500)
+	if err != nil {
+		return nil, fmt.Errorf("ldap search failed: %w", err)
+	}
+
+	users := make([]ldapUser, 0, len(result.Entries))
+	for _, entry := range result.Entries {
+		user := ldapUser{
+			DN:         entry.DN,
+			ExternalID: entry.GetAttributeValue(ldapConfig.IDAttribute),
+			Username:   entry.GetAttributeValue(ldapConfig.UsernameAttribute),
+			Groups:     entry.GetAttributeValues(ldapConfig.GroupAttribute),
+		}
+		// 目录不提供唯一 ID 属性时使用 DN
+		if user.ExternalID == "" {
+			user.ExternalID = entry.DN
+		}
+		if user.Username == "" {
+			continue
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// 未配置管理员组时返回 nil，不修改管理员状态
+func ldapAdminStatus(user ldapUser) *bool {
+	if ldapConfig.AdminGroup == "" {
+		return nil
+	}
+	isAdmin := false
+	for _, group := range user.Groups {
+		if strings.EqualFold(group, ldapConfig.AdminGroup) {
+			isAdmin = true
+			break
+		}
+	}
+	return &isAdmin
+}
@@ -0,0 +1,209 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"anonymail/models"
+
+	"gorm.io/gorm"
+)
+
+// 限速记录的类型，与 IP 或用户名拼接成 key
+const (
+	throttleLoginIP    = "login-ip:"
+	throttleAccount    = "account:"
+	throttleRegisterIP = "register-ip:"
+)
+
+const (
+	// 超过免费次数后，每次失败的等待时间翻倍，直到上限
+	throttleFreeAttempts = 3
+	throttleBaseDelay    = time.Second
+	throttleMaxDelay     = 5 * time.Minute
+	// 最后一次失败超过该时长后重新计数
+	throttleWindow = time.Hour
+)
+
+var (
+	ErrTooManyAttempts = errors.New("too many attempts")
+	ErrAccountLocked   = errors.New("account is temporarily locked")
+)
+
+var (
+	accountMaxFailures     = 10
+	accountLockoutDuration = 15 * time.Minute
+)
+
+func SetAccountLockout(maxFailures int, duration time.Duration) {
+	accountMaxFailures = maxFailures
+	accountLockoutDuration = duration
+}
+
+// 检查是否允许本次登录尝试，不允许时返回需要等待的时长
+func CheckLoginAllowed(db *gorm.DB, ip string, username string) (time.Duration, error) {
+	if wait, err := throttleWait(db, throttleLoginIP+ip); err != nil || wait > 0 {
+		return wait, firstError(err, ErrTooManyAttempts)
+	}
+
+	record, err := findThrottle(db, throttleAccount+username)
+	if err != nil || record == nil {
+		return 0, err
+	}
+	if record.LockedUntil != nil && time.Now().Before(*record.LockedUntil) {
+		return time.Until(*record.LockedUntil), ErrAccountLocked
+	}
+	if wait := progressiveDelay(*record); wait > 0 {
+		return wait, ErrTooManyAttempts
+	}
+	return 0, nil
+}
+
+// 记录一次失败的登录，账户连续失败达到上限后临时锁定
+func RecordLoginFailure(db *gorm.DB, ip string, username string) error {
+	if _, err := recordThrottleFailure(db, throttleLoginIP+ip); err != nil {
+		return err
+	}
+	record, err := recordThrottleFailure(db, throttleAccount+username)
+	if err != nil {
+		return err
+	}
+
+	if accountMaxFailures > 0 && record.Failures >= accountMaxFailures && record.LockedUntil == nil {
+		lockedUntil := time.Now().Add(accountLockoutDuration)
+		if err := db.Model(&record).Update("locked_until", lockedUntil).Error; err != nil {
+			return err
+		}
+		log.Printf("Account %q locked until %s after %d failed logins, last from %s", username, lockedUntil.Format(time.RFC3339), record.Failures, ip)
+	}
+	return nil
+}
+
+// 登录成功后清除账户的失败记录。IP 的记录保留，避免攻击者用自己的账户重置计数
+func ResetLoginFailures(db *gorm.DB, username string) error {
+	return db.Where("key = ?", throttleAccount+username).Delete(&models.LoginThrottle{}).Error
+}
+
+// 注册不区分成功失败，每次尝试都计数
+func CheckRegistrationAllowed(db *gorm.DB, ip string) (time.Duration, error) {
+	wait, err := throttleWait(db, throttleRegisterIP+ip)
+	if err != nil || wait > 0 {
+		return wait, firstError(err, ErrTooManyAttempts)
+	}
+	_, err = recordThrottleFailure(db, throttleRegisterIP+ip)
+	return 0, err
+}
+
+// 管理员解除账户锁定
+func UnlockAccount(db *gorm.DB, userID uint) error {
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		return err
+	}
+	if err := ResetLoginFailures(db, user.Username); err != nil {
+		return err
+	}
+	log.Printf("Account %q unlocked", user.Username)
+	return nil
+}
+
+// 返回账户当前锁定到的时间，未锁定时返回 nil
+func AccountLockedUntil(db *gorm.DB, username string) (*time.Time, error) {
+	record, err := findThrottle(db, throttleAccount+username)
+	if err != nil || record == nil {
+		return nil, err
+	}
+	if record.LockedUntil == nil || time.Now().After(*record.LockedUntil) {
+		return nil, nil
+	}
+	return record.LockedUntil, nil
+}
+
+// 返回当前被锁定的账户的用户名
+func lockedUsernames(db *gorm.DB) ([]string, error) {
+	var keys []string
+	err := db.Model(&models.LoginThrottle{}).
+		Where("key LIKE ? AND locked_until > ?", throttleAccount+"%", time.Now()).
+		Pluck("key", &keys).Error
+	usernames := make([]string, 0, len(keys))
+	for _, key := range keys {
+		usernames = append(usernames, strings.TrimPrefix(key, throttleAccount))
+	}
+	return usernames, err
+}
+
+func throttleWait(db *gorm.DB, key string) (time.Duration, error) {
+	record, err := findThrottle(db, key)
+	if err != nil || record == nil {
+		return 0, err
+	}
+	return progressiveDelay(*record), nil
+}
+
+// 过期的记录视为不存在
+func findThrottle(db *gorm.DB, key string) (*models.LoginThrottle, error) {
+	var record models.LoginThrottle
+	err := db.Where("key = ?", key).First(&record).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if throttleExpired(record, time.Now()) {
+		return nil, nil
+	}
+	return &record, nil
+}
+
+func recordThrottleFailure(db *gorm.DB, key string) (models.LoginThrottle, error) {
+	now := time.Now()
+	var record models.LoginThrottle
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("key = ?", key).First(&record).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			record = models.LoginThrottle{Key: key}
+		} else if err != nil {
+			return err
+		}
+
+		if throttleExpired(record, now) {
+			record.Failures = 0
+			record.LockedUntil = nil
+		}
+		record.Failures++
+		record.LastFailureAt = now
+		return tx.Save(&record).Error
+	})
+	return record, err
+}
+
+func throttleExpired(record models.LoginThrottle, now time.Time) bool {
+	if record.LockedUntil != nil {
+		return now.After(*record.LockedUntil)
+	}
+	return now.Sub(record.LastFailureAt) > throttleWindow
+}
+
+func progressiveDelay(record models.LoginThrottle) time.Duration {
+	if record.Failures < throttleFreeAttempts {
+		return 0
+	}
+	delay := throttleMaxDelay
+	if shift := record.Failures - throttleFreeAttempts; shift < 16 {
+		delay = throttleBaseDelay << shift
+		if delay > throttleMaxDelay {
+			delay = throttleMaxDelay
+		}
+	}
+	return time.Until(record.LastFailureAt.Add(delay))
+}
+
+func firstError(err error, fallback error) error {
+	if err != nil {
+		return err
+	}
+	return fallback
+}
@@ -0,0 +1,479 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"anonymail/models"
+
+	"gorm.io/gorm"
+)
+
+const (
+	oidcStateTTL          = 10 * time.Minute
+	oidcClockSkew         = time.Minute
+	oidcKeyRefreshBackoff = time.Minute
+	oidcMaxResponseSize   = 1 << 20
+)
+
+var ErrOIDCLogin = errors.New("single sign-on failed")
+
+type OIDCConfig struct {
+	Issuer        string
+	ClientID      string
+	ClientSecret  string
+	RedirectURL   string
+	Scopes        []string
+	UsernameClaim string
+	GroupsClaim   string
+	AdminGroup    string
+	DisplayName   string
+}
+
+var oidcConfig OIDCConfig
+
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// 身份提供方的元数据和签名公钥，首次使用时获取
+var oidcProvider struct {
+	mu            sync.Mutex
+	metadata      *oidcMetadata
+	keys          map[string]crypto.PublicKey
+	keysFetchedAt time.Time
+}
+
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func SetOIDCConfig(config OIDCConfig) {
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "profile", "email"}
+	}
+	if config.UsernameClaim == "" {
+		config.UsernameClaim = "preferred_username"
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+	if config.DisplayName == "" {
+		config.DisplayName = "SSO"
+	}
+	config.Issuer = strings.TrimRight(config.Issuer, "/")
+	oidcConfig = config
+}
+
+func OIDCEnabled() bool {
+	return oidcConfig.Issuer != "" && oidcConfig.ClientID != ""
+}
+
+func OIDCDisplayName() string {
+	return oidcConfig.DisplayName
+}
+
+// 回调地址必须配置，不能根据请求的 Host 推断，否则伪造的请求头可以改变回调地址
+func OIDCRedirectURL() string {
+	return oidcConfig.RedirectURL
+}
+
+// 生成 state、nonce 和 PKCE 参数，返回身份提供方的授权地址和 state
+func BeginOIDCLogin(db *gorm.DB, redirectURL string) (string, string, error) {
+	metadata, err := discoverOIDC()
+	if err != nil {
+		return "", "", err
+	}
+
+	state, err := GenerateRandomToken()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := GenerateRandomToken()
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := GenerateRandomToken()
+	if err != nil {
+		return "", "", err
+	}
+	verifier = strings.TrimRight(verifier, "=")
+
+	record := models.OIDCState{
+		StateHash:    hashChallengeToken(state),
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		RedirectURL:  redirectURL,
+		ExpiresAt:    time.Now().Add(oidcStateTTL),
+	}
+	if err := db.Create(&record).Error; err != nil {
+		return "", "", err
+	}
+	if err := db.Unscoped().Where("expires_at < ?", time.Now()).Delete(&models.OIDCState{}).Error; err != nil {
+		return "", "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", oidcConfig.ClientID)
+	query.Set("redirect_uri", redirectURL)
+	query.Set("scope", strings.Join(oidcConfig.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(metadata.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return metadata.AuthorizationEndpoint + separator + query.Encode(), state, nil
+}
+
+// 用授权码换取并校验 ID Token，然后查找或创建对应的用户
+func CompleteOIDCLogin(db *gorm.DB, state string, code string) (models.User, error) {
+	var record models.OIDCState
+	if err := db.Where("state_hash = ?", hashChallengeToken(state)).First(&record).Error; err != nil {
+		return models.User{}, fmt.Errorf("%w: unknown state", ErrOIDCLogin)
+	}
+	if err := db.Unscoped().Delete(&record).Error; err != nil {
+		return models.User{}, err
+	}
+	if time.Now().After(record.ExpiresAt) {
+		return models.User{}, fmt.Errorf("%w: login request expired", ErrOIDCLogin)
+	}
+
+	metadata, err := discoverOIDC()
+	if err != nil {
+		return models.User{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", record.RedirectURL)
+	form.Set("client_id", oidcConfig.ClientID)
+	form.Set("code_verifier", record.CodeVerifier)
+	req, err := http.NewRequest(http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return models.User{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if oidcConfig.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(oidcConfig.ClientID), url.QueryEscape(oidcConfig.ClientSecret))
+	}
+
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		AccessToken      string `json:"access_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := oidcDoJSON(req, &tokens); err != nil {
+		if tokens.Error != "" {
+			return models.User{}, fmt.Errorf("%w: token endpoint returned %s: %s", ErrOIDCLogin, tokens.Error, tokens.ErrorDescription)
+		}
+		return models.User{}, err
+	}
+	if tokens.IDToken == "" {
+		return models.User{}, fmt.Errorf("%w: no id_token in token response", ErrOIDCLogin)
+	}
+
+	claims, err := verifyIDToken(tokens.IDToken, record.Nonce)
+	if err != nil {
+		return models.User{}, err
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return models.User{}, fmt.Errorf("%w: id_token has no subject", ErrOIDCLogin)
+	}
+
+	// ID Token 中缺少的声明（例如部分提供方只在 userinfo 中返回 groups）从 userinfo 补充
+	if metadata.UserinfoEndpoint != "" && tokens.AccessToken != "" {
+		if err := mergeOIDCUserinfo(metadata.UserinfoEndpoint, tokens.AccessToken, subject, claims); err != nil {
+			return models.User{}, err
+		}
+	}
+
+	username := claimString(claims, oidcConfig.UsernameClaim)
+	if username == "" {
+		return models.User{}, fmt.Errorf("%w: claim %q is missing", ErrOIDCLogin, oidcConfig.UsernameClaim)
+	}
+	var isAdmin *bool
+	if oidcConfig.AdminGroup != "" {
+		admin := false
+		for _, group := range claimStrings(claims, oidcConfig.GroupsClaim) {
+			if group == oidcConfig.AdminGroup {
+				admin = true
+				break
+			}
+		}
+		isAdmin = &admin
+	}
+
+	return ProvisionExternalUser(db, models.AuthProviderOIDC, subject, username, isAdmin)
+}
+
+func discoverOIDC() (*oidcMetadata, error) {
+	oidcProvider.mu.Lock()
+	defer oidcProvider.mu.Unlock()
+	if oidcProvider.metadata != nil {
+		return oidcProvider.metadata, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, oidcConfig.Issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	var metadata oidcMetadata
+	if err := oidcDoJSON(req, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to load OIDC discovery document: %w", err)
+	}
+	if strings.TrimRight(metadata.Issuer, "/") != oidcConfig.Issuer {
+		return nil, fmt.Errorf("OIDC discovery issuer %q does not match %q", metadata.Issuer, oidcConfig.Issuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, errors.New("OIDC discovery document is incomplete")
+	}
+	oidcProvider.metadata = &metadata
+	return &metadata, nil
+}
+
+// 遇到未知的 kid 时重新获取 JWKS，以支持身份提供方轮换密钥
+func oidcSigningKey(kid string) (crypto.PublicKey, error) {
+	metadata, err := discoverOIDC()
+	if err != nil {
+		return nil, err
+	}
+
+	oidcProvider.mu.Lock()
+	defer oidcProvider.mu.Unlock()
+	if key, ok := oidcProvider.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(oidcProvider.keysFetchedAt) < oidcKeyRefreshBackoff {
+		return nil, fmt.Errorf("%w: unknown signing key %q", ErrOIDCLogin, kid)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, metadata.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := oidcDoJSON(req, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to load OIDC signing keys: %w", err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		switch jwk.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+			if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+				continue
+			}
+			exponent := 0
+			for _, b := range e {
+				exponent = exponent<<8 | int(b)
+			}
+			keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}
+		case "EC":
+			x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if jwk.Crv != "P-256" || errX != nil || errY != nil {
+				continue
+			}
+			key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !key.Curve.IsOnCurve(key.X, key.Y) {
+				continue
+			}
+			keys[jwk.Kid] = key
+		}
+	}
+	oidcProvider.keys = keys
+	oidcProvider.keysFetchedAt = time.Now()
+
+	key, ok := keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown signing key %q", ErrOIDCLogin, kid)
+	}
+	return key, nil
+}
+
+// 校验 ID Token 的签名（RS256/ES256）、签发方、受众、有效期和 nonce
+func verifyIDToken(rawToken string, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed id_token", ErrOIDCLogin)
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed id_token", ErrOIDCLogin)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, fmt.Errorf("%w: malformed id_token", ErrOIDCLogin)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed id_token", ErrOIDCLogin)
+	}
+
+	key, err := oidcSigningKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	valid := false
+	switch header.Alg {
+	case "RS256":
+		if rsaKey, ok := key.(*rsa.PublicKey); ok {
+			valid = rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature) == nil
+		}
+	case "ES256":
+		if ecKey, ok := key.(*ecdsa.PublicKey); ok && len(signature) == 64 {
+			r := new(big.Int).SetBytes(signature[:32])
+			s := new(big.Int).SetBytes(signature[32:])
+			valid = ecdsa.Verify(ecKey, digest[:], r, s)
+		}
+	}
+	if !valid {
+		return nil, fmt.Errorf("%w: invalid id_token signature", ErrOIDCLogin)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed id_token", ErrOIDCLogin)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("%w: malformed id_token", ErrOIDCLogin)
+	}
+
+	if issuer, _ := claims["iss"].(string); strings.TrimRight(issuer, "/") != oidcConfig.Issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrOIDCLogin, issuer)
+	}
+	audiences := claimStrings(claims, "aud")
+	audienceOK := false
+	for _, audience := range audiences {
+		if audience == oidcConfig.ClientID {
+			audienceOK = true
+		}
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != oidcConfig.ClientID {
+		audienceOK = false
+	}
+	if !audienceOK {
+		return nil, fmt.Errorf("%w: id_token was issued for another client", ErrOIDCLogin)
+	}
+	exp, _ := claims["exp"].(float64)
+	if time.Now().Add(-oidcClockSkew).After(time.Unix(int64(exp), 0)) {
+		return nil, fmt.Errorf("%w: id_token expired", ErrOIDCLogin)
+	}
+	if tokenNonce, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(tokenNonce), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrOIDCLogin)
+	}
+	return claims, nil
+}
+
+func mergeOIDCUserinfo(endpoint string, accessToken string, subject string, claims map[string]interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+
+	var userinfo map[string]interface{}
+	if err := oidcDoJSON(req, &userinfo); err != nil {
+		return fmt.Errorf("failed to load OIDC userinfo: %w", err)
+	}
+	if sub, _ := userinfo["sub"].(string); sub != subject {
+		return fmt.Errorf("%w: userinfo subject does not match id_token", ErrOIDCLogin)
+	}
+	for name, value := range userinfo {
+		if _, ok := claims[name]; !ok {
+			claims[name] = value
+		}
+	}
+	return nil
+}
+
+// 发送请求并解析 JSON 响应，非 2xx 状态时仍会解析响应体以便读取错误信息
+func oidcDoJSON(req *http.Request, out interface{}) error {
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, oidcMaxResponseSize))
+	if err != nil {
+		return err
+	}
+	decodeErr := json.Unmarshal(body, out)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned status %d", req.URL.Host, resp.StatusCode)
+	}
+	return decodeErr
+}
+
+func claimString(claims map[string]interface{}, name string) string {
+	value, _ := claims[name].(string)
+	return value
+}
+
+// 声明可以是字符串或字符串数组
+func claimStrings(claims map[string]interface{}, name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
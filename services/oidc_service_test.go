@@ -0,0 +1,281 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"anonymail/models"
+
+	"gorm.io/gorm"
+)
+
+const testOIDCClientID = "anonymail-test"
+
+// 测试用的身份提供方，提供发现文档、JWKS 和 token 接口
+type testOIDCIssuer struct {
+	t      *testing.T
+	server *httptest.Server
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+
+	mu            sync.Mutex
+	idToken       string
+	codeChallenge string
+}
+
+func newTestOIDCIssuer(t *testing.T) *testOIDCIssuer {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &testOIDCIssuer{t: t, rsaKey: rsaKey, ecKey: ecKey}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer.server.URL,
+			"authorization_endpoint": issuer.server.URL + "/authorize",
+			"token_endpoint":         issuer.server.URL + "/token",
+			"jwks_uri":               issuer.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		b64 := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa-1", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec-1", "use": "sig", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		issuer.mu.Lock()
+		defer issuer.mu.Unlock()
+		// 校验 PKCE，确认客户端发送的是授权请求对应的 code_verifier
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if r.PostFormValue("code") != "test-code" || base64.RawURLEncoding.EncodeToString(verifier[:]) != issuer.codeChallenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": issuer.idToken, "token_type": "Bearer"})
+	})
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+// 按给定的头部和声明签发 ID Token，alg 决定签名方式
+func (issuer *testOIDCIssuer) sign(header map[string]string, claims map[string]interface{}) string {
+	issuer.t.Helper()
+	headerJSON, _ := json.Marshal(header)
+	claimsJSON, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch header["alg"] {
+	case "RS256":
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, issuer.rsaKey, crypto.SHA256, digest[:])
+		if err != nil {
+			issuer.t.Fatal(err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, issuer.ecKey, digest[:])
+		if err != nil {
+			issuer.t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case "HS256":
+		// 用公钥作为 HMAC 密钥，模拟算法混淆攻击
+		mac := hmac.New(sha256.New, issuer.rsaKey.N.Bytes())
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (issuer *testOIDCIssuer) claims(nonce string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":                issuer.server.URL,
+		"aud":                testOIDCClientID,
+		"sub":                "subject-1",
+		"preferred_username": "sso-alice",
+		"nonce":              nonce,
+		"iat":                time.Now().Unix(),
+		"exp":                time.Now().Add(5 * time.Minute).Unix(),
+	}
+}
+
+func setupTestOIDC(t *testing.T) (*gorm.DB, *testOIDCIssuer) {
+	t.Helper()
+	db := openTestDB(t)
+	if err := db.AutoMigrate(&models.OIDCState{}); err != nil {
+		t.Fatal(err)
+	}
+	issuer := newTestOIDCIssuer(t)
+
+	previous := oidcConfig
+	SetOIDCConfig(OIDCConfig{Issuer: issuer.server.URL, ClientID: testOIDCClientID})
+	resetOIDCProvider()
+	t.Cleanup(func() {
+		oidcConfig = previous
+		resetOIDCProvider()
+	})
+	return db, issuer
+}
+
+func resetOIDCProvider() {
+	oidcProvider.mu.Lock()
+	defer oidcProvider.mu.Unlock()
+	oidcProvider.metadata = nil
+	oidcProvider.keys = nil
+	oidcProvider.keysFetchedAt = time.Time{}
+}
+
+// 发起登录，返回 state 和 nonce
+func beginTestOIDCLogin(t *testing.T, db *gorm.DB, issuer *testOIDCIssuer) (string, string) {
+	t.Helper()
+	authURL, state, err := BeginOIDCLogin(db, "https://mail.example.com/oidc/callback")
+	if err != nil {
+		t.Fatalf("begin login: %v", err)
+	}
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+	if query.Get("state") != state || query.Get("client_id") != testOIDCClientID || query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("unexpected authorization url %s", authURL)
+	}
+	issuer.mu.Lock()
+	issuer.codeChallenge = query.Get("code_challenge")
+	issuer.mu.Unlock()
+	return state, query.Get("nonce")
+}
+
+func (issuer *testOIDCIssuer) setIDToken(token string) {
+	issuer.mu.Lock()
+	defer issuer.mu.Unlock()
+	issuer.idToken = token
+}
+
+func TestOIDCLogin(t *testing.T) {
+	for _, tt := range []struct{ alg, kid string }{{"RS256", "rsa-1"}, {"ES256", "ec-1"}} {
+		t.Run(tt.alg, func(t *testing.T) {
+			db, issuer := setupTestOIDC(t)
+			state, nonce := beginTestOIDCLogin(t, db, issuer)
+			issuer.setIDToken(issuer.sign(map[string]string{"alg": tt.alg, "kid": tt.kid}, issuer.claims(nonce)))
+
+			user, err := CompleteOIDCLogin(db, state, "test-code")
+			if err != nil {
+				t.Fatalf("login failed: %v", err)
+			}
+			if user.Username != "sso-alice" || user.AuthProvider != models.AuthProviderOIDC || user.ExternalID != "subject-1" {
+				t.Fatalf("unexpected user %+v", user)
+			}
+
+			// state 只能使用一次
+			if _, err := CompleteOIDCLogin(db, state, "test-code"); !errors.Is(err, ErrOIDCLogin) {
+				t.Fatalf("reused state accepted: %v", err)
+			}
+		})
+	}
+}
+
+func TestOIDCLoginRejectsInvalidIDTokens(t *testing.T) {
+	tests := []struct {
+		name   string
+		header map[string]string
+		modify func(claims map[string]interface{})
+	}{
+		{"wrong audience", nil, func(claims map[string]interface{}) { claims["aud"] = "another-client" }},
+		{"wrong authorized party", nil, func(claims map[string]interface{}) {
+			claims["aud"] = []string{testOIDCClientID, "another-client"}
+			claims["azp"] = "another-client"
+		}},
+		{"wrong issuer", nil, func(claims map[string]interface{}) { claims["iss"] = "https://evil.example.com" }},
+		{"expired", nil, func(claims map[string]interface{}) { claims["exp"] = time.Now().Add(-2 * oidcClockSkew).Unix() }},
+		{"missing expiry", nil, func(claims map[string]interface{}) { delete(claims, "exp") }},
+		{"nonce mismatch", nil, func(claims map[string]interface{}) { claims["nonce"] = "other-nonce" }},
+		{"missing nonce", nil, func(claims map[string]interface{}) { delete(claims, "nonce") }},
+		{"alg none", map[string]string{"alg": "none", "kid": "rsa-1"}, nil},
+		{"alg HS256", map[string]string{"alg": "HS256", "kid": "rsa-1"}, nil},
+		{"alg of another key type", map[string]string{"alg": "ES256", "kid": "rsa-1"}, nil},
+		{"unknown kid", map[string]string{"alg": "RS256", "kid": "rsa-unknown"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, issuer := setupTestOIDC(t)
+			state, nonce := beginTestOIDCLogin(t, db, issuer)
+
+			header := tt.header
+			if header == nil {
+				header = map[string]string{"alg": "RS256", "kid": "rsa-1"}
+			}
+			claims := issuer.claims(nonce)
+			if tt.modify != nil {
+				tt.modify(claims)
+			}
+			// 签名使用 alg 对应的已知密钥，unknown kid 的情况下只有 kid 不在 JWKS 中
+			issuer.setIDToken(issuer.sign(header, claims))
+
+			if _, err := CompleteOIDCLogin(db, state, "test-code"); !errors.Is(err, ErrOIDCLogin) {
+				t.Fatalf("got error %v, want %v", err, ErrOIDCLogin)
+			}
+			var count int64
+			db.Model(&models.User{}).Count(&count)
+			if count != 0 {
+				t.Fatal("user created for an invalid id_token")
+			}
+		})
+	}
+}
+
+func TestOIDCLoginRejectsTamperedSignature(t *testing.T) {
+	db, issuer := setupTestOIDC(t)
+	state, nonce := beginTestOIDCLogin(t, db, issuer)
+
+	token := issuer.sign(map[string]string{"alg": "RS256", "kid": "rsa-1"}, issuer.claims(nonce))
+	claims := issuer.claims(nonce)
+	claims["preferred_username"] = "admin"
+	forged, _ := json.Marshal(claims)
+	parts := strings.Split(token, ".")
+	issuer.setIDToken(parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2])
+
+	if _, err := CompleteOIDCLogin(db, state, "test-code"); !errors.Is(err, ErrOIDCLogin) {
+		t.Fatalf("got error %v, want %v", err, ErrOIDCLogin)
+	}
+}
+
+func TestOIDCLoginRequiresPKCEVerifier(t *testing.T) {
+	db, issuer := setupTestOIDC(t)
+	state, nonce := beginTestOIDCLogin(t, db, issuer)
+	issuer.setIDToken(issuer.sign(map[string]string{"alg": "RS256", "kid": "rsa-1"}, issuer.claims(nonce)))
+
+	// 另一次授权请求的 code_challenge 与本次的 code_verifier 不匹配
+	beginTestOIDCLogin(t, db, issuer)
+	if _, err := CompleteOIDCLogin(db, state, "test-code"); err == nil {
+		t.Fatal("login accepted with a mismatched code verifier")
+	}
+}
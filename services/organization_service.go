@@ -0,0 +1,381 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"anonymail/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrNotOrganizationMember     = errors.New("not a member of this organization")
+	ErrOrganizationOwnerRequired = errors.New("only organization owners can do this")
+	ErrLastOrganizationOwner     = errors.New("an organization needs at least one owner")
+	ErrInvalidOrganizationRole   = errors.New("invalid organization role")
+	ErrInvalidOrganizationName   = errors.New("organization name is required")
+	ErrAlreadyOrganizationMember = errors.New("user is already a member of this organization")
+)
+
+type OrganizationMembership struct {
+	Organization models.Organization
+	Role         string
+}
+
+type OrganizationMemberInfo struct {
+	UserID   uint
+	Username string
+	Role     string
+	JoinedAt time.Time
+}
+
+type OrganizationMemberUsage struct {
+	UserID         uint
+	Username       string
+	GeneratedToday int64
+	GeneratedMonth int64
+	GeneratedTotal int64
+	FailuresTotal  int64
+}
+
+func validOrganizationRole(role string) bool {
+	return role == models.OrganizationRoleOwner || role == models.OrganizationRoleMember
+}
+
+// 创建组织，创建者成为所有者
+func CreateOrganization(db *gorm.DB, owner models.User, name string) (models.Organization, error) {
+	organization := models.Organization{Name: strings.TrimSpace(name)}
+	if organization.Name == "" {
+		return models.Organization{}, ErrInvalidOrganizationName
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&organization).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.OrganizationMember{
+			OrganizationID: organization.ID,
+			UserID:         owner.ID,
+			Role:           models.OrganizationRoleOwner,
+		}).Error
+	})
+	return organization, err
+}
+
+func ListUserOrganizations(db *gorm.DB, userID uint) ([]OrganizationMembership, error) {
+	var members []models.OrganizationMember
+	if err := db.Where("user_id = ?", userID).Order("organization_id").Find(&members).Error; err != nil {
+		return nil, err
+	}
+	memberships := make([]OrganizationMembership, 0, len(members))
+	for _, member := range members {
+		var organization models.Organization
+		if err := db.First(&organization, member.OrganizationID).Error; err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, OrganizationMembership{Organization: organization, Role: member.Role})
+	}
+	return memberships, nil
+}
+
+// 查询用户在组织中的成员身份，ownerRequired 为 true 时要求是所有者
+func GetOrganizationMembership(db *gorm.DB, organizationID uint, userID uint, ownerRequired bool) (models.OrganizationMember, error) {
+	var member models.OrganizationMember
+	err := db.Where("organization_id = ? AND user_id = ?", organizationID, userID).First(&member).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return models.OrganizationMember{}, ErrNotOrganizationMember
+	}
+	if err != nil {
+		return models.OrganizationMember{}, err
+	}
+	if ownerRequired && member.Role != models.OrganizationRoleOwner {
+		return models.OrganizationMember{}, ErrOrganizationOwnerRequired
+	}
+	return member, nil
+}
+
+// 删除组织及其成员和 Token，已生成的地址保留在各成员名下。组织和成员直接删除，名称可以重新使用
+func DeleteOrganization(db *gorm.DB, organizationID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("organization_id = ?", organizationID).Delete(&models.OrganizationMember{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("organization_id = ?", organizationID).Delete(&models.Token{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&models.Organization{}, organizationID).Error
+	})
+}
+
+func ListOrganizationMembers(db *gorm.DB, organizationID uint) ([]OrganizationMemberInfo, error) {
+	var members []OrganizationMemberInfo
+	err := db.Model(&models.OrganizationMember{}).
+		Select("organization_members.user_id, users.username, organization_members.role, organization_members.created_at AS joined_at").
+		Joins("JOIN users ON users.id = organization_members.user_id AND users.deleted_at IS NULL").
+		Where("organization_members.organization_id = ?", organizationID).
+		Order("organization_members.id").
+		Scan(&members).Error
+	return members, err
+}
+
+func AddOrganizationMember(db *gorm.DB, organizationID uint, username string, role string) (models.OrganizationMember, error) {
+	if !validOrganizationRole(role) {
+		return models.OrganizationMember{}, ErrInvalidOrganizationRole
+	}
+	var user models.User
+	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+		return models.OrganizationMember{}, err
+	}
+
+	var count int64
+	if err := db.Model(&models.OrganizationMember{}).Where("organization_id = ? AND user_id = ?", organizationID, user.ID).Count(&count).Error; err != nil {
+		return models.OrganizationMember{}, err
+	}
+	if count > 0 {
+		return models.OrganizationMember{}, ErrAlreadyOrganizationMember
+	}
+
+	member := models.OrganizationMember{OrganizationID: organizationID, UserID: user.ID, Role: role}
+	err := db.Create(&member).Error
+	return member, err
+}
+
+// 修改成员角色，组织至少要保留一个所有者。返回修改前的成员记录
+func SetOrganizationMemberRole(db *gorm.DB, organizationID uint, userID uint, role string) (models.OrganizationMember, error) {
+	if !validOrganizationRole(role) {
+		return models.OrganizationMember{}, ErrInvalidOrganizationRole
+	}
+	var member models.OrganizationMember
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		member, err = GetOrganizationMembership(tx, organizationID, userID, false)
+		if err != nil {
+			return err
+		}
+		if member.Role == models.OrganizationRoleOwner && role != models.OrganizationRoleOwner {
+			if err := ensureOtherOrganizationOwner(tx, organizationID, userID); err != nil {
+				return err
+			}
+		}
+		return tx.Model(&models.OrganizationMember{}).Where("id = ?", member.ID).Update("role", role).Error
+	})
+	return member, err
+}
+
+// 移除成员，返回被移除的成员记录
+func RemoveOrganizationMember(db *gorm.DB, organizationID uint, userID uint) (models.OrganizationMember, error) {
+	var member models.OrganizationMember
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		member, err = GetOrganizationMembership(tx, organizationID, userID, false)
+		if err != nil {
+			return err
+		}
+		if member.Role == models.OrganizationRoleOwner {
+			if err := ensureOtherOrganizationOwner(tx, organizationID, userID); err != nil {
+				return err
+			}
+		}
+		return tx.Unscoped().Delete(&member).Error
+	})
+	return member, err
+}
+
+func ensureOtherOrganizationOwner(db *gorm.DB, organizationID uint, userID uint) error {
+	var count int64
+	if err := db.Model(&models.OrganizationMember{}).Where("organization_id = ? AND role = ? AND user_id <> ?", organizationID, models.OrganizationRoleOwner, userID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrLastOrganizationOwner
+	}
+	return nil
+}
+
+// 删除用户时移除其组织成员身份。组织没有其他所有者时，最早加入的成员成为所有者；没有成员时删除组织
+func removeUserFromOrganizations(tx *gorm.DB, userID uint) error {
+	var memberships []models.OrganizationMember
+	if err := tx.Where("user_id = ?", userID).Find(&memberships).Error; err != nil {
+		return err
+	}
+	for _, membership := range memberships {
+		if err := tx.Unscoped().Delete(&membership).Error; err != nil {
+			return err
+		}
+		if membership.Role != models.OrganizationRoleOwner {
+			continue
+		}
+
+		var owners int64
+		if err := tx.Model(&models.OrganizationMember{}).Where("organization_id = ? AND role = ?", membership.OrganizationID, models.OrganizationRoleOwner).Count(&owners).Error; err != nil {
+			return err
+		}
+		if owners > 0 {
+			continue
+		}
+		var next models.OrganizationMember
+		err := tx.Where("organization_id = ?", membership.OrganizationID).Order("id").First(&next).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			if err := DeleteOrganization(tx, membership.OrganizationID); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(&next).Update("role", models.OrganizationRoleOwner).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 未指定 Token 时使用组织的默认 Token
+func FindOrganizationToken(db *gorm.DB, organizationID uint, tokenID uint) (models.Token, error) {
+	var token models.Token
+	query := db.Where("organization_id = ?", organizationID)
+	if tokenID == 0 {
+		query = query.Where("is_default = ?", true)
+	} else {
+		query = query.Where("id = ?", tokenID)
+	}
+	err := query.First(&token).Error
+	return token, err
+}
+
+func ListOrganizationTokens(db *gorm.DB, organizationID uint) ([]models.Token, error) {
+	var tokens []models.Token
+	err := db.Where("organization_id = ?", organizationID).Find(&tokens).Error
+	return tokens, err
+}
+
+// 添加组织 Token，组织的第一个 Token 自动成为默认 Token
+func AddOrganizationToken(db *gorm.DB, organizationID uint, value string, description string) (models.Token, error) {
+	token := models.Token{
+		OrganizationID: organizationID,
+		Value:          models.EncryptedString(value),
+		Description:    description,
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&models.Token{}).Where("organization_id = ? AND is_default = ?", organizationID, true).Count(&count).Error; err != nil {
+			return err
+		}
+		token.IsDefault = count == 0
+		return tx.Create(&token).Error
+	})
+	return token, err
+}
+
+func SetDefaultOrganizationToken(db *gorm.DB, organizationID uint, tokenID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if _, err := FindOrganizationToken(tx, organizationID, tokenID); err != nil {
+			return err
+		}
+		if err := tx.Model(&models.Token{}).Where("organization_id = ? AND id <> ?", organizationID, tokenID).Update("is_default", false).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.Token{}).Where("id = ?", tokenID).Update("is_default", true).Error
+	})
+}
+
+// 删除组织 Token，删除的是默认 Token 时将最新的 Token 设为默认。返回被删除的 Token
+func DeleteOrganizationToken(db *gorm.DB, organizationID uint, tokenID uint) (models.Token, error) {
+	var token models.Token
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		token, err = FindOrganizationToken(tx, organizationID, tokenID)
+		if err != nil {
+			return err
+		}
+		if err := tx.Delete(&token).Error; err != nil {
+			return err
+		}
+		if !token.IsDefault {
+			return nil
+		}
+		var next models.Token
+		err = tx.Where("organization_id = ?", organizationID).Order("id DESC").First(&next).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Model(&next).Update("is_default", true).Error
+	})
+	return token, err
+}
+
+func ListOrganizationAddresses(db *gorm.DB, organizationID uint) ([]models.Address, error) {
+	var addresses []models.Address
+	err := db.Where("organization_id = ?", organizationID).Order("id DESC").Find(&addresses).Error
+	return addresses, err
+}
+
+// 记录成员使用组织 Token 的一次调用，按天累加
+func RecordOrganizationUsage(db *gorm.DB, token models.Token, userID uint, success bool) error {
+	usage := models.OrganizationUsage{
+		OrganizationID: token.OrganizationID,
+		UserID:         userID,
+		TokenID:        token.ID,
+		Day:            time.Now().UTC().Format(usageDayLayout),
+	}
+	if success {
+		usage.Generated = 1
+	} else {
+		usage.Failures = 1
+	}
+	return db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "user_id"}, {Name: "token_id"}, {Name: "day"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"generated": gorm.Expr("generated + ?", usage.Generated),
+			"failures":  gorm.Expr("failures + ?", usage.Failures),
+		}),
+	}).Create(&usage).Error
+}
+
+// 每个成员使用组织 Token 的统计，已离开组织的成员也会列出
+func GetOrganizationMemberUsage(db *gorm.DB, organizationID uint) ([]OrganizationMemberUsage, error) {
+	var usages []models.OrganizationUsage
+	if err := db.Where("organization_id = ?", organizationID).Find(&usages).Error; err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	today := now.Format(usageDayLayout)
+	monthStart := now.AddDate(0, 0, -(usageMonthDays - 1)).Format(usageDayLayout)
+
+	byUser := map[uint]*OrganizationMemberUsage{}
+	var order []uint
+	for _, usage := range usages {
+		stats, ok := byUser[usage.UserID]
+		if !ok {
+			stats = &OrganizationMemberUsage{UserID: usage.UserID}
+			byUser[usage.UserID] = stats
+			order = append(order, usage.UserID)
+		}
+		stats.GeneratedTotal += usage.Generated
+		stats.FailuresTotal += usage.Failures
+		if usage.Day >= monthStart {
+			stats.GeneratedMonth += usage.Generated
+		}
+		if usage.Day == today {
+			stats.GeneratedToday += usage.Generated
+		}
+	}
+
+	result := make([]OrganizationMemberUsage, 0, len(order))
+	for _, userID := range order {
+		stats := byUser[userID]
+		var user models.User
+		if err := db.Unscoped().Select("username").First(&user, userID).Error; err == nil {
+			stats.Username = user.Username
+		}
+		result = append(result, *stats)
+	}
+	return result, nil
+}
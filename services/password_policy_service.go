@@ -0,0 +1,162 @@
+package services
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+
+	"anonymail/models"
+
+	"gorm.io/gorm"
+)
+
+type PasswordPolicy struct {
+	MinLength int
+	// 至少包含几类字符：小写字母、大写字母、数字、其他符号
+	MinCharClasses int
+	// 不能与最近使用过的几个密码（含当前密码）相同，0 表示不限制
+	HistorySize int
+}
+
+// PasswordPolicyError 说明密码不符合策略的原因，可以直接返回给用户
+type PasswordPolicyError struct {
+	Reason string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return e.Reason
+}
+
+var passwordPolicy = PasswordPolicy{
+	MinLength:      8,
+	MinCharClasses: 1,
+	HistorySize:    3,
+}
+
+// 已泄露密码的 SHA-1（大写十六进制）
+var breachedPasswords map[string]bool
+
+func SetPasswordPolicy(policy PasswordPolicy) {
+	passwordPolicy = policy
+}
+
+func GetPasswordPolicy() PasswordPolicy {
+	return passwordPolicy
+}
+
+// 加载已泄露密码列表，每行一个明文密码或 SHA-1 值（兼容 Have I Been Pwned 的 HASH:次数 格式）
+func LoadBreachedPasswords(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	passwords := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		if hash := strings.SplitN(line, ":", 2)[0]; isSHA1Hex(hash) {
+			passwords[strings.ToUpper(hash)] = true
+			continue
+		}
+		passwords[passwordSHA1(line)] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	breachedPasswords = passwords
+	return len(passwords), nil
+}
+
+// 检查密码是否符合策略。user 为空（新用户或管理员设置的临时密码）时不检查历史密码
+func ValidatePassword(db *gorm.DB, user models.User, password string) error {
+	if len([]rune(password)) < passwordPolicy.MinLength {
+		return &PasswordPolicyError{fmt.Sprintf("Password must be at least %d characters long", passwordPolicy.MinLength)}
+	}
+	if passwordCharClasses(password) < passwordPolicy.MinCharClasses {
+		return &PasswordPolicyError{fmt.Sprintf("Password must contain at least %d of: lowercase letters, uppercase letters, digits, symbols", passwordPolicy.MinCharClasses)}
+	}
+	if user.Username != "" && strings.EqualFold(password, user.Username) {
+		return &PasswordPolicyError{"Password must not be the same as the username"}
+	}
+	if breachedPasswords[passwordSHA1(password)] {
+		return &PasswordPolicyError{"This password has appeared in a data breach, please choose another one"}
+	}
+
+	if user.ID == 0 || passwordPolicy.HistorySize <= 0 {
+		return nil
+	}
+	if user.PasswordHash != "" && CheckPassword(user.PasswordHash, password) {
+		return &PasswordPolicyError{"New password must be different from the current password"}
+	}
+	var history []models.PasswordHistory
+	if err := db.Where("user_id = ?", user.ID).Order("id desc").Limit(passwordPolicy.HistorySize - 1).Find(&history).Error; err != nil {
+		return err
+	}
+	for _, previous := range history {
+		if CheckPassword(previous.PasswordHash, password) {
+			return &PasswordPolicyError{fmt.Sprintf("Password must not match any of your last %d passwords", passwordPolicy.HistorySize)}
+		}
+	}
+	return nil
+}
+
+// 修改密码前保存旧密码的哈希，只保留策略需要的数量
+func RecordPasswordHistory(tx *gorm.DB, userID uint, oldHash string) error {
+	if oldHash == "" || passwordPolicy.HistorySize <= 1 {
+		return nil
+	}
+	if err := tx.Create(&models.PasswordHistory{UserID: userID, PasswordHash: oldHash}).Error; err != nil {
+		return err
+	}
+
+	var keep []uint
+	if err := tx.Model(&models.PasswordHistory{}).Where("user_id = ?", userID).Order("id desc").Limit(passwordPolicy.HistorySize-1).Pluck("id", &keep).Error; err != nil {
+		return err
+	}
+	return tx.Unscoped().Where("user_id = ? AND id NOT IN ?", userID, keep).Delete(&models.PasswordHistory{}).Error
+}
+
+func passwordCharClasses(password string) int {
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	classes := 0
+	for _, present := range []bool{lower, upper, digit, other} {
+		if present {
+			classes++
+		}
+	}
+	return classes
+}
+
+func passwordSHA1(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func isSHA1Hex(value string) bool {
+	if len(value) != 2*sha1.Size {
+		return false
+	}
+	_, err := hex.DecodeString(value)
+	return err == nil
+}
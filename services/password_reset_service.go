@@ -0,0 +1,121 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"anonymail/models"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidResetToken = errors.New("password reset link is invalid or has expired")
+	ErrExternalAccount   = errors.New("password is managed by an identity provider")
+)
+
+// 重置链接的有效期
+var passwordResetTTL = 24 * time.Hour
+
+func SetPasswordResetTTL(ttl time.Duration) {
+	passwordResetTTL = ttl
+}
+
+// 为用户生成一次性重置密码链接的凭证，之前未使用的链接随之失效
+func CreatePasswordResetToken(db *gorm.DB, user models.User, createdByID uint) (string, models.PasswordResetToken, error) {
+	if user.AuthProvider != models.AuthProviderLocal {
+		return "", models.PasswordResetToken{}, ErrExternalAccount
+	}
+	token, err := GenerateRandomToken()
+	if err != nil {
+		return "", models.PasswordResetToken{}, err
+	}
+
+	record := models.PasswordResetToken{
+		UserID:      user.ID,
+		CreatedByID: createdByID,
+		TokenHash:   hashChallengeToken(token),
+		ExpiresAt:   time.Now().Add(passwordResetTTL),
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("user_id = ? AND used_at IS NULL", user.ID).Delete(&models.PasswordResetToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&record).Error
+	})
+	if err != nil {
+		return "", models.PasswordResetToken{}, err
+	}
+	return token, record, nil
+}
+
+// 使用重置链接设置新密码，成功后所有已登录的会话失效
+func RedeemPasswordResetToken(db *gorm.DB, token string, newPassword string, ip string, userAgent string) (models.User, error) {
+	var record models.PasswordResetToken
+	err := db.Where("token_hash = ? AND used_at IS NULL", hashChallengeToken(token)).First(&record).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return models.User{}, ErrInvalidResetToken
+	}
+	if err != nil {
+		return models.User{}, err
+	}
+	if time.Now().After(record.ExpiresAt) {
+		return models.User{}, ErrInvalidResetToken
+	}
+
+	var user models.User
+	if err := db.First(&user, record.UserID).Error; err != nil {
+		return models.User{}, err
+	}
+	if user.AuthProvider != models.AuthProviderLocal {
+		return models.User{}, ErrExternalAccount
+	}
+	if err := ValidatePassword(db, user, newPassword); err != nil {
+		return models.User{}, err
+	}
+	hashedPassword, err := HashPassword(newPassword)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// 在同一条 UPDATE 中检查是否已使用，同一链接并发提交时只有一次成功
+		now := time.Now()
+		result := tx.Model(&models.PasswordResetToken{}).
+			Where("id = ? AND used_at IS NULL", record.ID).
+			Updates(map[string]interface{}{"used_at": now, "used_ip": ip, "used_user_agent": userAgent})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvalidResetToken
+		}
+
+		if err := RecordPasswordHistory(tx, user.ID, user.PasswordHash); err != nil {
+			return err
+		}
+		if err := tx.Model(&user).Updates(map[string]interface{}{
+			"password_hash":        hashedPassword,
+			"needs_password_reset": false,
+		}).Error; err != nil {
+			return err
+		}
+		return RevokeUserSessions(tx, user.ID, 0)
+	})
+	if err != nil {
+		return models.User{}, err
+	}
+
+	// 设置了新密码的账户不应继续被之前的失败登录锁定
+	if err := ResetLoginFailures(db, user.Username); err != nil {
+		log.Printf("Failed to reset login failures for user %s: %v", user.Username, err)
+	}
+	return user, nil
+}
+
+func ListPasswordResetTokens(db *gorm.DB, userID uint) ([]models.PasswordResetToken, error) {
+	var tokens []models.PasswordResetToken
+	err := db.Where("user_id = ?", userID).Order("created_at desc").Find(&tokens).Error
+	return tokens, err
+}
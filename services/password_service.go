@@ -0,0 +1,127 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 新密码使用的哈希算法
+const (
+	PasswordHashArgon2id = "argon2id"
+	PasswordHashBcrypt   = "bcrypt"
+)
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+var ErrInvalidPasswordHash = errors.New("invalid password hash")
+
+type Argon2Params struct {
+	// 内存用量，单位 KiB
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+var (
+	passwordHashAlgorithm = PasswordHashArgon2id
+	argon2Params          = Argon2Params{Memory: 64 * 1024, Iterations: 3, Parallelism: 2}
+)
+
+func SetPasswordHashing(algorithm string, params Argon2Params) error {
+	if algorithm != PasswordHashArgon2id && algorithm != PasswordHashBcrypt {
+		return fmt.Errorf("unknown password hash algorithm %q", algorithm)
+	}
+	if params.Memory == 0 || params.Iterations == 0 || params.Parallelism == 0 {
+		return errors.New("argon2 parameters must be positive")
+	}
+	passwordHashAlgorithm = algorithm
+	argon2Params = params
+	return nil
+}
+
+func GetArgon2Params() Argon2Params {
+	return argon2Params
+}
+
+// 使用当前配置的算法计算密码哈希
+func HashPassword(password string) (string, error) {
+	if passwordHashAlgorithm == PasswordHashBcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(hash), err
+	}
+
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	p := argon2Params
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, argon2KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// 校验密码，同时支持旧的 bcrypt 哈希。needsRehash 表示哈希的算法或参数与当前配置不同，应在登录成功后重新计算
+func VerifyPassword(hash string, password string) (match bool, needsRehash bool) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		params, salt, key, err := parseArgon2Hash(hash)
+		if err != nil {
+			return false, false
+		}
+		computed := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+		if subtle.ConstantTimeCompare(computed, key) != 1 {
+			return false, false
+		}
+		return true, passwordHashAlgorithm != PasswordHashArgon2id || params != argon2Params
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false, false
+	}
+	return true, passwordHashAlgorithm != PasswordHashBcrypt
+}
+
+// 只判断是否匹配，用于检查历史密码等不需要升级哈希的场景
+func CheckPassword(hash string, password string) bool {
+	match, _ := VerifyPassword(hash, password)
+	return match
+}
+
+// 解析 $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key> 格式
+func parseArgon2Hash(hash string) (Argon2Params, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return Argon2Params{}, nil, nil, ErrInvalidPasswordHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return Argon2Params{}, nil, nil, ErrInvalidPasswordHash
+	}
+	var params Argon2Params
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return Argon2Params{}, nil, nil, ErrInvalidPasswordHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Argon2Params{}, nil, nil, ErrInvalidPasswordHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return Argon2Params{}, nil, nil, ErrInvalidPasswordHash
+	}
+	return params, salt, key, nil
+}
@@ -0,0 +1,109 @@
+package services
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"anonymail/models"
+
+	"gorm.io/gorm"
+)
+
+type ProxyAuthConfig struct {
+	TrustedProxies []string
+	UserHeader     string
+	GroupsHeader   string
+	AdminGroup     string
+}
+
+var (
+	proxyAuthConfig   ProxyAuthConfig
+	proxyAuthNetworks []*net.IPNet
+)
+
+// 未配置可信代理时不启用
+func SetProxyAuthConfig(config ProxyAuthConfig) error {
+	if config.UserHeader == "" {
+		config.UserHeader = "Remote-User"
+	}
+	if config.GroupsHeader == "" {
+		config.GroupsHeader = "Remote-Groups"
+	}
+
+	networks := make([]*net.IPNet, 0, len(config.TrustedProxies))
+	for _, value := range config.TrustedProxies {
+		network := parseIPOrCIDR(value)
+		if network == nil {
+			return fmt.Errorf("invalid proxy address %q", value)
+		}
+		networks = append(networks, network)
+	}
+
+	proxyAuthConfig = config
+	proxyAuthNetworks = networks
+	return nil
+}
+
+func ProxyAuthEnabled() bool {
+	return len(proxyAuthNetworks) > 0
+}
+
+// 返回可信代理转发的用户名和用户组。只看直接连接的对端地址，不使用 X-Forwarded-For，
+// 否则任何人都可以伪造来源绕过检查
+func ProxyIdentity(r *http.Request) (string, []string, bool) {
+	if !ProxyAuthEnabled() {
+		return "", nil, false
+	}
+	username := strings.TrimSpace(r.Header.Get(proxyAuthConfig.UserHeader))
+	if username == "" || !fromTrustedProxy(r.RemoteAddr) {
+		return "", nil, false
+	}
+
+	var groups []string
+	for _, group := range strings.Split(r.Header.Get(proxyAuthConfig.GroupsHeader), ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			groups = append(groups, group)
+		}
+	}
+	return username, groups, true
+}
+
+// 查找或创建代理认证的用户，并按管理员组更新管理员状态
+func ProxyAuthLogin(db *gorm.DB, username string, groups []string) (models.User, error) {
+	var isAdmin *bool
+	if proxyAuthConfig.AdminGroup != "" {
+		admin := false
+		for _, group := range groups {
+			if group == proxyAuthConfig.AdminGroup {
+				admin = true
+				break
+			}
+		}
+		isAdmin = &admin
+	}
+	return ProvisionExternalUser(db, models.AuthProviderProxy, username, username, isAdmin)
+}
+
+// 会话必须属于代理当前转发的用户，代理那边换了用户后旧会话不能继续使用
+func ProxyIdentityMatches(user models.User, username string) bool {
+	return user.AuthProvider == models.AuthProviderProxy && user.ExternalID == username
+}
+
+func fromTrustedProxy(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range proxyAuthNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,267 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"anonymail/models"
+
+	"gorm.io/gorm"
+)
+
+// 配额名称
+const (
+	QuotaMaxAddresses    = "max_addresses"
+	QuotaAddressesPerDay = "addresses_per_day"
+	QuotaMaxTokens       = "max_tokens"
+)
+
+var ErrInvalidQuota = errors.New("quota must not be negative")
+
+// QuotaExceededError 说明超出了哪一项配额，可以直接返回给用户
+type QuotaExceededError struct {
+	Quota string
+	Limit int
+}
+
+func (e *QuotaExceededError) Error() string {
+	switch e.Quota {
+	case QuotaAddressesPerDay:
+		return fmt.Sprintf("Daily alias quota reached (limit %d per day)", e.Limit)
+	case QuotaMaxTokens:
+		return fmt.Sprintf("Token quota reached (limit %d)", e.Limit)
+	default:
+		return fmt.Sprintf("Alias quota reached (limit %d)", e.Limit)
+	}
+}
+
+// 用户的配额，0 表示不限制
+type Quotas struct {
+	MaxAddresses    int
+	AddressesPerDay int
+	MaxTokens       int
+}
+
+// 配额和当前用量，Custom 表示用户有单独设置的配额
+type QuotaUsage struct {
+	Quotas
+	Custom         bool
+	Addresses      int64
+	AddressesToday int64
+	Tokens         int64
+}
+
+func DefaultQuotas(db *gorm.DB) (Quotas, error) {
+	var quotas Quotas
+	var err error
+	if quotas.MaxAddresses, err = GetIntSetting(db, SettingQuotaMaxAddresses); err != nil {
+		return Quotas{}, err
+	}
+	if quotas.AddressesPerDay, err = GetIntSetting(db, SettingQuotaAddressesPerDay); err != nil {
+		return Quotas{}, err
+	}
+	if quotas.MaxTokens, err = GetIntSetting(db, SettingQuotaMaxTokens); err != nil {
+		return Quotas{}, err
+	}
+	return quotas, nil
+}
+
+// 用户单独设置的配额优先，未设置的项使用全局默认值
+func UserQuotas(db *gorm.DB, user models.User) (Quotas, error) {
+	quotas, err := DefaultQuotas(db)
+	if err != nil {
+		return Quotas{}, err
+	}
+	if user.QuotaMaxAddresses != nil {
+		quotas.MaxAddresses = *user.QuotaMaxAddresses
+	}
+	if user.QuotaAddressesPerDay != nil {
+		quotas.AddressesPerDay = *user.QuotaAddressesPerDay
+	}
+	if user.QuotaMaxTokens != nil {
+		quotas.MaxTokens = *user.QuotaMaxTokens
+	}
+	return quotas, nil
+}
+
+func GetQuotaUsage(db *gorm.DB, user models.User) (QuotaUsage, error) {
+	quotas, err := UserQuotas(db, user)
+	if err != nil {
+		return QuotaUsage{}, err
+	}
+	usage := QuotaUsage{
+		Quotas: quotas,
+		Custom: user.QuotaMaxAddresses != nil || user.QuotaAddressesPerDay != nil || user.QuotaMaxTokens != nil,
+	}
+	if usage.Addresses, err = countUserAddresses(db, user.ID); err != nil {
+		return QuotaUsage{}, err
+	}
+	if usage.AddressesToday, err = countUserAddressesToday(db, user.ID); err != nil {
+		return QuotaUsage{}, err
+	}
+	if usage.Tokens, err = countUserTokens(db, user.ID); err != nil {
+		return QuotaUsage{}, err
+	}
+	return usage, nil
+}
+
+// 正在向 DuckDuckGo 请求的地址，检查配额时和已保存的地址一起计入。
+// 检查、预留和保存都在同一个锁内完成，并发请求不会同时通过最后一个名额的检查
+var addressReservations = struct {
+	sync.Mutex
+	pending map[uint]int64
+}{pending: map[uint]int64{}}
+
+// 预留的地址名额，生成成功时用 commit 保存地址，失败时用 release 归还
+type addressReservation struct {
+	userID uint
+	done   bool
+}
+
+// 生成地址前检查地址总数和当天生成的数量，并预留一个名额。
+// 组织 Token 生成的地址不计入个人配额，返回的预留不占用名额
+func reserveAddressQuota(db *gorm.DB, userID uint, organizationID uint) (*addressReservation, error) {
+	if organizationID != 0 {
+		return &addressReservation{userID: userID, done: true}, nil
+	}
+	addressReservations.Lock()
+	defer addressReservations.Unlock()
+	if err := checkAddressQuota(db, userID, addressReservations.pending[userID]); err != nil {
+		return nil, err
+	}
+	addressReservations.pending[userID]++
+	return &addressReservation{userID: userID}, nil
+}
+
+// 保存生成的地址并释放名额，保存和释放之间不能插入其他请求的检查
+func (r *addressReservation) commit(save func() error) error {
+	addressReservations.Lock()
+	defer addressReservations.Unlock()
+	r.finish()
+	return save()
+}
+
+func (r *addressReservation) release() {
+	addressReservations.Lock()
+	defer addressReservations.Unlock()
+	r.finish()
+}
+
+func (r *addressReservation) finish() {
+	if r.done {
+		return
+	}
+	r.done = true
+	addressReservations.pending[r.userID]--
+	if addressReservations.pending[r.userID] <= 0 {
+		delete(addressReservations.pending, r.userID)
+	}
+}
+
+func checkAddressQuota(db *gorm.DB, userID uint, pending int64) error {
+	quotas, err := loadUserQuotas(db, userID)
+	if err != nil {
+		return err
+	}
+	if quotas.MaxAddresses > 0 {
+		count, err := countUserAddresses(db, userID)
+		if err != nil {
+			return err
+		}
+		if count+pending >= int64(quotas.MaxAddresses) {
+			return &QuotaExceededError{Quota: QuotaMaxAddresses, Limit: quotas.MaxAddresses}
+		}
+	}
+	if quotas.AddressesPerDay > 0 {
+		count, err := countUserAddressesToday(db, userID)
+		if err != nil {
+			return err
+		}
+		if count+pending >= int64(quotas.AddressesPerDay) {
+			return &QuotaExceededError{Quota: QuotaAddressesPerDay, Limit: quotas.AddressesPerDay}
+		}
+	}
+	return nil
+}
+
+// 添加 Token 时的检查和保存在同一个锁内完成，与地址的预留一样，并发请求不会同时通过最后一个名额的检查
+var tokenQuotaLock sync.Mutex
+
+// 检查个人 Token 数量后保存 Token，组织的 Token 不计入
+func CreateTokenWithinQuota(db *gorm.DB, token *models.Token) error {
+	tokenQuotaLock.Lock()
+	defer tokenQuotaLock.Unlock()
+	if err := checkTokenQuota(db, token.UserID); err != nil {
+		return err
+	}
+	return db.Create(token).Error
+}
+
+func checkTokenQuota(db *gorm.DB, userID uint) error {
+	quotas, err := loadUserQuotas(db, userID)
+	if err != nil {
+		return err
+	}
+	if quotas.MaxTokens <= 0 {
+		return nil
+	}
+	count, err := countUserTokens(db, userID)
+	if err != nil {
+		return err
+	}
+	if count >= int64(quotas.MaxTokens) {
+		return &QuotaExceededError{Quota: QuotaMaxTokens, Limit: quotas.MaxTokens}
+	}
+	return nil
+}
+
+// 设置用户的配额，为 nil 的项恢复为全局默认值
+func SetUserQuotas(db *gorm.DB, userID uint, maxAddresses, addressesPerDay, maxTokens *int) (models.User, error) {
+	for _, value := range []*int{maxAddresses, addressesPerDay, maxTokens} {
+		if value != nil && *value < 0 {
+			return models.User{}, ErrInvalidQuota
+		}
+	}
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		return models.User{}, err
+	}
+	user.QuotaMaxAddresses = maxAddresses
+	user.QuotaAddressesPerDay = addressesPerDay
+	user.QuotaMaxTokens = maxTokens
+	err := db.Model(&user).Select("quota_max_addresses", "quota_addresses_per_day", "quota_max_tokens").Updates(&user).Error
+	return user, err
+}
+
+func loadUserQuotas(db *gorm.DB, userID uint) (Quotas, error) {
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		return Quotas{}, err
+	}
+	return UserQuotas(db, user)
+}
+
+// 地址配额和 Token 配额一样只计算个人的部分：使用组织 Token 生成的地址由组织承担，
+// 所有者可以在组织的用量统计中查看
+func countUserAddresses(db *gorm.DB, userID uint) (int64, error) {
+	var count int64
+	err := db.Model(&models.Address{}).Where("user_id = ? AND organization_id = 0", userID).Count(&count).Error
+	return count, err
+}
+
+// 当天（UTC）生成的地址，已删除的地址也计入，避免删除后重新生成绕过限制
+func countUserAddressesToday(db *gorm.DB, userID uint) (int64, error) {
+	now := time.Now().UTC()
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).Local()
+	var count int64
+	err := db.Unscoped().Model(&models.Address{}).Where("user_id = ? AND organization_id = 0 AND created_at >= ?", userID, dayStart).Count(&count).Error
+	return count, err
+}
+
+func countUserTokens(db *gorm.DB, userID uint) (int64, error) {
+	var count int64
+	err := db.Model(&models.Token{}).Where("user_id = ? AND organization_id = 0", userID).Count(&count).Error
+	return count, err
+}
@@ -0,0 +1,113 @@
+package services
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"anonymail/models"
+)
+
+func TestReserveAddressQuota(t *testing.T) {
+	db := openTestDB(t)
+	limit := 2
+	user := models.User{Username: "alice", QuotaMaxAddresses: &limit}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// 两个请求还在等待 DuckDuckGo 时，第三个请求不能通过检查
+	first, err := reserveAddressQuota(db, user.ID, 0)
+	if err != nil {
+		t.Fatalf("first reservation: %v", err)
+	}
+	second, err := reserveAddressQuota(db, user.ID, 0)
+	if err != nil {
+		t.Fatalf("second reservation: %v", err)
+	}
+	var quotaErr *QuotaExceededError
+	if _, err := reserveAddressQuota(db, user.ID, 0); !errors.As(err, &quotaErr) {
+		t.Fatalf("got error %v, want quota exceeded", err)
+	}
+
+	// 请求失败归还名额，成功保存的地址继续占用名额
+	first.release()
+	err = second.commit(func() error {
+		return db.Create(&models.Address{UserID: user.ID, GeneratedAddress: "one@duck.com"}).Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.release()
+
+	third, err := reserveAddressQuota(db, user.ID, 0)
+	if err != nil {
+		t.Fatalf("reservation after release: %v", err)
+	}
+	defer third.release()
+	if _, err := reserveAddressQuota(db, user.ID, 0); !errors.As(err, &quotaErr) {
+		t.Fatalf("got error %v, want quota exceeded", err)
+	}
+}
+
+func TestOrganizationAddressesDoNotUseQuota(t *testing.T) {
+	db := openTestDB(t)
+	limit := 1
+	user := models.User{Username: "alice", QuotaMaxAddresses: &limit}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&models.Address{UserID: user.ID, GeneratedAddress: "org@duck.com", OrganizationID: 1}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// 组织地址不占用名额，个人地址仍然可以生成
+	reservation, err := reserveAddressQuota(db, user.ID, 0)
+	if err != nil {
+		t.Fatalf("personal reservation: %v", err)
+	}
+	defer reservation.release()
+	if _, err := reserveAddressQuota(db, user.ID, 1); err != nil {
+		t.Fatalf("organization reservation: %v", err)
+	}
+}
+
+func TestCreateTokenWithinQuota(t *testing.T) {
+	db := openTestDB(t)
+	startWithMasterKey(t, db, randomMasterKey(t))
+	limit := 2
+	user := models.User{Username: "alice", QuotaMaxTokens: &limit}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// 并发添加时只有配额内的请求成功
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = CreateTokenWithinQuota(db, &models.Token{UserID: user.ID, Value: "value"})
+		}(i)
+	}
+	wg.Wait()
+
+	created := 0
+	for _, err := range errs {
+		var quotaErr *QuotaExceededError
+		switch {
+		case err == nil:
+			created++
+		case !errors.As(err, &quotaErr):
+			t.Fatalf("got error %v, want quota exceeded", err)
+		}
+	}
+	count, err := countUserTokens(db, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created != limit || count != int64(limit) {
+		t.Fatalf("created %d tokens, stored %d, want %d", created, count, limit)
+	}
+}
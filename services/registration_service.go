@@ -0,0 +1,178 @@
+package services
+
+import (
+	"errors"
+	"time"
+
+	"anonymail/models"
+
+	"gorm.io/gorm"
+)
+
+// 注册模式
+const (
+	RegistrationOpen     = "open"
+	RegistrationInvite   = "invite"
+	RegistrationApproval = "approval"
+	RegistrationClosed   = "closed"
+)
+
+const invitePrefixLength = 6
+
+var (
+	ErrRegistrationClosed      = errors.New("registration is closed")
+	ErrInviteRequired          = errors.New("an invite code is required to register")
+	ErrInvalidInviteCode       = errors.New("invalid or expired invite code")
+	ErrInvalidRegistrationMode = errors.New("invalid registration mode")
+)
+
+func ValidRegistrationMode(mode string) bool {
+	switch mode {
+	case RegistrationOpen, RegistrationInvite, RegistrationApproval, RegistrationClosed:
+		return true
+	}
+	return false
+}
+
+func GetRegistrationMode(db *gorm.DB) (string, error) {
+	mode, err := GetSetting(db, SettingRegistrationMode)
+	if err != nil {
+		return "", err
+	}
+	if !ValidRegistrationMode(mode) {
+		return "", ErrInvalidRegistrationMode
+	}
+	return mode, nil
+}
+
+// 按当前注册模式创建用户。需要审批时创建的用户处于停用状态，有效的邀请码可以跳过审批
+func RegisterUser(db *gorm.DB, username string, passwordHash string, inviteCode string) (models.User, error) {
+	mode, err := GetRegistrationMode(db)
+	if err != nil {
+		return models.User{}, err
+	}
+	switch {
+	case mode == RegistrationClosed:
+		return models.User{}, ErrRegistrationClosed
+	case mode == RegistrationInvite && inviteCode == "":
+		return models.User{}, ErrInviteRequired
+	}
+
+	user := models.User{
+		Username:     username,
+		PasswordHash: passwordHash,
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if inviteCode != "" {
+			invite, err := redeemInviteCode(tx, inviteCode)
+			if err != nil {
+				return err
+			}
+			user.InviteCodeID = &invite.ID
+		} else if mode == RegistrationApproval {
+			user.Disabled = true
+			user.DisabledReason = models.DisabledPendingApproval
+		}
+		return tx.Create(&user).Error
+	})
+	if err != nil {
+		return models.User{}, err
+	}
+	return user, nil
+}
+
+// 生成邀请码，返回只显示一次的明文。maxUses 为 0 表示不限次数
+func CreateInviteCode(db *gorm.DB, createdByID uint, note string, maxUses int, expiresAt *time.Time) (string, models.InviteCode, error) {
+	code, err := GenerateRandomPassword()
+	if err != nil {
+		return "", models.InviteCode{}, err
+	}
+	invite := models.InviteCode{
+		CreatedByID: createdByID,
+		Note:        note,
+		Prefix:      code[:invitePrefixLength],
+		CodeHash:    hashChallengeToken(code),
+		MaxUses:     maxUses,
+		ExpiresAt:   expiresAt,
+	}
+	if err := db.Create(&invite).Error; err != nil {
+		return "", models.InviteCode{}, err
+	}
+	return code, invite, nil
+}
+
+func ListInviteCodes(db *gorm.DB) ([]models.InviteCode, error) {
+	var invites []models.InviteCode
+	err := db.Order("created_at desc").Find(&invites).Error
+	return invites, err
+}
+
+func DeleteInviteCode(db *gorm.DB, inviteID uint) error {
+	result := db.Delete(&models.InviteCode{}, inviteID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func ListPendingUsers(db *gorm.DB) ([]models.User, error) {
+	var users []models.User
+	err := db.Where("disabled = ? AND disabled_reason = ?", true, models.DisabledPendingApproval).Order("created_at").Find(&users).Error
+	return users, err
+}
+
+func ApproveUser(db *gorm.DB, userID uint) error {
+	result := db.Model(&models.User{}).
+		Where("id = ? AND disabled = ? AND disabled_reason = ?", userID, true, models.DisabledPendingApproval).
+		Updates(map[string]interface{}{"disabled": false, "disabled_reason": ""})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// 拒绝的注册直接删除，用户名可以重新使用
+func RejectUser(db *gorm.DB, userID uint) error {
+	result := db.Unscoped().
+		Where("id = ? AND disabled = ? AND disabled_reason = ?", userID, true, models.DisabledPendingApproval).
+		Delete(&models.User{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// 使用次数在同一条 UPDATE 中检查并增加，避免并发注册超出次数限制
+func redeemInviteCode(tx *gorm.DB, code string) (models.InviteCode, error) {
+	var invite models.InviteCode
+	err := tx.Where("code_hash = ?", hashChallengeToken(code)).First(&invite).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return models.InviteCode{}, ErrInvalidInviteCode
+	}
+	if err != nil {
+		return models.InviteCode{}, err
+	}
+	if invite.ExpiresAt != nil && time.Now().After(*invite.ExpiresAt) {
+		return models.InviteCode{}, ErrInvalidInviteCode
+	}
+
+	result := tx.Model(&models.InviteCode{}).
+		Where("id = ? AND (max_uses = 0 OR uses < max_uses)", invite.ID).
+		UpdateColumn("uses", gorm.Expr("uses + 1"))
+	if result.Error != nil {
+		return models.InviteCode{}, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return models.InviteCode{}, ErrInvalidInviteCode
+	}
+	return invite, nil
+}
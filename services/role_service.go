@@ -0,0 +1,138 @@
+package services
+
+import (
+	"errors"
+
+	"anonymail/models"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidRole = errors.New("invalid role")
+	ErrLastAdmin   = errors.New("cannot remove the last administrator")
+)
+
+// 各角色拥有的权限，完整管理员不在此列，拥有全部权限
+var rolePermissions = map[string][]string{
+	models.RoleUserManager: {
+		models.PermissionUsersRead,
+		models.PermissionUsersManage,
+	},
+	models.RoleAuditor: {
+		models.PermissionUsersRead,
+		models.PermissionSettingsRead,
+		models.PermissionAuditRead,
+	},
+	models.RoleTokenManager: {
+		models.PermissionUsersRead,
+		models.PermissionTokensManage,
+	},
+	models.RoleSupport: {
+		models.PermissionUsersRead,
+	},
+}
+
+var allPermissions = []string{
+	models.PermissionUsersRead,
+	models.PermissionUsersManage,
+	models.PermissionUsersDelete,
+	models.PermissionRolesManage,
+	models.PermissionSettingsRead,
+	models.PermissionSettingsManage,
+	models.PermissionTokensManage,
+	models.PermissionAuditRead,
+}
+
+// 角色及其权限，用于管理界面展示
+func RolePermissions() map[string][]string {
+	roles := map[string][]string{models.RoleAdmin: allPermissions}
+	for role, permissions := range rolePermissions {
+		roles[role] = permissions
+	}
+	return roles
+}
+
+func ValidRole(role string) bool {
+	if role == models.RoleNone || role == models.RoleAdmin {
+		return true
+	}
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// 用户的有效角色，完整管理员返回 admin
+func UserRole(user models.User) string {
+	if user.IsAdmin {
+		return models.RoleAdmin
+	}
+	if _, ok := rolePermissions[user.Role]; ok {
+		return user.Role
+	}
+	return models.RoleNone
+}
+
+func UserPermissions(user models.User) []string {
+	if user.IsAdmin {
+		return allPermissions
+	}
+	return rolePermissions[user.Role]
+}
+
+func HasPermission(user models.User, permission string) bool {
+	for _, granted := range UserPermissions(user) {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// 是否拥有任何管理权限，可以访问管理界面
+func IsStaff(user models.User) bool {
+	return len(UserPermissions(user)) > 0
+}
+
+// 只有完整管理员可以操作拥有管理角色的账户，避免用户管理员借此提升自己的权限
+func CanManageUser(actor models.User, target models.User) bool {
+	return actor.IsAdmin || !IsStaff(target)
+}
+
+// 修改用户角色，不能把最后一个可用的完整管理员降级
+func SetUserRole(db *gorm.DB, userID uint, role string) (models.User, error) {
+	if !ValidRole(role) {
+		return models.User{}, ErrInvalidRole
+	}
+
+	var user models.User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&user, userID).Error; err != nil {
+			return err
+		}
+		isAdmin := role == models.RoleAdmin
+		if user.IsAdmin && !isAdmin {
+			if err := EnsureOtherAdminExists(tx, user.ID); err != nil {
+				return err
+			}
+		}
+		user.IsAdmin = isAdmin
+		user.Role = role
+		if isAdmin {
+			user.Role = models.RoleNone
+		}
+		return tx.Model(&user).Updates(map[string]interface{}{"is_admin": user.IsAdmin, "role": user.Role}).Error
+	})
+	return user, err
+}
+
+// 在删除或降级管理员之前确认还有其他可用的完整管理员
+func EnsureOtherAdminExists(db *gorm.DB, userID uint) error {
+	var count int64
+	if err := db.Model(&models.User{}).Where("is_admin = ? AND disabled = ? AND id <> ?", true, false, userID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrLastAdmin
+	}
+	return nil
+}
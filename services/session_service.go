@@ -0,0 +1,170 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"anonymail/models"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrSessionExpired  = errors.New("session expired")
+	ErrAccountDisabled = errors.New("account is disabled")
+)
+
+// 会话有效期，每次访问都会顺延
+var sessionTTL = 7 * 24 * time.Hour
+
+// 避免每个请求都写数据库，最后访问时间只在间隔超过该值时更新
+const sessionTouchInterval = time.Minute
+
+// 数据库中只保存会话 token 的 HMAC，数据库泄露也无法直接使用其中的会话
+var sessionHashKey []byte
+
+func SetSessionTTL(ttl time.Duration) {
+	sessionTTL = ttl
+}
+
+func SetSessionHashKey(key []byte) {
+	sessionHashKey = key
+}
+
+func hashSessionToken(token string) string {
+	mac := hmac.New(sha256.New, sessionHashKey)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func GenerateRandomToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+// 生成初始密码等需要人工输入的随机密码
+func GenerateRandomPassword() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// 创建新会话并返回会话 token，同时记录登录时间并清理该用户已过期的会话
+func CreateSession(db *gorm.DB, userID uint, userAgent string, ip string) (string, models.Session, error) {
+	token, err := GenerateRandomToken()
+	if err != nil {
+		return "", models.Session{}, err
+	}
+
+	now := time.Now()
+	session := models.Session{
+		UserID:     userID,
+		TokenHash:  hashSessionToken(token),
+		UserAgent:  userAgent,
+		IP:         ip,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(sessionTTL),
+	}
+	if err := db.Create(&session).Error; err != nil {
+		return "", models.Session{}, err
+	}
+
+	if err := db.Unscoped().Where("user_id = ? AND expires_at < ?", userID, now).Delete(&models.Session{}).Error; err != nil {
+		return "", models.Session{}, err
+	}
+	if err := db.Model(&models.User{}).Where("id = ?", userID).UpdateColumn("last_login_at", now).Error; err != nil {
+		return "", models.Session{}, err
+	}
+	return token, session, nil
+}
+
+// 校验会话 token，返回会话和对应的用户，并顺延会话有效期
+func ValidateSession(db *gorm.DB, token string, ip string) (models.Session, models.User, error) {
+	tokenHash := hashSessionToken(token)
+	var session models.Session
+	if err := db.Where("token_hash = ?", tokenHash).First(&session).Error; err != nil {
+		return models.Session{}, models.User{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(session.TokenHash), []byte(tokenHash)) != 1 {
+		return models.Session{}, models.User{}, gorm.ErrRecordNotFound
+	}
+
+	now := time.Now()
+	if now.After(session.ExpiresAt) {
+		db.Unscoped().Delete(&session)
+		return models.Session{}, models.User{}, ErrSessionExpired
+	}
+
+	var user models.User
+	if err := db.First(&user, session.UserID).Error; err != nil {
+		return models.Session{}, models.User{}, err
+	}
+	if user.Disabled {
+		return models.Session{}, models.User{}, ErrAccountDisabled
+	}
+
+	if now.Sub(session.LastSeenAt) > sessionTouchInterval {
+		session.LastSeenAt = now
+		session.ExpiresAt = now.Add(sessionTTL)
+		session.IP = ip
+		if err := db.Model(&session).UpdateColumns(map[string]interface{}{
+			"last_seen_at": session.LastSeenAt,
+			"expires_at":   session.ExpiresAt,
+			"ip":           session.IP,
+		}).Error; err != nil {
+			return models.Session{}, models.User{}, err
+		}
+	}
+	return session, user, nil
+}
+
+func ListSessions(db *gorm.DB, userID uint) ([]models.Session, error) {
+	var sessions []models.Session
+	err := db.Where("user_id = ? AND expires_at > ?", userID, time.Now()).Order("last_seen_at DESC").Find(&sessions).Error
+	return sessions, err
+}
+
+func RevokeSession(db *gorm.DB, userID uint, sessionID uint) error {
+	result := db.Unscoped().Where("id = ? AND user_id = ?", sessionID, userID).Delete(&models.Session{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// 撤销用户的所有会话，exceptSessionID 不为 0 时保留该会话
+func RevokeUserSessions(db *gorm.DB, userID uint, exceptSessionID uint) error {
+	query := db.Unscoped().Where("user_id = ?", userID)
+	if exceptSessionID != 0 {
+		query = query.Where("id <> ?", exceptSessionID)
+	}
+	return query.Delete(&models.Session{}).Error
+}
+
+// 旧版本以明文保存会话 token（users.token），迁移时删除这一列，旧的登录状态随之失效
+func DropLegacySessionTokens(db *gorm.DB) error {
+	if db.Migrator().HasColumn(&models.User{}, "token") {
+		if err := db.Migrator().DropColumn(&models.User{}, "token"); err != nil {
+			return err
+		}
+		if err := db.AutoMigrate(&models.User{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
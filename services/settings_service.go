@@ -0,0 +1,75 @@
+package services
+
+import (
+	"errors"
+	"strconv"
+
+	"anonymail/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 全局设置项
+const (
+	SettingRequire2FA           = "require_2fa"
+	SettingRegistrationMode     = "registration_mode"
+	SettingQuotaMaxAddresses    = "quota_max_addresses"
+	SettingQuotaAddressesPerDay = "quota_addresses_per_day"
+	SettingQuotaMaxTokens       = "quota_max_tokens"
+)
+
+// 一次性数据迁移的完成标记，不通过设置接口公开
+const (
+	SettingPlaintextEncrypted = "migration_plaintext_encrypted"
+)
+
+// 设置项在数据库中不存在时使用的默认值，启动时可由环境变量覆盖
+var settingDefaults = map[string]string{
+	SettingRequire2FA:           "false",
+	SettingRegistrationMode:     RegistrationOpen,
+	SettingQuotaMaxAddresses:    "0",
+	SettingQuotaAddressesPerDay: "0",
+	SettingQuotaMaxTokens:       "0",
+	SettingPlaintextEncrypted:   "false",
+}
+
+func SetSettingDefault(key string, value string) {
+	settingDefaults[key] = value
+}
+
+func GetSetting(db *gorm.DB, key string) (string, error) {
+	var setting models.Setting
+	err := db.Where("key = ?", key).First(&setting).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return settingDefaults[key], nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return setting.Value, nil
+}
+
+func GetBoolSetting(db *gorm.DB, key string) (bool, error) {
+	value, err := GetSetting(db, key)
+	if err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(value)
+}
+
+func GetIntSetting(db *gorm.DB, key string) (int, error) {
+	value, err := GetSetting(db, key)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+func SetSetting(db *gorm.DB, key string, value string) error {
+	setting := models.Setting{Key: key, Value: value}
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"value"}),
+	}).Create(&setting).Error
+}
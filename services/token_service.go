@@ -0,0 +1,187 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"anonymail/models"
+
+	"gorm.io/gorm"
+)
+
+var ErrSameToken = errors.New("source and target token are the same")
+
+// 未指定 Token 时使用用户的默认 Token
+func FindUserToken(db *gorm.DB, userID uint, tokenID uint) (models.Token, error) {
+	var token models.Token
+	query := db.Where("user_id = ?", userID)
+	if tokenID == 0 {
+		query = query.Where("is_default = ?", true)
+	} else {
+		query = query.Where("id = ?", tokenID)
+	}
+	err := query.First(&token).Error
+	return token, err
+}
+
+// 将指定 Token 设为默认，同一用户只能有一个默认 Token
+func SetDefaultToken(db *gorm.DB, userID uint, tokenID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if _, err := FindUserToken(tx, userID, tokenID); err != nil {
+			return err
+		}
+		if err := tx.Model(&models.Token{}).Where("user_id = ? AND id <> ?", userID, tokenID).Update("is_default", false).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.Token{}).Where("id = ?", tokenID).Update("is_default", true).Error
+	})
+}
+
+// 删除默认 Token 后，将最新的 Token 设为默认
+func EnsureDefaultToken(db *gorm.DB, userID uint) error {
+	var count int64
+	if err := db.Model(&models.Token{}).Where("user_id = ? AND is_default = ?", userID, true).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	var token models.Token
+	err := db.Where("user_id = ?", userID).Order("id DESC").First(&token).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return db.Model(&token).Update("is_default", true).Error
+}
+
+// 修改 Token 描述，同时更新用户自己使用该 Token 生成的地址上记录的描述，返回更新的地址数量。
+// 转移给其他用户的地址可能仍然引用这个 Token，只更新属于该用户的地址
+func RenameToken(db *gorm.DB, userID uint, tokenID uint, description string) (int64, error) {
+	var affected int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Token{}).Where("id = ? AND user_id = ?", tokenID, userID).Update("description", description)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 1 {
+			return gorm.ErrRecordNotFound
+		}
+		result = tx.Model(&models.Address{}).Where("token_id = ? AND user_id = ?", tokenID, userID).Update("token_description", description)
+		affected = result.RowsAffected
+		return result.Error
+	})
+	return affected, err
+}
+
+// 替换 Token 的值（例如 DuckDuckGo 重新签发后），旧值保存在历史记录中，返回更新的地址数量
+func ReplaceTokenValue(db *gorm.DB, userID uint, tokenID uint, value string) (int64, error) {
+	var affected int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		token, err := FindUserToken(tx, userID, tokenID)
+		if err != nil {
+			return err
+		}
+
+		revision := models.TokenRevision{
+			TokenID: token.ID,
+			UserID:  userID,
+			Value:   token.Value,
+		}
+		if err := tx.Create(&revision).Error; err != nil {
+			return fmt.Errorf("failed to save token revision: %w", err)
+		}
+
+		newValue := models.EncryptedString(value)
+		result := tx.Model(&models.Token{}).Where("id = ? AND user_id = ?", token.ID, userID).Update("value", newValue)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 1 {
+			return gorm.ErrRecordNotFound
+		}
+		result = tx.Model(&models.Address{}).Where("token_id = ? AND user_id = ?", token.ID, userID).Update("token_value", newValue)
+		affected = result.RowsAffected
+		return result.Error
+	})
+	return affected, err
+}
+
+// 将旧 Token 下的所有地址转移到另一个 Token，返回转移的地址数量
+func ReassignTokenAddresses(db *gorm.DB, userID uint, fromTokenID uint, toTokenID uint) (int64, error) {
+	if fromTokenID == toTokenID {
+		return 0, ErrSameToken
+	}
+
+	var affected int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		from, err := FindUserToken(tx, userID, fromTokenID)
+		if err != nil {
+			return err
+		}
+		to, err := FindUserToken(tx, userID, toTokenID)
+		if err != nil {
+			return err
+		}
+
+		result := tx.Model(&models.Address{}).Where("user_id = ? AND token_id = ?", userID, from.ID).Updates(map[string]interface{}{
+			"token_id":          to.ID,
+			"token_value":       to.Value,
+			"token_description": to.Description,
+		})
+		affected = result.RowsAffected
+		return result.Error
+	})
+	return affected, err
+}
+
+// 升级旧数据：为每个有 Token 的用户设置默认 Token，并为地址补全 TokenID
+func MigrateTokenData(db *gorm.DB) error {
+	var userIDs []uint
+	if err := db.Model(&models.Token{}).Where("organization_id = 0").Distinct("user_id").Pluck("user_id", &userIDs).Error; err != nil {
+		return err
+	}
+	for _, userID := range userIDs {
+		if err := EnsureDefaultToken(db, userID); err != nil {
+			return err
+		}
+	}
+
+	// 根据地址上记录的 Token 值匹配对应的 Token
+	var addresses []models.Address
+	if err := db.Where("token_id = 0 OR token_id IS NULL").Find(&addresses).Error; err != nil {
+		return err
+	}
+	if len(addresses) == 0 {
+		return backfillTokenUsage(db)
+	}
+
+	tokensByUser := map[uint][]models.Token{}
+	matched := 0
+	for _, address := range addresses {
+		tokens, ok := tokensByUser[address.UserID]
+		if !ok {
+			if err := db.Where("user_id = ?", address.UserID).Find(&tokens).Error; err != nil {
+				return err
+			}
+			tokensByUser[address.UserID] = tokens
+		}
+		for _, token := range tokens {
+			if token.Value == address.TokenValue {
+				if err := db.Model(&address).UpdateColumn("token_id", token.ID).Error; err != nil {
+					return err
+				}
+				matched++
+				break
+			}
+		}
+	}
+	if matched > 0 {
+		log.Printf("Linked %d of %d existing addresses to their tokens", matched, len(addresses))
+	}
+	return backfillTokenUsage(db)
+}
@@ -0,0 +1,47 @@
+package services
+
+import (
+	"testing"
+
+	"anonymail/models"
+)
+
+func TestTokenChangesOnlyUpdateOwnAddresses(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.AutoMigrate(&models.TokenRevision{}); err != nil {
+		t.Fatal(err)
+	}
+	startWithMasterKey(t, db, randomMasterKey(t))
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	token := models.Token{UserID: alice.ID, Value: "old-value", Description: "old"}
+	if err := db.Create(&token).Error; err != nil {
+		t.Fatal(err)
+	}
+	// 第二个地址已经转移给 bob，但仍然引用 alice 的 Token
+	own := models.Address{UserID: alice.ID, GeneratedAddress: "one@duck.com", TokenID: token.ID, TokenValue: "old-value", TokenDescription: "old"}
+	moved := models.Address{UserID: bob.ID, GeneratedAddress: "two@duck.com", TokenID: token.ID, TokenValue: "old-value", TokenDescription: "old"}
+	for _, address := range []*models.Address{&own, &moved} {
+		if err := db.Create(address).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if count, err := RenameToken(db, alice.ID, token.ID, "new"); err != nil || count != 1 {
+		t.Fatalf("rename updated %d addresses: %v", count, err)
+	}
+	if count, err := ReplaceTokenValue(db, alice.ID, token.ID, "new-value"); err != nil || count != 1 {
+		t.Fatalf("replace updated %d addresses: %v", count, err)
+	}
+	if _, err := RenameToken(db, bob.ID, token.ID, "stolen"); err == nil {
+		t.Fatal("renamed a token of another user")
+	}
+
+	var got models.Address
+	if err := db.First(&got, moved.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if got.TokenDescription != "old" || got.TokenValue != "old-value" {
+		t.Fatalf("address of another user changed: %q %q", got.TokenDescription, got.TokenValue)
+	}
+}
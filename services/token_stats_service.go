@@ -0,0 +1,164 @@
+package services
+
+import (
+	"time"
+
+	"anonymail/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const usageDayLayout = "2006-01-02"
+
+// 统计窗口：今天、最近 7 天、最近 30 天
+const (
+	usageWeekDays  = 7
+	usageMonthDays = 30
+)
+
+type DailyTokenUsage struct {
+	Day       string
+	Generated int64
+	Failures  int64
+}
+
+type TokenStats struct {
+	TokenID          uint
+	GeneratedToday   int64
+	GeneratedWeek    int64
+	GeneratedMonth   int64
+	GeneratedTotal   int64
+	FailuresMonth    int64
+	FailuresTotal    int64
+	AverageLatencyMs float64
+	LastUsedAt       *time.Time
+	Daily            []DailyTokenUsage
+}
+
+// 记录一次 DuckDuckGo API 调用，按天累加
+func RecordTokenUsage(db *gorm.DB, tokenID uint, success bool, latency time.Duration) error {
+	now := time.Now()
+	usage := models.TokenUsage{
+		TokenID:        tokenID,
+		Day:            now.UTC().Format(usageDayLayout),
+		LatencyTotalMs: latency.Milliseconds(),
+		LatencyCount:   1,
+	}
+	if success {
+		usage.Generated = 1
+	} else {
+		usage.Failures = 1
+	}
+
+	err := db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "token_id"}, {Name: "day"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"generated":        gorm.Expr("generated + ?", usage.Generated),
+			"failures":         gorm.Expr("failures + ?", usage.Failures),
+			"latency_total_ms": gorm.Expr("latency_total_ms + ?", usage.LatencyTotalMs),
+			"latency_count":    gorm.Expr("latency_count + 1"),
+		}),
+	}).Create(&usage).Error
+	if err != nil {
+		return err
+	}
+
+	return db.Model(&models.Token{}).Where("id = ?", tokenID).UpdateColumn("last_used_at", now).Error
+}
+
+// 汇总多个 Token 的使用统计，withDaily 为 true 时附带最近 30 天的每日数据
+func GetTokenStats(db *gorm.DB, tokens []models.Token, withDaily bool) (map[uint]*TokenStats, error) {
+	stats := make(map[uint]*TokenStats, len(tokens))
+	if len(tokens) == 0 {
+		return stats, nil
+	}
+
+	ids := make([]uint, 0, len(tokens))
+	for _, token := range tokens {
+		ids = append(ids, token.ID)
+		stats[token.ID] = &TokenStats{TokenID: token.ID, LastUsedAt: token.LastUsedAt}
+	}
+
+	var totals []struct {
+		TokenID   uint
+		Generated int64
+		Failures  int64
+	}
+	if err := db.Model(&models.TokenUsage{}).
+		Select("token_id, SUM(generated) AS generated, SUM(failures) AS failures").
+		Where("token_id IN ?", ids).
+		Group("token_id").
+		Scan(&totals).Error; err != nil {
+		return nil, err
+	}
+	for _, total := range totals {
+		stats[total.TokenID].GeneratedTotal = total.Generated
+		stats[total.TokenID].FailuresTotal = total.Failures
+	}
+
+	now := time.Now().UTC()
+	today := now.Format(usageDayLayout)
+	weekStart := now.AddDate(0, 0, -(usageWeekDays - 1)).Format(usageDayLayout)
+	monthStart := now.AddDate(0, 0, -(usageMonthDays - 1)).Format(usageDayLayout)
+
+	var recent []models.TokenUsage
+	if err := db.Where("token_id IN ? AND day >= ?", ids, monthStart).Order("day").Find(&recent).Error; err != nil {
+		return nil, err
+	}
+
+	latencyTotals := map[uint][2]int64{}
+	for _, usage := range recent {
+		s := stats[usage.TokenID]
+		s.GeneratedMonth += usage.Generated
+		s.FailuresMonth += usage.Failures
+		if usage.Day >= weekStart {
+			s.GeneratedWeek += usage.Generated
+		}
+		if usage.Day == today {
+			s.GeneratedToday += usage.Generated
+		}
+		if withDaily {
+			s.Daily = append(s.Daily, DailyTokenUsage{Day: usage.Day, Generated: usage.Generated, Failures: usage.Failures})
+		}
+		latency := latencyTotals[usage.TokenID]
+		latencyTotals[usage.TokenID] = [2]int64{latency[0] + usage.LatencyTotalMs, latency[1] + usage.LatencyCount}
+	}
+	for tokenID, latency := range latencyTotals {
+		if latency[1] > 0 {
+			stats[tokenID].AverageLatencyMs = float64(latency[0]) / float64(latency[1])
+		}
+	}
+	return stats, nil
+}
+
+// 统计功能上线前生成的地址按创建日期计入使用量
+func backfillTokenUsage(db *gorm.DB) error {
+	var count int64
+	if err := db.Model(&models.TokenUsage{}).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	var rows []struct {
+		TokenID   uint
+		Day       string
+		Generated int64
+	}
+	if err := db.Unscoped().Model(&models.Address{}).
+		Select("token_id, substr(created_at, 1, 10) AS day, COUNT(*) AS generated").
+		Where("token_id <> 0").
+		Group("token_id, day").
+		Scan(&rows).Error; err != nil {
+		return err
+	}
+	for _, row := range rows {
+		usage := models.TokenUsage{TokenID: row.TokenID, Day: row.Day, Generated: row.Generated}
+		if err := db.Create(&usage).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,359 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"anonymail/models"
+
+	"gorm.io/gorm"
+)
+
+const (
+	totpPeriod             = 30
+	totpDigits             = 6
+	recoveryCodeCount      = 10
+	recoveryCodeBytes      = 10
+	loginChallengeTTL      = 5 * time.Minute
+	loginChallengeMaxTries = 5
+	totpAllowedClockDrift  = 1
+)
+
+var (
+	ErrInvalidTwoFactorCode = errors.New("invalid two-factor code")
+	ErrTwoFactorNotSetup    = errors.New("two-factor authentication is not set up")
+	ErrTwoFactorRequired    = errors.New("two-factor authentication is required for this account")
+	ErrChallengeExpired     = errors.New("login challenge expired")
+)
+
+var totpIssuer = "DDGM Alias Manager"
+
+func SetTOTPIssuer(issuer string) {
+	totpIssuer = issuer
+}
+
+// 恢复码的 HMAC 密钥，与会话 token 一样由主密钥包装保存，只拿到数据库无法离线猜测恢复码
+var recoveryCodeHashKey []byte
+
+func SetRecoveryCodeHashKey(key []byte) {
+	recoveryCodeHashKey = key
+}
+
+// 用户自己开启了两步验证，或者管理员要求该用户/所有用户开启
+func TwoFactorRequired(db *gorm.DB, user models.User) (bool, error) {
+	if user.TOTPRequired {
+		return true, nil
+	}
+	return GetBoolSetting(db, SettingRequire2FA)
+}
+
+// 需要开启两步验证但尚未设置验证器或安全密钥
+func TwoFactorSetupPending(db *gorm.DB, user models.User) (bool, error) {
+	if user.TOTPEnabled {
+		return false, nil
+	}
+	hasKeys, err := HasWebAuthnCredentials(db, user.ID)
+	if err != nil || hasKeys {
+		return false, err
+	}
+	return TwoFactorRequired(db, user)
+}
+
+// 生成新的 TOTP 密钥并保存，确认验证码之前不会启用
+func BeginTOTPEnrollment(db *gorm.DB, user models.User) (string, string, error) {
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw)
+
+	if err := db.Model(&user).Updates(map[string]interface{}{
+		"totp_secret":    models.EncryptedString(secret),
+		"totp_enabled":   false,
+		"totp_last_step": 0,
+	}).Error; err != nil {
+		return "", "", err
+	}
+	return secret, totpProvisioningURI(user.Username, secret), nil
+}
+
+// 校验第一个验证码后启用两步验证，并生成恢复码
+func ConfirmTOTPEnrollment(db *gorm.DB, user models.User, code string) ([]string, error) {
+	if user.TOTPSecret == "" {
+		return nil, ErrTwoFactorNotSetup
+	}
+	step, ok := verifyTOTP(string(user.TOTPSecret), code, 0)
+	if !ok {
+		return nil, ErrInvalidTwoFactorCode
+	}
+
+	var codes []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&user).Updates(map[string]interface{}{
+			"totp_enabled":   true,
+			"totp_last_step": step,
+		}).Error; err != nil {
+			return err
+		}
+		var err error
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	return codes, err
+}
+
+// 用户主动关闭验证器，被要求开启两步验证且没有安全密钥时不允许关闭
+func DisableTOTP(db *gorm.DB, user models.User, code string) error {
+	required, err := TwoFactorRequired(db, user)
+	if err != nil {
+		return err
+	}
+	hasKeys, err := HasWebAuthnCredentials(db, user.ID)
+	if err != nil {
+		return err
+	}
+	if required && !hasKeys {
+		return ErrTwoFactorRequired
+	}
+	if err := VerifySecondFactor(db, user, code, ""); err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		return clearTOTP(tx, user.ID)
+	})
+}
+
+// 管理员重置：清除验证器、恢复码和所有安全密钥
+func ResetTwoFactor(db *gorm.DB, userID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := clearTOTP(tx, userID); err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("user_id = ?", userID).Delete(&models.WebAuthnCredential{}).Error
+	})
+}
+
+func clearTOTP(tx *gorm.DB, userID uint) error {
+	if err := tx.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"totp_secret":    "",
+		"totp_enabled":   false,
+		"totp_last_step": 0,
+	}).Error; err != nil {
+		return err
+	}
+	return tx.Unscoped().Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error
+}
+
+func RegenerateRecoveryCodes(db *gorm.DB, user models.User, code string) ([]string, error) {
+	if err := VerifySecondFactor(db, user, code, ""); err != nil {
+		return nil, err
+	}
+	var codes []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	return codes, err
+}
+
+func CountRecoveryCodes(db *gorm.DB, userID uint) (int64, error) {
+	var count int64
+	err := db.Model(&models.RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&count).Error
+	return count, err
+}
+
+// 校验 TOTP 验证码或恢复码，同一个验证码和恢复码都只能使用一次
+func VerifySecondFactor(db *gorm.DB, user models.User, code string, recoveryCode string) error {
+	if !user.TOTPEnabled {
+		return ErrTwoFactorNotSetup
+	}
+
+	if recoveryCode != "" {
+		codeHash := hashRecoveryCode(recoveryCode)
+		result := db.Model(&models.RecoveryCode{}).
+			Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, codeHash).
+			Update("used_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvalidTwoFactorCode
+		}
+		return nil
+	}
+
+	step, ok := verifyTOTP(string(user.TOTPSecret), code, user.TOTPLastStep)
+	if !ok {
+		return ErrInvalidTwoFactorCode
+	}
+	// 条件更新防止并发请求重复使用同一个验证码
+	result := db.Model(&models.User{}).
+		Where("id = ? AND totp_last_step < ?", user.ID, step).
+		Update("totp_last_step", step)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidTwoFactorCode
+	}
+	return nil
+}
+
+// 第一步验证通过后创建待完成的登录，返回给客户端用于完成登录
+func CreateLoginChallenge(db *gorm.DB, userID uint, purpose string) (string, error) {
+	token, err := GenerateRandomToken()
+	if err != nil {
+		return "", err
+	}
+	challenge := models.LoginChallenge{
+		UserID:    userID,
+		Purpose:   purpose,
+		TokenHash: hashChallengeToken(token),
+		ExpiresAt: time.Now().Add(loginChallengeTTL),
+	}
+	if err := db.Create(&challenge).Error; err != nil {
+		return "", err
+	}
+	if err := db.Unscoped().Where("expires_at < ?", time.Now()).Delete(&models.LoginChallenge{}).Error; err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// 查找待完成的登录并记录一次尝试，超过次数或过期后失效
+func FindLoginChallenge(db *gorm.DB, token string, purpose string) (models.LoginChallenge, models.User, error) {
+	var challenge models.LoginChallenge
+	if err := db.Where("token_hash = ? AND purpose = ?", hashChallengeToken(token), purpose).First(&challenge).Error; err != nil {
+		return models.LoginChallenge{}, models.User{}, err
+	}
+	// 检查和计数在同一条条件更新中完成，并发请求也无法超过尝试次数
+	result := db.Model(&models.LoginChallenge{}).
+		Where("id = ? AND attempts < ? AND expires_at > ?", challenge.ID, loginChallengeMaxTries, time.Now()).
+		UpdateColumn("attempts", gorm.Expr("attempts + 1"))
+	if result.Error != nil {
+		return models.LoginChallenge{}, models.User{}, result.Error
+	}
+	if result.RowsAffected == 0 {
+		db.Unscoped().Delete(&challenge)
+		return models.LoginChallenge{}, models.User{}, ErrChallengeExpired
+	}
+
+	var user models.User
+	if err := db.First(&user, challenge.UserID).Error; err != nil {
+		return models.LoginChallenge{}, models.User{}, err
+	}
+	return challenge, user, nil
+}
+
+// 完成登录时删除待完成的登录。删除成功的请求才能继续，并发请求只有一个可以使用同一个凭证
+func CompleteLoginChallenge(db *gorm.DB, challenge models.LoginChallenge) error {
+	result := db.Unscoped().
+		Where("id = ? AND expires_at > ?", challenge.ID, time.Now()).
+		Delete(&models.LoginChallenge{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != 1 {
+		return ErrChallengeExpired
+	}
+	return nil
+}
+
+func replaceRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Unscoped().Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		// 80 位随机数，格式为 xxxx-xxxx-xxxx-xxxx
+		raw := make([]byte, recoveryCodeBytes)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		encoded := strings.ToLower(base32.StdEncoding.EncodeToString(raw))
+		code := encoded[:4] + "-" + encoded[4:8] + "-" + encoded[8:12] + "-" + encoded[12:]
+		if err := tx.Create(&models.RecoveryCode{UserID: userID, CodeHash: hashRecoveryCode(code)}).Error; err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// 恢复码忽略大小写、空格和连字符
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	mac := hmac.New(sha256.New, recoveryCodeHashKey)
+	mac.Write([]byte(normalized))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func hashChallengeToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func totpProvisioningURI(username string, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// 允许前后一个时间窗口的时钟偏差，且时间窗口必须大于上次使用的窗口
+func verifyTOTP(secret string, code string, lastStep int64) (int64, bool) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := time.Now().Unix() / totpPeriod
+	for offset := int64(-totpAllowedClockDrift); offset <= totpAllowedClockDrift; offset++ {
+		step := current + offset
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// RFC 6238 TOTP，HMAC-SHA1
+func totpCode(key []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
@@ -0,0 +1,69 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"anonymail/models"
+)
+
+func TestLoginChallengeCompletesOnce(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.AutoMigrate(&models.LoginChallenge{}); err != nil {
+		t.Fatal(err)
+	}
+	user := createTestUser(t, db, "alice")
+
+	token, err := CreateLoginChallenge(db, user.ID, models.LoginChallengeSSO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 两个请求都在完成之前查到了同一个凭证
+	first, _, err := FindLoginChallenge(db, token, models.LoginChallengeSSO)
+	if err != nil {
+		t.Fatalf("find challenge: %v", err)
+	}
+	second, _, err := FindLoginChallenge(db, token, models.LoginChallengeSSO)
+	if err != nil {
+		t.Fatalf("find challenge: %v", err)
+	}
+
+	if err := CompleteLoginChallenge(db, first); err != nil {
+		t.Fatalf("complete challenge: %v", err)
+	}
+	if err := CompleteLoginChallenge(db, second); !errors.Is(err, ErrChallengeExpired) {
+		t.Fatalf("got error %v, want %v", err, ErrChallengeExpired)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.AutoMigrate(&models.RecoveryCode{}); err != nil {
+		t.Fatal(err)
+	}
+	previous := recoveryCodeHashKey
+	SetRecoveryCodeHashKey(randomMasterKey(t))
+	t.Cleanup(func() { recoveryCodeHashKey = previous })
+
+	codes, err := replaceRecoveryCodes(db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range codes {
+		// 16 个 base32 字符，共 80 位
+		if len(strings.ReplaceAll(code, "-", "")) != 16 {
+			t.Fatalf("recovery code %q is too short", code)
+		}
+	}
+
+	// 哈希使用密钥，换一个密钥后数据库中的哈希无法匹配
+	var stored models.RecoveryCode
+	if err := db.Where("code_hash = ?", hashRecoveryCode(strings.ToUpper(codes[0]))).First(&stored).Error; err != nil {
+		t.Fatalf("recovery code not found: %v", err)
+	}
+	SetRecoveryCodeHashKey(randomMasterKey(t))
+	if stored.CodeHash == hashRecoveryCode(codes[0]) {
+		t.Fatal("recovery code hash does not depend on the key")
+	}
+}
@@ -0,0 +1,192 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"anonymail/models"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrTransferSameUser  = errors.New("source and target user are the same")
+	ErrTransferSelection = errors.New("selected items do not belong to the source user")
+	ErrTransferEmpty     = errors.New("nothing to transfer")
+)
+
+// 未指定任何地址和 Token 时转移源用户的全部地址和 Token
+type TransferRequest struct {
+	FromUserID uint
+	ToUserID   uint
+	AddressIDs []uint
+	TokenIDs   []uint
+}
+
+type TransferPlan struct {
+	From      models.User
+	To        models.User
+	Addresses []models.Address
+	Tokens    []models.Token
+}
+
+// 预览转移的内容，不修改数据
+func PlanTransfer(db *gorm.DB, request TransferRequest) (TransferPlan, error) {
+	if request.FromUserID == request.ToUserID {
+		return TransferPlan{}, ErrTransferSameUser
+	}
+
+	// 源用户可以是已删除的用户，以便找回其遗留的地址和 Token
+	var plan TransferPlan
+	if err := db.Unscoped().First(&plan.From, request.FromUserID).Error; err != nil {
+		return TransferPlan{}, err
+	}
+	if err := db.First(&plan.To, request.ToUserID).Error; err != nil {
+		return TransferPlan{}, err
+	}
+
+	transferAll := len(request.AddressIDs) == 0 && len(request.TokenIDs) == 0
+	if transferAll || len(request.AddressIDs) > 0 {
+		query := db.Where("user_id = ?", request.FromUserID)
+		if !transferAll {
+			query = query.Where("id IN ?", request.AddressIDs)
+		}
+		if err := query.Order("id").Find(&plan.Addresses).Error; err != nil {
+			return TransferPlan{}, err
+		}
+		if !transferAll && len(plan.Addresses) != len(uniqueIDs(request.AddressIDs)) {
+			return TransferPlan{}, ErrTransferSelection
+		}
+	}
+	if transferAll || len(request.TokenIDs) > 0 {
+		query := db.Where("user_id = ?", request.FromUserID)
+		if !transferAll {
+			query = query.Where("id IN ?", request.TokenIDs)
+		}
+		if err := query.Order("id").Find(&plan.Tokens).Error; err != nil {
+			return TransferPlan{}, err
+		}
+		if !transferAll && len(plan.Tokens) != len(uniqueIDs(request.TokenIDs)) {
+			return TransferPlan{}, ErrTransferSelection
+		}
+	}
+	if len(plan.Addresses) == 0 && len(plan.Tokens) == 0 {
+		return TransferPlan{}, ErrTransferEmpty
+	}
+	return plan, nil
+}
+
+// 在一个事务中执行转移并保存记录，任何一步失败都不会留下部分转移的数据
+func ExecuteTransfer(db *gorm.DB, request TransferRequest, performedBy uint) (TransferPlan, models.OwnershipTransfer, error) {
+	var plan TransferPlan
+	var record models.OwnershipTransfer
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		plan, err = PlanTransfer(tx, request)
+		if err != nil {
+			return err
+		}
+
+		addressIDs := make([]uint, 0, len(plan.Addresses))
+		for _, address := range plan.Addresses {
+			addressIDs = append(addressIDs, address.ID)
+		}
+		tokenIDs := make([]uint, 0, len(plan.Tokens))
+		for _, token := range plan.Tokens {
+			tokenIDs = append(tokenIDs, token.ID)
+		}
+
+		if len(addressIDs) > 0 {
+			if err := tx.Model(&models.Address{}).Where("id IN ?", addressIDs).Update("user_id", request.ToUserID).Error; err != nil {
+				return err
+			}
+			// 新所有者不需要再通过共享访问这些地址
+			if err := tx.Where("address_id IN ? AND user_id = ?", addressIDs, request.ToUserID).Delete(&models.AddressShare{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&models.AddressShare{}).Where("address_id IN ?", addressIDs).Update("granted_by", request.ToUserID).Error; err != nil {
+				return err
+			}
+			// 没有一起转移的个人 Token 仍属于源用户，地址不再引用它，新所有者也拿不到 Token 的值
+			detached := tx.Model(&models.Address{}).Where("id IN ? AND organization_id = 0", addressIDs)
+			if len(tokenIDs) > 0 {
+				detached = detached.Where("token_id NOT IN ?", tokenIDs)
+			}
+			if err := detached.Updates(map[string]interface{}{"token_id": 0, "token_value": ""}).Error; err != nil {
+				return err
+			}
+		}
+		if len(tokenIDs) > 0 {
+			// 转移的 Token 不会成为新用户的默认 Token
+			if err := tx.Model(&models.Token{}).Where("id IN ?", tokenIDs).Updates(map[string]interface{}{"user_id": request.ToUserID, "is_default": false}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&models.TokenRevision{}).Where("token_id IN ?", tokenIDs).Update("user_id", request.ToUserID).Error; err != nil {
+				return err
+			}
+			if err := EnsureDefaultToken(tx, request.FromUserID); err != nil {
+				return err
+			}
+			if err := EnsureDefaultToken(tx, request.ToUserID); err != nil {
+				return err
+			}
+		}
+
+		record = models.OwnershipTransfer{
+			FromUserID:  request.FromUserID,
+			ToUserID:    request.ToUserID,
+			PerformedBy: performedBy,
+			AddressIDs:  joinIDs(addressIDs),
+			TokenIDs:    joinIDs(tokenIDs),
+		}
+		return tx.Create(&record).Error
+	})
+	if err != nil {
+		return TransferPlan{}, models.OwnershipTransfer{}, err
+	}
+	return plan, record, nil
+}
+
+func ListOwnershipTransfers(db *gorm.DB, userID uint) ([]models.OwnershipTransfer, error) {
+	var transfers []models.OwnershipTransfer
+	query := db.Order("id DESC")
+	if userID != 0 {
+		query = query.Where("from_user_id = ? OR to_user_id = ?", userID, userID)
+	}
+	err := query.Find(&transfers).Error
+	return transfers, err
+}
+
+func joinIDs(ids []uint) string {
+	values := make([]string, 0, len(ids))
+	for _, id := range ids {
+		values = append(values, strconv.FormatUint(uint64(id), 10))
+	}
+	return strings.Join(values, ",")
+}
+
+// 解析以逗号分隔的 ID 列表
+func ParseIDList(value string) ([]uint, error) {
+	ids := []uint{}
+	for _, item := range strings.Split(value, ",") {
+		if item == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(item, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id %q", item)
+		}
+		ids = append(ids, uint(id))
+	}
+	return ids, nil
+}
+
+func uniqueIDs(ids []uint) map[uint]bool {
+	unique := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		unique[id] = true
+	}
+	return unique
+}
@@ -0,0 +1,57 @@
+package services
+
+import (
+	"testing"
+
+	"anonymail/models"
+)
+
+func TestTransferDetachesTokensLeftBehind(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.AutoMigrate(&models.AddressShare{}, &models.TokenRevision{}, &models.OwnershipTransfer{}); err != nil {
+		t.Fatal(err)
+	}
+	startWithMasterKey(t, db, randomMasterKey(t))
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+
+	kept := models.Token{UserID: alice.ID, Value: "kept-value", IsDefault: true}
+	moved := models.Token{UserID: alice.ID, Value: "moved-value"}
+	for _, token := range []*models.Token{&kept, &moved} {
+		if err := db.Create(token).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	withKept := models.Address{UserID: alice.ID, GeneratedAddress: "one@duck.com", TokenID: kept.ID, TokenValue: kept.Value}
+	withMoved := models.Address{UserID: alice.ID, GeneratedAddress: "two@duck.com", TokenID: moved.ID, TokenValue: moved.Value}
+	for _, address := range []*models.Address{&withKept, &withMoved} {
+		if err := db.Create(address).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, _, err := ExecuteTransfer(db, TransferRequest{
+		FromUserID: alice.ID,
+		ToUserID:   bob.ID,
+		AddressIDs: []uint{withKept.ID, withMoved.ID},
+		TokenIDs:   []uint{moved.ID},
+	}, alice.ID)
+	if err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+
+	var got models.Address
+	if err := db.First(&got, withKept.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if got.UserID != bob.ID || got.TokenID != 0 || got.TokenValue != "" {
+		t.Fatalf("address still refers to the source user's token: %+v", got)
+	}
+	var other models.Address
+	if err := db.First(&other, withMoved.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if other.TokenID != moved.ID || other.TokenValue != moved.Value {
+		t.Fatalf("address lost the token moved with it: %+v", other)
+	}
+}
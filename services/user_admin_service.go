@@ -0,0 +1,254 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"anonymail/models"
+
+	"gorm.io/gorm"
+)
+
+const (
+	DefaultUserPageSize = 50
+	MaxUserPageSize     = 200
+)
+
+// 用户列表按状态筛选
+const (
+	UserStatusActive    = "active"
+	UserStatusSuspended = "suspended"
+	UserStatusPending   = "pending"
+	UserStatusDisabled  = "disabled"
+	UserStatusLocked    = "locked"
+)
+
+var (
+	ErrInvalidUserStatus   = errors.New("invalid status filter")
+	ErrInvalidUsername     = errors.New("username must not be empty")
+	ErrExternalUsername    = errors.New("username of an externally managed account cannot be changed")
+	ErrAdminFlagPermission = errors.New("missing permission: " + models.PermissionRolesManage)
+	ErrNothingToUpdate     = errors.New("no attributes to update")
+	ErrSelfAdminFlag       = errors.New("cannot remove your own admin flag")
+)
+
+var userStatusFilters = map[string]func(*gorm.DB) *gorm.DB{
+	UserStatusActive: func(q *gorm.DB) *gorm.DB {
+		return q.Where("disabled = ?", false)
+	},
+	UserStatusSuspended: func(q *gorm.DB) *gorm.DB {
+		return q.Where("disabled = ? AND disabled_reason = ?", true, models.DisabledSuspended)
+	},
+	UserStatusPending: func(q *gorm.DB) *gorm.DB {
+		return q.Where("disabled = ? AND disabled_reason = ?", true, models.DisabledPendingApproval)
+	},
+	UserStatusDisabled: func(q *gorm.DB) *gorm.DB {
+		return q.Where("disabled = ?", true)
+	},
+}
+
+type UserListQuery struct {
+	Search   string
+	Status   string
+	Page     int
+	PageSize int
+}
+
+// 管理员用户列表中的一项，附带会话、地址和 Token 数量
+type UserSummary struct {
+	User         models.User
+	SessionCount int64
+	AddressCount int64
+	TokenCount   int64
+	LockedUntil  *time.Time
+	// 注册了安全密钥也算开启两步验证
+	HasSecurityKeys bool
+}
+
+// 补全默认的页码和每页数量
+func (query UserListQuery) Normalized() UserListQuery {
+	if query.PageSize <= 0 {
+		query.PageSize = DefaultUserPageSize
+	}
+	if query.PageSize > MaxUserPageSize {
+		query.PageSize = MaxUserPageSize
+	}
+	if query.Page <= 0 {
+		query.Page = 1
+	}
+	return query
+}
+
+// 按用户名搜索并分页列出用户，返回当前页和符合条件的总数
+func ListUsers(db *gorm.DB, query UserListQuery) ([]UserSummary, int64, error) {
+	query = query.Normalized()
+
+	q := db.Model(&models.User{})
+	if search := strings.TrimSpace(query.Search); search != "" {
+		q = q.Where(`username LIKE ? ESCAPE '\'`, "%"+escapeLike(search)+"%")
+	}
+	if query.Status == UserStatusLocked {
+		lockedNames, err := lockedUsernames(db)
+		if err != nil {
+			return nil, 0, err
+		}
+		q = q.Where("username IN ?", append(lockedNames, ""))
+	} else if query.Status != "" {
+		filter, ok := userStatusFilters[query.Status]
+		if !ok {
+			return nil, 0, ErrInvalidUserStatus
+		}
+		q = filter(q)
+	}
+
+	var total int64
+	if err := q.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var users []models.User
+	if err := q.Order("id").Limit(query.PageSize).Offset((query.Page - 1) * query.PageSize).Find(&users).Error; err != nil {
+		return nil, 0, err
+	}
+	summaries, err := summarizeUsers(db, users)
+	return summaries, total, err
+}
+
+func summarizeUsers(db *gorm.DB, users []models.User) ([]UserSummary, error) {
+	summaries := make([]UserSummary, 0, len(users))
+	if len(users) == 0 {
+		return summaries, nil
+	}
+	userIDs := make([]uint, 0, len(users))
+	for _, user := range users {
+		userIDs = append(userIDs, user.ID)
+	}
+
+	sessions, err := countByUser(db.Model(&models.Session{}).Where("expires_at > ?", time.Now()), userIDs)
+	if err != nil {
+		return nil, err
+	}
+	addresses, err := countByUser(db.Model(&models.Address{}), userIDs)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := countByUser(db.Model(&models.Token{}).Where("organization_id = 0"), userIDs)
+	if err != nil {
+		return nil, err
+	}
+	securityKeys, err := countByUser(db.Model(&models.WebAuthnCredential{}), userIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, user := range users {
+		lockedUntil, err := AccountLockedUntil(db, user.Username)
+		if err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, UserSummary{
+			User:            user,
+			SessionCount:    sessions[user.ID],
+			AddressCount:    addresses[user.ID],
+			TokenCount:      tokens[user.ID],
+			LockedUntil:     lockedUntil,
+			HasSecurityKeys: securityKeys[user.ID] > 0,
+		})
+	}
+	return summaries, nil
+}
+
+func countByUser(query *gorm.DB, userIDs []uint) (map[uint]int64, error) {
+	var rows []struct {
+		UserID uint
+		Count  int64
+	}
+	err := query.Select("user_id, COUNT(*) AS count").Where("user_id IN ?", userIDs).Group("user_id").Scan(&rows).Error
+	counts := make(map[uint]int64, len(rows))
+	for _, row := range rows {
+		counts[row.UserID] = row.Count
+	}
+	return counts, err
+}
+
+// 转义 LIKE 通配符，搜索词按字面匹配
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+}
+
+// 管理员可以修改的用户属性，为 nil 的字段保持不变
+type UserUpdate struct {
+	Username           *string
+	IsAdmin            *bool
+	NeedsPasswordReset *bool
+	TwoFactorRequired  *bool
+}
+
+// 修改用户属性；修改管理员标记需要 roles:manage 权限，且不能移除最后一个管理员
+func UpdateUserAttributes(db *gorm.DB, actor models.User, userID uint, update UserUpdate) (models.User, error) {
+	if update.Username == nil && update.IsAdmin == nil && update.NeedsPasswordReset == nil && update.TwoFactorRequired == nil {
+		return models.User{}, ErrNothingToUpdate
+	}
+	if update.IsAdmin != nil && !HasPermission(actor, models.PermissionRolesManage) {
+		return models.User{}, ErrAdminFlagPermission
+	}
+
+	var user models.User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&user, userID).Error; err != nil {
+			return err
+		}
+		changes := map[string]interface{}{}
+
+		if update.Username != nil {
+			username := strings.TrimSpace(*update.Username)
+			if username == "" {
+				return ErrInvalidUsername
+			}
+			if username != user.Username {
+				if user.AuthProvider != models.AuthProviderLocal {
+					return ErrExternalUsername
+				}
+				// 已删除的用户仍占用用户名，以便之后转移其数据
+				var count int64
+				if err := tx.Unscoped().Model(&models.User{}).Where("username = ? AND id <> ?", username, user.ID).Count(&count).Error; err != nil {
+					return err
+				}
+				if count > 0 {
+					return ErrUsernameTaken
+				}
+				changes["username"] = username
+				user.Username = username
+			}
+		}
+		if update.IsAdmin != nil && *update.IsAdmin != user.IsAdmin {
+			if !*update.IsAdmin {
+				if actor.ID == user.ID {
+					return ErrSelfAdminFlag
+				}
+				if err := EnsureOtherAdminExists(tx, user.ID); err != nil {
+					return err
+				}
+			}
+			user.IsAdmin = *update.IsAdmin
+			user.Role = models.RoleNone
+			changes["is_admin"] = user.IsAdmin
+			changes["role"] = user.Role
+		}
+		if update.NeedsPasswordReset != nil {
+			user.NeedsPasswordReset = *update.NeedsPasswordReset
+			changes["needs_password_reset"] = user.NeedsPasswordReset
+		}
+		if update.TwoFactorRequired != nil {
+			user.TOTPRequired = *update.TwoFactorRequired
+			changes["totp_required"] = user.TOTPRequired
+		}
+
+		if len(changes) == 0 {
+			return nil
+		}
+		return tx.Model(&user).Updates(changes).Error
+	})
+	return user, err
+}
@@ -0,0 +1,566 @@
+package services
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+
+	"anonymail/models"
+
+	"gorm.io/gorm"
+)
+
+const (
+	webAuthnChallengeTTL = 5 * time.Minute
+	webAuthnTimeoutMs    = 60000
+
+	webAuthnPurposeRegister = "register"
+	webAuthnPurposeLogin    = "login"
+	webAuthnPurposePasskey  = "passkey"
+
+	coseAlgES256 = -7
+	coseAlgRS256 = -257
+
+	authDataFlagUserPresent  = 0x01
+	authDataFlagUserVerified = 0x04
+	authDataFlagAttested     = 0x40
+)
+
+var (
+	ErrWebAuthnVerification  = errors.New("webauthn verification failed")
+	ErrWebAuthnUnknownKey    = errors.New("unknown security key")
+	ErrWebAuthnNoCredentials = errors.New("no security keys registered")
+)
+
+var webAuthnRPName = "DDGM Alias Manager"
+var webAuthnRPID string
+var webAuthnOrigins []string
+
+// 未配置时根据请求的 Host 推断 RP ID 和允许的来源
+func SetWebAuthnConfig(rpID string, rpName string, origins []string) {
+	webAuthnRPID = rpID
+	if rpName != "" {
+		webAuthnRPName = rpName
+	}
+	webAuthnOrigins = origins
+}
+
+// WebAuthnRP 是一次请求对应的依赖方信息
+type WebAuthnRP struct {
+	ID      string
+	Origins []string
+}
+
+func ResolveWebAuthnRP(requestHost string) WebAuthnRP {
+	if webAuthnRPID != "" {
+		return WebAuthnRP{ID: webAuthnRPID, Origins: webAuthnOrigins}
+	}
+	hostname := requestHost
+	if host, _, err := net.SplitHostPort(requestHost); err == nil {
+		hostname = host
+	}
+	return WebAuthnRP{
+		ID:      hostname,
+		Origins: []string{"https://" + requestHost, "http://" + requestHost},
+	}
+}
+
+// 浏览器返回的数据，二进制字段均为 base64url 编码
+type WebAuthnAttestation struct {
+	ID       string `json:"id" binding:"required"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string   `json:"clientDataJSON" binding:"required"`
+		AttestationObject string   `json:"attestationObject" binding:"required"`
+		Transports        []string `json:"transports"`
+	} `json:"response"`
+}
+
+type WebAuthnAssertion struct {
+	ID       string `json:"id" binding:"required"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON" binding:"required"`
+		AuthenticatorData string `json:"authenticatorData" binding:"required"`
+		Signature         string `json:"signature" binding:"required"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+// 返回给浏览器 navigator.credentials 的参数，二进制字段由前端从 base64url 解码
+type webAuthnCredentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+type WebAuthnCreationOptions struct {
+	RP struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	} `json:"user"`
+	Challenge        string `json:"challenge"`
+	PubKeyCredParams []struct {
+		Type string `json:"type"`
+		Alg  int    `json:"alg"`
+	} `json:"pubKeyCredParams"`
+	Timeout                int                            `json:"timeout"`
+	Attestation            string                         `json:"attestation"`
+	ExcludeCredentials     []webAuthnCredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection struct {
+		ResidentKey      string `json:"residentKey"`
+		UserVerification string `json:"userVerification"`
+	} `json:"authenticatorSelection"`
+}
+
+type WebAuthnRequestOptions struct {
+	RPID             string                         `json:"rpId"`
+	Challenge        string                         `json:"challenge"`
+	Timeout          int                            `json:"timeout"`
+	AllowCredentials []webAuthnCredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                         `json:"userVerification"`
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+func HasWebAuthnCredentials(db *gorm.DB, userID uint) (bool, error) {
+	var count int64
+	err := db.Model(&models.WebAuthnCredential{}).Where("user_id = ?", userID).Count(&count).Error
+	return count > 0, err
+}
+
+// 登录时可用的第二步验证方式，为空表示未开启两步验证
+func SecondFactorMethods(db *gorm.DB, user models.User) ([]string, error) {
+	var methods []string
+	if user.TOTPEnabled {
+		methods = append(methods, "totp", "recovery_code")
+	}
+	hasKeys, err := HasWebAuthnCredentials(db, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if hasKeys {
+		methods = append(methods, "webauthn")
+	}
+	return methods, nil
+}
+
+func ListWebAuthnCredentials(db *gorm.DB, userID uint) ([]models.WebAuthnCredential, error) {
+	var credentials []models.WebAuthnCredential
+	err := db.Where("user_id = ?", userID).Order("id").Find(&credentials).Error
+	return credentials, err
+}
+
+func RenameWebAuthnCredential(db *gorm.DB, userID uint, credentialID uint, name string) error {
+	result := db.Model(&models.WebAuthnCredential{}).Where("id = ? AND user_id = ?", credentialID, userID).Update("name", name)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// 被要求开启两步验证时，不允许删除最后一个第二步验证方式
+func DeleteWebAuthnCredential(db *gorm.DB, user models.User, credentialID uint) error {
+	var credential models.WebAuthnCredential
+	if err := db.Where("id = ? AND user_id = ?", credentialID, user.ID).First(&credential).Error; err != nil {
+		return err
+	}
+
+	if !user.TOTPEnabled {
+		required, err := TwoFactorRequired(db, user)
+		if err != nil {
+			return err
+		}
+		var count int64
+		if err := db.Model(&models.WebAuthnCredential{}).Where("user_id = ?", user.ID).Count(&count).Error; err != nil {
+			return err
+		}
+		if required && count <= 1 {
+			return ErrTwoFactorRequired
+		}
+	}
+	return db.Unscoped().Delete(&credential).Error
+}
+
+// 开始注册安全密钥，已注册的密钥会被排除以免重复注册
+func BeginWebAuthnRegistration(db *gorm.DB, rp WebAuthnRP, user models.User) (WebAuthnCreationOptions, error) {
+	var options WebAuthnCreationOptions
+	challenge, err := createWebAuthnChallenge(db, user.ID, webAuthnPurposeRegister)
+	if err != nil {
+		return options, err
+	}
+	credentials, err := ListWebAuthnCredentials(db, user.ID)
+	if err != nil {
+		return options, err
+	}
+
+	options.RP.ID = rp.ID
+	options.RP.Name = webAuthnRPName
+	options.User.ID = base64.RawURLEncoding.EncodeToString(webAuthnUserHandle(user.ID))
+	options.User.Name = user.Username
+	options.User.DisplayName = user.Username
+	options.Challenge = challenge
+	for _, alg := range []int{coseAlgES256, coseAlgRS256} {
+		options.PubKeyCredParams = append(options.PubKeyCredParams, struct {
+			Type string `json:"type"`
+			Alg  int    `json:"alg"`
+		}{Type: "public-key", Alg: alg})
+	}
+	options.Timeout = webAuthnTimeoutMs
+	options.Attestation = "none"
+	options.ExcludeCredentials = credentialDescriptors(credentials)
+	options.AuthenticatorSelection.ResidentKey = "preferred"
+	options.AuthenticatorSelection.UserVerification = "preferred"
+	return options, nil
+}
+
+// 校验注册结果并保存公钥。不校验设备证明，只信任密钥本身
+func FinishWebAuthnRegistration(db *gorm.DB, rp WebAuthnRP, user models.User, name string, attestation WebAuthnAttestation) (models.WebAuthnCredential, error) {
+	clientDataJSON, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(attestation.Response.ClientDataJSON, "="))
+	if err != nil {
+		return models.WebAuthnCredential{}, ErrWebAuthnVerification
+	}
+	if err := verifyClientData(db, rp, clientDataJSON, "webauthn.create", webAuthnPurposeRegister, user.ID); err != nil {
+		return models.WebAuthnCredential{}, err
+	}
+
+	rawObject, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(attestation.Response.AttestationObject, "="))
+	if err != nil {
+		return models.WebAuthnCredential{}, ErrWebAuthnVerification
+	}
+	decoded, _, err := decodeCBOR(rawObject)
+	if err != nil {
+		return models.WebAuthnCredential{}, fmt.Errorf("%w: %v", ErrWebAuthnVerification, err)
+	}
+	object, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return models.WebAuthnCredential{}, ErrWebAuthnVerification
+	}
+	authData, ok := object["authData"].([]byte)
+	if !ok {
+		return models.WebAuthnCredential{}, ErrWebAuthnVerification
+	}
+
+	flags, signCount, err := verifyAuthenticatorData(rp, authData)
+	if err != nil {
+		return models.WebAuthnCredential{}, err
+	}
+	if flags&authDataFlagAttested == 0 || len(authData) < 37+18 {
+		return models.WebAuthnCredential{}, ErrWebAuthnVerification
+	}
+
+	// 认证器数据之后依次是 AAGUID(16)、凭据 ID 长度(2)、凭据 ID、COSE 公钥
+	rest := authData[37+16:]
+	idLength := int(binary.BigEndian.Uint16(rest[:2]))
+	if len(rest) < 2+idLength {
+		return models.WebAuthnCredential{}, ErrWebAuthnVerification
+	}
+	credentialID := rest[2 : 2+idLength]
+	coseKey, consumed, err := decodeCBOR(rest[2+idLength:])
+	if err != nil {
+		return models.WebAuthnCredential{}, fmt.Errorf("%w: %v", ErrWebAuthnVerification, err)
+	}
+	publicKey := rest[2+idLength : 2+idLength+consumed]
+	if _, err := parseCOSEKey(coseKey); err != nil {
+		return models.WebAuthnCredential{}, err
+	}
+
+	credential := models.WebAuthnCredential{
+		UserID:       user.ID,
+		Name:         name,
+		CredentialID: base64.RawURLEncoding.EncodeToString(credentialID),
+		PublicKey:    append([]byte(nil), publicKey...),
+		SignCount:    signCount,
+		Transports:   strings.Join(attestation.Response.Transports, ","),
+	}
+	if err := db.Create(&credential).Error; err != nil {
+		return models.WebAuthnCredential{}, err
+	}
+	return credential, nil
+}
+
+// userID 为 0 时表示无密码登录，由浏览器列出可用的通行密钥
+func BeginWebAuthnLogin(db *gorm.DB, rp WebAuthnRP, userID uint) (WebAuthnRequestOptions, error) {
+	var options WebAuthnRequestOptions
+	purpose := webAuthnPurposePasskey
+	userVerification := "required"
+	if userID != 0 {
+		purpose = webAuthnPurposeLogin
+		userVerification = "discouraged"
+
+		credentials, err := ListWebAuthnCredentials(db, userID)
+		if err != nil {
+			return options, err
+		}
+		if len(credentials) == 0 {
+			return options, ErrWebAuthnNoCredentials
+		}
+		options.AllowCredentials = credentialDescriptors(credentials)
+	}
+
+	challenge, err := createWebAuthnChallenge(db, userID, purpose)
+	if err != nil {
+		return options, err
+	}
+	options.RPID = rp.ID
+	options.Challenge = challenge
+	options.Timeout = webAuthnTimeoutMs
+	options.UserVerification = userVerification
+	if options.AllowCredentials == nil {
+		options.AllowCredentials = []webAuthnCredentialDescriptor{}
+	}
+	return options, nil
+}
+
+// 校验签名并返回密钥所属的用户。无密码登录要求认证器验证了用户身份
+func FinishWebAuthnLogin(db *gorm.DB, rp WebAuthnRP, userID uint, assertion WebAuthnAssertion) (models.User, error) {
+	purpose := webAuthnPurposeLogin
+	if userID == 0 {
+		purpose = webAuthnPurposePasskey
+	}
+
+	var credential models.WebAuthnCredential
+	if err := db.Where("credential_id = ?", strings.TrimRight(assertion.ID, "=")).First(&credential).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.User{}, ErrWebAuthnUnknownKey
+		}
+		return models.User{}, err
+	}
+	if userID != 0 && credential.UserID != userID {
+		return models.User{}, ErrWebAuthnUnknownKey
+	}
+	if assertion.Response.UserHandle != "" {
+		handle, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(assertion.Response.UserHandle, "="))
+		if err != nil || !bytes.Equal(handle, webAuthnUserHandle(credential.UserID)) {
+			return models.User{}, ErrWebAuthnVerification
+		}
+	}
+
+	clientDataJSON, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(assertion.Response.ClientDataJSON, "="))
+	if err != nil {
+		return models.User{}, ErrWebAuthnVerification
+	}
+	if err := verifyClientData(db, rp, clientDataJSON, "webauthn.get", purpose, userID); err != nil {
+		return models.User{}, err
+	}
+
+	authData, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(assertion.Response.AuthenticatorData, "="))
+	if err != nil {
+		return models.User{}, ErrWebAuthnVerification
+	}
+	flags, signCount, err := verifyAuthenticatorData(rp, authData)
+	if err != nil {
+		return models.User{}, err
+	}
+	if purpose == webAuthnPurposePasskey && flags&authDataFlagUserVerified == 0 {
+		return models.User{}, ErrWebAuthnVerification
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(assertion.Response.Signature, "="))
+	if err != nil {
+		return models.User{}, ErrWebAuthnVerification
+	}
+	coseKey, _, err := decodeCBOR(credential.PublicKey)
+	if err != nil {
+		return models.User{}, err
+	}
+	publicKey, err := parseCOSEKey(coseKey)
+	if err != nil {
+		return models.User{}, err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	if !verifyWebAuthnSignature(publicKey, append(append([]byte(nil), authData...), clientDataHash[:]...), signature) {
+		return models.User{}, ErrWebAuthnVerification
+	}
+
+	// 签名计数没有增长说明密钥可能被克隆；不支持计数的认证器始终返回 0。
+	// 检查放在更新条件中，同一个断言并发提交时只有一次能成功
+	query := db.Model(&models.WebAuthnCredential{}).Where("id = ?", credential.ID)
+	if signCount == 0 {
+		query = query.Where("sign_count = 0")
+	} else {
+		query = query.Where("sign_count < ?", signCount)
+	}
+	result := query.Updates(map[string]interface{}{
+		"sign_count":   signCount,
+		"last_used_at": time.Now(),
+	})
+	if result.Error != nil {
+		return models.User{}, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return models.User{}, ErrWebAuthnVerification
+	}
+
+	var user models.User
+	if err := db.First(&user, credential.UserID).Error; err != nil {
+		return models.User{}, err
+	}
+	return user, nil
+}
+
+func createWebAuthnChallenge(db *gorm.DB, userID uint, purpose string) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	challenge := base64.RawURLEncoding.EncodeToString(raw)
+
+	record := models.WebAuthnChallenge{
+		UserID:        userID,
+		Purpose:       purpose,
+		ChallengeHash: hashWebAuthnChallenge(challenge),
+		ExpiresAt:     time.Now().Add(webAuthnChallengeTTL),
+	}
+	if err := db.Create(&record).Error; err != nil {
+		return "", err
+	}
+	if err := db.Unscoped().Where("expires_at < ?", time.Now()).Delete(&models.WebAuthnChallenge{}).Error; err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+// 校验类型、来源和挑战，挑战只能使用一次
+func verifyClientData(db *gorm.DB, rp WebAuthnRP, clientDataJSON []byte, ceremony string, purpose string, userID uint) error {
+	var data clientData
+	if err := json.Unmarshal(clientDataJSON, &data); err != nil {
+		return ErrWebAuthnVerification
+	}
+	if data.Type != ceremony || !originAllowed(rp, data.Origin) {
+		return ErrWebAuthnVerification
+	}
+
+	result := db.Unscoped().
+		Where("challenge_hash = ? AND purpose = ? AND user_id = ? AND expires_at > ?", hashWebAuthnChallenge(data.Challenge), purpose, userID, time.Now()).
+		Delete(&models.WebAuthnChallenge{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrWebAuthnVerification
+	}
+	return nil
+}
+
+func originAllowed(rp WebAuthnRP, origin string) bool {
+	for _, allowed := range rp.Origins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// 校验 RP ID 哈希和用户在场标志，返回标志位和签名计数
+func verifyAuthenticatorData(rp WebAuthnRP, authData []byte) (byte, uint32, error) {
+	if len(authData) < 37 {
+		return 0, 0, ErrWebAuthnVerification
+	}
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(authData[:32], rpIDHash[:]) {
+		return 0, 0, ErrWebAuthnVerification
+	}
+	flags := authData[32]
+	if flags&authDataFlagUserPresent == 0 {
+		return 0, 0, ErrWebAuthnVerification
+	}
+	return flags, binary.BigEndian.Uint32(authData[33:37]), nil
+}
+
+// 支持 ES256（P-256）和 RS256 两种 COSE 公钥
+func parseCOSEKey(decoded interface{}) (crypto.PublicKey, error) {
+	key, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrWebAuthnVerification
+	}
+	alg, _ := key[int64(3)].(int64)
+
+	switch alg {
+	case coseAlgES256:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, ErrWebAuthnVerification
+		}
+		publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+			return nil, ErrWebAuthnVerification
+		}
+		return publicKey, nil
+	case coseAlgRS256:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, ErrWebAuthnVerification
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, nil
+	}
+	return nil, fmt.Errorf("%w: unsupported key algorithm %d", ErrWebAuthnVerification, alg)
+}
+
+func verifyWebAuthnSignature(publicKey crypto.PublicKey, signed []byte, signature []byte) bool {
+	digest := sha256.Sum256(signed)
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, digest[:], signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	}
+	return false
+}
+
+func credentialDescriptors(credentials []models.WebAuthnCredential) []webAuthnCredentialDescriptor {
+	descriptors := make([]webAuthnCredentialDescriptor, 0, len(credentials))
+	for _, credential := range credentials {
+		descriptor := webAuthnCredentialDescriptor{Type: "public-key", ID: credential.CredentialID}
+		if credential.Transports != "" {
+			descriptor.Transports = strings.Split(credential.Transports, ",")
+		}
+		descriptors = append(descriptors, descriptor)
+	}
+	return descriptors
+}
+
+// 用户句柄只使用用户 ID，不包含用户名等个人信息
+func webAuthnUserHandle(userID uint) []byte {
+	handle := make([]byte, 8)
+	binary.BigEndian.PutUint64(handle, uint64(userID))
+	return handle
+}
+
+func hashWebAuthnChallenge(challenge string) string {
+	sum := sha256.Sum256([]byte(challenge))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,299 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"anonymail/models"
+
+	"gorm.io/gorm"
+)
+
+var testRP = WebAuthnRP{ID: "mail.example.com", Origins: []string{"https://mail.example.com"}}
+
+// 测试用的软件认证器，使用 P-256 密钥
+type testAuthenticator struct {
+	t            *testing.T
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+}
+
+func newTestAuthenticator(t *testing.T) *testAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialID := make([]byte, 16)
+	if _, err := rand.Read(credentialID); err != nil {
+		t.Fatal(err)
+	}
+	return &testAuthenticator{t: t, key: key, credentialID: credentialID}
+}
+
+func (a *testAuthenticator) coseKey() []byte {
+	return cborMap(
+		cborInt(1), cborInt(2),
+		cborInt(3), cborInt(coseAlgES256),
+		cborInt(-1), cborInt(1),
+		cborInt(-2), cborBytes(a.key.X.FillBytes(make([]byte, 32))),
+		cborInt(-3), cborBytes(a.key.Y.FillBytes(make([]byte, 32))),
+	)
+}
+
+func testAuthData(rpID string, flags byte, signCount uint32) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	authData := append(rpIDHash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(authData[33:], signCount)
+	return authData
+}
+
+func testClientData(t *testing.T, ceremony string, challenge string, origin string) []byte {
+	t.Helper()
+	encoded, err := json.Marshal(clientData{Type: ceremony, Challenge: challenge, Origin: origin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func (a *testAuthenticator) attestation(rpID string, origin string, challenge string) WebAuthnAttestation {
+	authData := testAuthData(rpID, authDataFlagUserPresent|authDataFlagUserVerified|authDataFlagAttested, 0)
+	authData = append(authData, make([]byte, 16)...)
+	authData = append(authData, byte(len(a.credentialID)>>8), byte(len(a.credentialID)))
+	authData = append(authData, a.credentialID...)
+	authData = append(authData, a.coseKey()...)
+
+	var attestation WebAuthnAttestation
+	attestation.ID = b64(a.credentialID)
+	attestation.Type = "public-key"
+	attestation.Response.ClientDataJSON = b64(testClientData(a.t, "webauthn.create", challenge, origin))
+	attestation.Response.AttestationObject = b64(cborMap(
+		cborText("fmt"), cborText("none"),
+		cborText("attStmt"), cborMap(),
+		cborText("authData"), cborBytes(authData),
+	))
+	return attestation
+}
+
+func (a *testAuthenticator) assertion(rpID string, origin string, challenge string, flags byte, signCount uint32) WebAuthnAssertion {
+	authData := testAuthData(rpID, flags, signCount)
+	clientDataJSON := testClientData(a.t, "webauthn.get", challenge, origin)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	var assertion WebAuthnAssertion
+	assertion.ID = b64(a.credentialID)
+	assertion.Type = "public-key"
+	assertion.Response.ClientDataJSON = b64(clientDataJSON)
+	assertion.Response.AuthenticatorData = b64(authData)
+	assertion.Response.Signature = b64(signature)
+	return assertion
+}
+
+func registerTestAuthenticator(t *testing.T, db *gorm.DB, user models.User) *testAuthenticator {
+	t.Helper()
+	authenticator := newTestAuthenticator(t)
+	options, err := BeginWebAuthnRegistration(db, testRP, user)
+	if err != nil {
+		t.Fatalf("begin registration: %v", err)
+	}
+	attestation := authenticator.attestation(testRP.ID, testRP.Origins[0], options.Challenge)
+	if _, err := FinishWebAuthnRegistration(db, testRP, user, "test key", attestation); err != nil {
+		t.Fatalf("finish registration: %v", err)
+	}
+	return authenticator
+}
+
+func createTestUser(t *testing.T, db *gorm.DB, username string) models.User {
+	t.Helper()
+	user := models.User{Username: username}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func beginTestLogin(t *testing.T, db *gorm.DB, userID uint) string {
+	t.Helper()
+	options, err := BeginWebAuthnLogin(db, testRP, userID)
+	if err != nil {
+		t.Fatalf("begin login: %v", err)
+	}
+	return options.Challenge
+}
+
+func TestWebAuthnRegistrationRejectsInvalidData(t *testing.T) {
+	db := openTestDB(t)
+	user := createTestUser(t, db, "alice")
+	authenticator := newTestAuthenticator(t)
+
+	tests := []struct {
+		name   string
+		rpID   string
+		origin string
+	}{
+		{"wrong rp id hash", "evil.example.com", testRP.Origins[0]},
+		{"wrong origin", testRP.ID, "https://evil.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options, err := BeginWebAuthnRegistration(db, testRP, user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			attestation := authenticator.attestation(tt.rpID, tt.origin, options.Challenge)
+			if _, err := FinishWebAuthnRegistration(db, testRP, user, "key", attestation); err == nil {
+				t.Fatal("registration accepted")
+			}
+		})
+	}
+
+	// 挑战只能使用一次
+	options, err := BeginWebAuthnRegistration(db, testRP, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attestation := authenticator.attestation(testRP.ID, testRP.Origins[0], options.Challenge)
+	if _, err := FinishWebAuthnRegistration(db, testRP, user, "key", attestation); err != nil {
+		t.Fatalf("valid registration rejected: %v", err)
+	}
+	authenticator.credentialID[0]++
+	attestation = authenticator.attestation(testRP.ID, testRP.Origins[0], options.Challenge)
+	if _, err := FinishWebAuthnRegistration(db, testRP, user, "key", attestation); err == nil {
+		t.Fatal("registration with a reused challenge accepted")
+	}
+}
+
+func TestWebAuthnLogin(t *testing.T) {
+	db := openTestDB(t)
+	user := createTestUser(t, db, "alice")
+	authenticator := registerTestAuthenticator(t, db, user)
+	origin := testRP.Origins[0]
+
+	challenge := beginTestLogin(t, db, user.ID)
+	assertion := authenticator.assertion(testRP.ID, origin, challenge, authDataFlagUserPresent, 5)
+	got, err := FinishWebAuthnLogin(db, testRP, user.ID, assertion)
+	if err != nil {
+		t.Fatalf("valid assertion rejected: %v", err)
+	}
+	if got.ID != user.ID {
+		t.Fatalf("got user %d, want %d", got.ID, user.ID)
+	}
+
+	// 重复使用已完成的挑战，签名计数正常增长也应失败
+	reused := authenticator.assertion(testRP.ID, origin, challenge, authDataFlagUserPresent, 6)
+	if _, err := FinishWebAuthnLogin(db, testRP, user.ID, reused); err == nil {
+		t.Fatal("assertion with a reused challenge accepted")
+	}
+
+	tests := []struct {
+		name      string
+		rpID      string
+		origin    string
+		flags     byte
+		signCount uint32
+	}{
+		{"wrong rp id hash", "evil.example.com", origin, authDataFlagUserPresent, 10},
+		{"wrong origin", testRP.ID, "https://evil.example.com", authDataFlagUserPresent, 10},
+		{"user not present", testRP.ID, origin, 0, 10},
+		{"sign count not increased", testRP.ID, origin, authDataFlagUserPresent, 5},
+		{"sign count regression", testRP.ID, origin, authDataFlagUserPresent, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertion := authenticator.assertion(tt.rpID, tt.origin, beginTestLogin(t, db, user.ID), tt.flags, tt.signCount)
+			if _, err := FinishWebAuthnLogin(db, testRP, user.ID, assertion); err == nil {
+				t.Fatal("assertion accepted")
+			}
+		})
+	}
+
+	t.Run("bad signature", func(t *testing.T) {
+		assertion := authenticator.assertion(testRP.ID, origin, beginTestLogin(t, db, user.ID), authDataFlagUserPresent, 10)
+		signature, _ := base64.RawURLEncoding.DecodeString(assertion.Response.Signature)
+		signature[len(signature)-1] ^= 0xff
+		assertion.Response.Signature = b64(signature)
+		if _, err := FinishWebAuthnLogin(db, testRP, user.ID, assertion); err == nil {
+			t.Fatal("assertion with a bad signature accepted")
+		}
+	})
+
+	t.Run("key of another user", func(t *testing.T) {
+		other := createTestUser(t, db, "bob")
+		registerTestAuthenticator(t, db, other)
+		assertion := authenticator.assertion(testRP.ID, origin, beginTestLogin(t, db, other.ID), authDataFlagUserPresent, 10)
+		if _, err := FinishWebAuthnLogin(db, testRP, other.ID, assertion); err == nil {
+			t.Fatal("assertion for another user accepted")
+		}
+	})
+
+	// 失败的尝试不能更新签名计数
+	assertion = authenticator.assertion(testRP.ID, origin, beginTestLogin(t, db, user.ID), authDataFlagUserPresent, 6)
+	if _, err := FinishWebAuthnLogin(db, testRP, user.ID, assertion); err != nil {
+		t.Fatalf("valid assertion rejected after failed attempts: %v", err)
+	}
+}
+
+func TestWebAuthnLoginConcurrentSignCount(t *testing.T) {
+	db := openTestDB(t)
+	user := createTestUser(t, db, "alice")
+	authenticator := registerTestAuthenticator(t, db, user)
+	origin := testRP.Origins[0]
+
+	// 克隆的密钥用相同的签名计数登录：在读取凭证之后、更新之前，另一次登录已经把计数更新为 7
+	err := db.Callback().Update().Before("gorm:update").Register("test:concurrent_login", func(tx *gorm.DB) {
+		if tx.Statement.Table == "web_authn_credentials" {
+			tx.Statement.ConnPool.ExecContext(tx.Statement.Context, "UPDATE web_authn_credentials SET sign_count = 7")
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertion := authenticator.assertion(testRP.ID, origin, beginTestLogin(t, db, user.ID), authDataFlagUserPresent, 7)
+	if _, err := FinishWebAuthnLogin(db, testRP, user.ID, assertion); err == nil {
+		t.Fatal("assertion accepted although the sign count was already used")
+	}
+}
+
+func TestPasskeyLoginRequiresUserVerification(t *testing.T) {
+	db := openTestDB(t)
+	user := createTestUser(t, db, "alice")
+	authenticator := registerTestAuthenticator(t, db, user)
+	origin := testRP.Origins[0]
+
+	assertion := authenticator.assertion(testRP.ID, origin, beginTestLogin(t, db, 0), authDataFlagUserPresent, 1)
+	if _, err := FinishWebAuthnLogin(db, testRP, 0, assertion); err == nil {
+		t.Fatal("passkey login without user verification accepted")
+	}
+
+	// 第二步验证的挑战不能用于无密码登录
+	assertion = authenticator.assertion(testRP.ID, origin, beginTestLogin(t, db, user.ID), authDataFlagUserPresent|authDataFlagUserVerified, 2)
+	if _, err := FinishWebAuthnLogin(db, testRP, 0, assertion); err == nil {
+		t.Fatal("second factor challenge accepted for passkey login")
+	}
+
+	assertion = authenticator.assertion(testRP.ID, origin, beginTestLogin(t, db, 0), authDataFlagUserPresent|authDataFlagUserVerified, 3)
+	assertion.Response.UserHandle = b64(webAuthnUserHandle(user.ID))
+	got, err := FinishWebAuthnLogin(db, testRP, 0, assertion)
+	if err != nil {
+		t.Fatalf("valid passkey login rejected: %v", err)
+	}
+	if got.ID != user.ID {
+		t.Fatalf("got user %d, want %d", got.ID, user.ID)
+	}
+}
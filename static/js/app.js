@@ -24,13 +24,54 @@ function translateError(error) {
     return errorMessages[locale][error] || error;
 }
 
+// WebAuthn 参数中的二进制字段使用 base64url 编码传输
+function base64urlToBuffer(value) {
+    const base64 = value.replace(/-/g, '+').replace(/_/g, '/');
+    const binary = atob(base64 + '='.repeat((4 - base64.length % 4) % 4));
+    return Uint8Array.from(binary, c => c.charCodeAt(0)).buffer;
+}
+
+function bufferToBase64url(buffer) {
+    const binary = String.fromCharCode.apply(null, new Uint8Array(buffer));
+    return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+
+// 调用浏览器进行安全密钥认证，返回可直接提交给后端的结果
+async function getWebAuthnAssertion(publicKey) {
+    publicKey.challenge = base64urlToBuffer(publicKey.challenge);
+    publicKey.allowCredentials = publicKey.allowCredentials.map(c => Object.assign({}, c, { id: base64urlToBuffer(c.id) }));
+    const credential = await navigator.credentials.get({ publicKey });
+    return {
+        id: credential.id,
+        type: credential.type,
+        response: {
+            clientDataJSON: bufferToBase64url(credential.response.clientDataJSON),
+            authenticatorData: bufferToBase64url(credential.response.authenticatorData),
+            signature: bufferToBase64url(credential.response.signature),
+            userHandle: credential.response.userHandle ? bufferToBase64url(credential.response.userHandle) : ''
+        }
+    };
+}
+
 // 修改所有组件，使用 $t 函数进行翻译
 // 例如：
 Vue.component('login-form', {
     template: `
         <div class="bg-white shadow-md rounded px-8 pt-6 pb-8 mb-4">
             <h2 class="text-2xl font-bold mb-6 text-center">{{ $t('login') }}</h2>
-            <form @submit.prevent="login">
+            <form v-if="mfaToken" @submit.prevent="verifySecondFactor">
+                <div v-if="mfaMethods.includes('totp')" class="mb-4">
+                    <input v-model="mfaCode" class="shadow appearance-none border rounded w-full py-2 px-3 text-gray-700 leading-tight focus:outline-none focus:shadow-outline" type="text" autocomplete="one-time-code" :placeholder="$t('twoFactorCodeOrRecovery')" required>
+                </div>
+                <div class="flex items-center justify-between">
+                    <button v-if="mfaMethods.includes('totp')" class="bg-blue-500 hover:bg-blue-700 text-white font-bold py-2 px-4 rounded focus:outline-none focus:shadow-outline" type="submit">{{ $t('verify') }}</button>
+                    <button v-if="mfaMethods.includes('webauthn')" @click="verifySecurityKey" class="btn btn-green" type="button">{{ $t('useSecurityKey') }}</button>
+                    <a @click="mfaToken = ''" class="inline-block align-baseline font-bold text-sm text-blue-500 hover:text-blue-800 cursor-pointer">
+                        {{ $t('back') }}
+                    </a>
+                </div>
+            </form>
+            <form v-else-if="providers.password_login" @submit.prevent="login">
                 <div class="mb-4">
                     <input v-model="username" class="shadow appearance-none border rounded w-full py-2 px-3 text-gray-700 leading-tight focus:outline-none focus:shadow-outline" type="text" :placeholder="$t('username')" required>
                 </div>
@@ -39,19 +80,37 @@ Vue.component('login-form', {
                 </div>
                 <div class="flex items-center justify-between">
                     <button class="bg-blue-500 hover:bg-blue-700 text-white font-bold py-2 px-4 rounded focus:outline-none focus:shadow-outline" type="submit">{{ $t('loginButton') }}</button>
-                    <a @click="$emit('switch-to-register')" class="inline-block align-baseline font-bold text-sm text-blue-500 hover:text-blue-800 cursor-pointer">
+                    <button v-if="webAuthnSupported" @click="loginWithPasskey" class="btn btn-green" type="button">{{ $t('loginWithPasskey') }}</button>
+                    <a v-if="providers.registration !== 'closed'" @click="$emit('switch-to-register')" class="inline-block align-baseline font-bold text-sm text-blue-500 hover:text-blue-800 cursor-pointer">
                         {{ $t('register') }}
                     </a>
                 </div>
             </form>
+            <div v-if="!mfaToken && (providers.oidc || !providers.password_login)" class="flex items-center justify-center mt-4">
+                <a v-if="providers.oidc" href="/oidc/login" class="btn btn-blue mr-2">{{ $t('loginWithSSO', { name: providers.oidc_name }) }}</a>
+                <button v-if="!providers.password_login && webAuthnSupported" @click="loginWithPasskey" class="btn btn-green" type="button">{{ $t('loginWithPasskey') }}</button>
+            </div>
         </div>
     `,
     data() {
         return {
             username: '',
-            password: ''
+            password: '',
+            mfaToken: '',
+            mfaCode: '',
+            mfaMethods: [],
+            webAuthnSupported: !!window.PublicKeyCredential,
+            providers: { password_login: true, oidc: false, oidc_name: '', registration: 'open' }
         };
     },
+    async mounted() {
+        try {
+            const response = await axios.get('/auth/providers');
+            this.providers = response.data;
+        } catch (error) {
+            console.error('获取登录方式失败:', error);
+        }
+    },
     methods: {
         handleError(errorKey, error) {
             console.error(this.$t(errorKey), error);
@@ -64,10 +123,58 @@ Vue.component('login-form', {
                     password: this.password
                 });
                 console.log('Login response:', response.data);
+                if (response.data.mfa_required) {
+                    // 需要输入两步验证码
+                    this.mfaToken = response.data.mfa_token;
+                    this.mfaMethods = response.data.mfa_methods;
+                    this.mfaCode = '';
+                    return;
+                }
                 this.$emit('login-success', response.data.user, response.data.token);
             } catch (error) {
                 this.handleError('loginFailed', error);
             }
+        },
+        async verifySecondFactor() {
+            // 6 位数字为验证器中的验证码，否则视为恢复码
+            const code = this.mfaCode.trim();
+            const payload = { mfa_token: this.mfaToken };
+            if (/^\d{6}$/.test(code)) {
+                payload.code = code;
+            } else {
+                payload.recovery_code = code;
+            }
+            try {
+                const response = await axios.post('/login/2fa', payload);
+                this.mfaToken = '';
+                this.$emit('login-success', response.data.user, response.data.token);
+            } catch (error) {
+                if (error.response && error.response.status === 401 && error.response.data.error !== 'Invalid two-factor code') {
+                    this.mfaToken = '';
+                }
+                this.handleError('twoFactorFailed', error);
+            }
+        },
+        async verifySecurityKey() {
+            try {
+                const options = await axios.post('/login/webauthn/options', { mfa_token: this.mfaToken });
+                const assertion = await getWebAuthnAssertion(options.data.publicKey);
+                const response = await axios.post('/login/2fa', { mfa_token: this.mfaToken, webauthn: assertion });
+                this.mfaToken = '';
+                this.$emit('login-success', response.data.user, response.data.token);
+            } catch (error) {
+                this.handleError('securityKeyFailed', error);
+            }
+        },
+        async loginWithPasskey() {
+            try {
+                const options = await axios.post('/login/webauthn/options', {});
+                const assertion = await getWebAuthnAssertion(options.data.publicKey);
+                const response = await axios.post('/login/passkey', assertion);
+                this.$emit('login-success', response.data.user, response.data.token);
+            } catch (error) {
+                this.handleError('securityKeyFailed', error);
+            }
         }
     }
 });
@@ -83,6 +190,7 @@ Vue.component('register-form', {
                 </div>
                 <div class="mb-6">
                     <input v-model="password" class="shadow appearance-none border rounded w-full py-2 px-3 text-gray-700 mb-3 leading-tight focus:outline-none focus:shadow-outline" type="password" :placeholder="$t('password')" required>
+                    <input v-model="inviteCode" class="shadow appearance-none border rounded w-full py-2 px-3 text-gray-700 leading-tight focus:outline-none focus:shadow-outline" type="text" :placeholder="$t('inviteCode')">
                 </div>
                 <div class="flex items-center justify-between">
                     <button class="bg-green-500 hover:bg-green-700 text-white font-bold py-2 px-4 rounded focus:outline-none focus:shadow-outline" type="submit">{{ $t('registerButton') }}</button>
@@ -96,7 +204,8 @@ Vue.component('register-form', {
     data() {
         return {
             username: '',
-            password: ''
+            password: '',
+            inviteCode: ''
         };
     },
     methods: {
@@ -106,15 +215,22 @@ Vue.component('register-form', {
         },
         async register() {
             try {
-                await axios.post('/register', {
+                const response = await axios.post('/register', {
                     username: this.username,
-                    password: this.password
+                    password: this.password,
+                    invite_code: this.inviteCode
                 });
-                alert(this.$t('registerSuccess'));
+                alert(this.$t(response.data.pending_approval ? 'registerPendingApproval' : 'registerSuccess'));
                 this.$emit('switch-to-login');
                 this.username = '';
                 this.password = '';
+                this.inviteCode = '';
             } catch (error) {
+                // 注册关闭、邀请码无效或密码不符合策略时显示服务端返回的原因
+                if (error.response && error.response.data.error) {
+                    alert(this.$t('registerFailed') + ': ' + error.response.data.error);
+                    return;
+                }
                 this.handleError('registerFailed', error);
             }
         }
@@ -162,13 +278,22 @@ Vue.component('address-generator', {
                     <select v-model="selectedTokenId" class="shadow appearance-none border rounded w-full py-2 px-3 text-gray-700 leading-tight focus:outline-none focus:shadow-outline">
                         <option value="">{{ $t('selectToken') }}</option>
                         <option v-for="token in tokens" :key="token.ID" :value="token.ID">
-                            {{ token.Description || token.Value }}
+                            {{ token.Description || token.MaskedValue }}
                         </option>
+                        <optgroup v-for="organization in organizations" :key="'org-' + organization.ID" :label="organization.Name">
+                            <option v-for="token in organization.tokens" :key="token.ID" :value="token.ID">
+                                {{ token.Description || $t('organizationToken') }}
+                            </option>
+                        </optgroup>
                     </select>
                 </div>
                 <div class="flex items-center justify-center">
                     <button class="btn btn-blue px-6 py-3 rounded-lg shadow-lg hover:shadow-xl transition duration-300" type="submit">{{ $t('generateButton') }}</button>
                 </div>
+                <p v-if="quota && (quota.MaxAddresses || quota.AddressesPerDay)" class="mt-2 text-sm text-gray-600 text-center">
+                    <span v-if="quota.MaxAddresses">{{ $t('aliasQuota', { used: quota.Addresses, limit: quota.MaxAddresses }) }}</span>
+                    <span v-if="quota.AddressesPerDay">{{ $t('dailyAliasQuota', { used: quota.AddressesToday, limit: quota.AddressesPerDay }) }}</span>
+                </p>
             </form>
             <div v-if="generatedAddress" class="mt-4 p-4 bg-green-100 border-l-4 border-green-500 text-green-700">
                 <p>{{ $t('generatedAddress') }}：{{ generatedAddress }}</p>
@@ -181,11 +306,15 @@ Vue.component('address-generator', {
             realAddress: '',
             generatedAddress: '',
             selectedTokenId: '',
-            tokens: []
+            tokens: [],
+            organizations: [],
+            quota: null
         };
     },
     mounted() {
         this.fetchTokens();
+        this.fetchOrganizationTokens();
+        this.fetchQuota();
     },
     methods: {
         handleError(errorKey, error) {
@@ -198,6 +327,37 @@ Vue.component('address-generator', {
                     headers: { 'Authorization': localStorage.getItem('token') }
                 });
                 this.tokens = response.data.tokens;
+                const defaultToken = this.tokens.find(token => token.IsDefault);
+                if (!this.selectedTokenId && defaultToken) {
+                    this.selectedTokenId = defaultToken.ID;
+                }
+            } catch (error) {
+                this.handleError('fetchTokensFailed', error);
+            }
+        },
+        async fetchQuota() {
+            try {
+                const response = await axios.get('/quota', {
+                    headers: { 'Authorization': localStorage.getItem('token') }
+                });
+                this.quota = response.data.quota;
+            } catch (error) {
+                console.error(error);
+            }
+        },
+        // 组织共享的 Token，只显示描述
+        async fetchOrganizationTokens() {
+            try {
+                const headers = { 'Authorization': localStorage.getItem('token') };
+                const response = await axios.get('/organizations', { headers });
+                const organizations = [];
+                for (const organization of response.data.organizations) {
+                    const tokens = await axios.get(`/organization/${organization.ID}/tokens`, { headers });
+                    if (tokens.data.tokens.length) {
+                        organizations.push({ ...organization, tokens: tokens.data.tokens });
+                    }
+                }
+                this.organizations = organizations;
             } catch (error) {
                 this.handleError('fetchTokensFailed', error);
             }
@@ -207,16 +367,24 @@ Vue.component('address-generator', {
                 alert(this.$t('selectToken'));
                 return;
             }
+            const organization = this.organizations.find(org => org.tokens.some(token => token.ID === this.selectedTokenId));
             try {
                 const response = await axios.post('/generate-address', {
                     real_address: this.realAddress,
-                    token_id: this.selectedTokenId
+                    token_id: this.selectedTokenId,
+                    organization_id: organization ? organization.ID : 0
                 }, {
                     headers: { 'Authorization': localStorage.getItem('token') }
                 });
                 this.generatedAddress = response.data.generated_address;
                 this.$emit('address-generated');
+                this.fetchQuota();
             } catch (error) {
+                // 超出配额时显示服务端返回的具体原因
+                if (error.response && error.response.data.quota) {
+                    alert(error.response.data.error);
+                    return;
+                }
                 this.handleError('generateAddressFailed', error);
             }
         },
@@ -253,16 +421,43 @@ Vue.component('address-list', {
                         <td class="px-6 py-4 whitespace-nowrap text-sm text-gray-500">{{ address.RealAddress || '-' }}</td>
                         <td class="px-6 py-4 whitespace-nowrap text-sm text-gray-500">{{ address.TokenDescription || '-' }}</td>
                         <td class="px-6 py-4 whitespace-nowrap text-right text-sm font-medium">
+                            <button @click="shareAddress(address.ID)" class="text-blue-600 hover:text-blue-900 mr-2">{{ $t('share') }}</button>
                             <button @click="deleteAddress(address.ID)" class="text-red-600 hover:text-red-900">{{ $t('delete') }}</button>
                         </td>
                     </tr>
                 </tbody>
             </table>
+            <div v-if="sharedAddresses.length > 0" class="mt-8">
+                <h3 class="text-xl font-semibold mb-4">{{ $t('sharedWithMe') }}</h3>
+                <table class="address-list-table min-w-full divide-y divide-gray-200">
+                    <thead class="bg-gray-50">
+                        <tr>
+                            <th class="px-6 py-3 text-left text-xs font-medium text-gray-500 uppercase tracking-wider">{{ $t('aliasAddress') }}</th>
+                            <th class="px-6 py-3 text-left text-xs font-medium text-gray-500 uppercase tracking-wider">{{ $t('realRecipient') }}</th>
+                            <th class="px-6 py-3 text-left text-xs font-medium text-gray-500 uppercase tracking-wider">{{ $t('sharedBy') }}</th>
+                            <th class="px-6 py-3 text-left text-xs font-medium text-gray-500 uppercase tracking-wider">{{ $t('actions') }}</th>
+                        </tr>
+                    </thead>
+                    <tbody class="bg-white divide-y divide-gray-200">
+                        <tr v-for="address in sharedAddresses" :key="address.ID">
+                            <td class="px-6 py-4 whitespace-nowrap text-sm text-gray-900">{{ address.ConvertedAddress }}</td>
+                            <td class="px-6 py-4 whitespace-nowrap text-sm text-gray-500">{{ address.RealAddress || '-' }}</td>
+                            <td class="px-6 py-4 whitespace-nowrap text-sm text-gray-500">{{ address.Owner }}</td>
+                            <td class="px-6 py-4 whitespace-nowrap text-right text-sm font-medium">
+                                <button v-if="address.Permission === 'edit'" @click="editRecipient(address)" class="text-blue-600 hover:text-blue-900 mr-2">{{ $t('editRecipient') }}</button>
+                                <button @click="leaveShare(address.ID)" class="text-red-600 hover:text-red-900">{{ $t('removeShare') }}</button>
+                            </td>
+                        </tr>
+                    </tbody>
+                </table>
+            </div>
         </div>
     `,
     data() {
         return {
-            addresses: []
+            addresses: [],
+            sharedAddresses: [],
+            currentUserId: null
         };
     },
     mounted() {
@@ -279,10 +474,56 @@ Vue.component('address-list', {
                     headers: { 'Authorization': localStorage.getItem('token') }
                 });
                 this.addresses = response.data.addresses;
+                this.sharedAddresses = response.data.shared_with_me || [];
             } catch (error) {
                 this.handleError('fetchAddressesFailed', error);
             }
         },
+        async shareAddress(id) {
+            const username = prompt(this.$t('shareWithUsername'));
+            if (!username) {
+                return;
+            }
+            const permission = confirm(this.$t('shareAllowEdit')) ? 'edit' : 'view';
+            try {
+                await axios.post(`/address/${id}/shares`, { username, permission }, {
+                    headers: { 'Authorization': localStorage.getItem('token') }
+                });
+                alert(this.$t('addressShared'));
+            } catch (error) {
+                this.handleError('shareAddressFailed', error);
+            }
+        },
+        async editRecipient(address) {
+            const realAddress = prompt(this.$t('realAddress'), address.RealAddress);
+            if (realAddress === null) {
+                return;
+            }
+            try {
+                await axios.put(`/address/${address.ID}`, { real_address: realAddress }, {
+                    headers: { 'Authorization': localStorage.getItem('token') }
+                });
+                this.fetchAddresses();
+            } catch (error) {
+                this.handleError('shareAddressFailed', error);
+            }
+        },
+        async leaveShare(id) {
+            try {
+                if (!this.currentUserId) {
+                    const response = await axios.get('/check-auth', {
+                        headers: { 'Authorization': localStorage.getItem('token') }
+                    });
+                    this.currentUserId = response.data.user.id;
+                }
+                await axios.delete(`/address/${id}/share/${this.currentUserId}`, {
+                    headers: { 'Authorization': localStorage.getItem('token') }
+                });
+                this.fetchAddresses();
+            } catch (error) {
+                this.handleError('shareAddressFailed', error);
+            }
+        },
         async deleteAddress(id) {
             if (confirm(this.$t('confirmDeleteAddress'))) {
                 try {
@@ -316,15 +557,19 @@ Vue.component('token-manager', {
                 <ul class="divide-y divide-gray-200">
                     <li v-for="token in tokens" :key="token.ID" class="py-2 flex justify-between items-center">
                         <div>
-                            <p class="font-medium">{{ token.Description || 'Token' }}</p>
+                            <p class="font-medium">
+                                {{ token.Description || 'Token' }}
+                                <span v-if="token.IsDefault" class="text-xs text-green-600 ml-1">{{ $t('defaultToken') }}</span>
+                            </p>
                             <p class="text-sm text-gray-500">
-                                {{ showTokenValue[token.ID] ? token.Value : '••••••••' }}
+                                {{ revealedTokens[token.ID] || token.MaskedValue }}
                                 <button @click="toggleTokenVisibility(token.ID)" class="btn btn-gray ml-2 px-3 py-1 rounded-md shadow-sm hover:shadow-md transition duration-300">
-                                    {{ showTokenValue[token.ID] ? $t('showHide') : $t('showHide') }}
+                                    {{ $t('showHide') }}
                                 </button>
                             </p>
                         </div>
                         <div>
+                            <button v-if="!token.IsDefault" @click="setDefaultToken(token.ID)" class="btn btn-green ml-2 px-4 py-2 rounded-lg shadow-md hover:shadow-lg transition duration-300">{{ $t('setDefault') }}</button>
                             <button @click="deleteToken(token.ID)" class="btn btn-red ml-2 px-4 py-2 rounded-lg shadow-md hover:shadow-lg transition duration-300">{{ $t('delete') }}</button>
                         </div>
                     </li>
@@ -341,7 +586,7 @@ Vue.component('token-manager', {
                 description: ''
             },
             showNewToken: false,
-            showTokenValue: {}
+            revealedTokens: {}
         };
     },
     mounted() {
@@ -358,9 +603,7 @@ Vue.component('token-manager', {
                     headers: { 'Authorization': localStorage.getItem('token') }
                 });
                 this.tokens = response.data.tokens;
-                this.tokens.forEach(token => {
-                    this.$set(this.showTokenValue, token.ID, false);
-                });
+                this.revealedTokens = {};
             } catch (error) {
                 this.handleError('fetchTokensFailed', error);
             }
@@ -379,11 +622,42 @@ Vue.component('token-manager', {
                 alert(this.$t('tokenAdded'));
                 this.$emit('token-added'); // 发射事件
             } catch (error) {
+                if (error.response && error.response.data.quota) {
+                    alert(error.response.data.error);
+                    return;
+                }
                 this.handleError('tokenAddFailed', error);
             }
         },
-        toggleTokenVisibility(tokenId) {
-            this.$set(this.showTokenValue, tokenId, !this.showTokenValue[tokenId]);
+        async toggleTokenVisibility(tokenId) {
+            if (this.revealedTokens[tokenId]) {
+                this.$delete(this.revealedTokens, tokenId);
+                return;
+            }
+            const password = prompt(this.$t('reenterPassword'));
+            // 单点登录用户没有密码，可以留空
+            if (password === null) {
+                return;
+            }
+            try {
+                const response = await axios.post(`/reveal-token/${tokenId}`, { password }, {
+                    headers: { 'Authorization': localStorage.getItem('token') }
+                });
+                this.$set(this.revealedTokens, tokenId, response.data.value);
+            } catch (error) {
+                this.handleError('revealTokenFailed', error);
+            }
+        },
+        async setDefaultToken(tokenId) {
+            try {
+                await axios.post(`/set-default-token/${tokenId}`, {}, {
+                    headers: { 'Authorization': localStorage.getItem('token') }
+                });
+                await this.fetchTokens();
+                this.$emit('token-added');
+            } catch (error) {
+                this.handleError('setDefaultTokenFailed', error);
+            }
         },
         async deleteToken(tokenId) {
             if (!confirm(this.$t('confirmDeleteToken'))) {
@@ -467,11 +741,14 @@ Vue.component('admin-change-password', {
 
 // 管理员面板组件
 Vue.component('admin-panel', {
+    props: {
+        permissions: { type: Array, default: () => [] }
+    },
     template: `
         <div class="bg-white shadow-md rounded px-8 pt-6 pb-8 mb-4">
             <h2 class="text-2xl font-bold mb-6">{{ $t('adminPanel') }}</h2>
             <h3 class="text-xl font-semibold mb-4">{{ $t('userManagement') }}</h3>
-            <div class="mb-8">
+            <div v-if="can('users:manage')" class="mb-8">
                 <button @click="showCreateUserForm = !showCreateUserForm" class="btn btn-blue px-6 py-3 rounded-lg shadow-lg hover:shadow-xl transition duration-300">
                     {{ showCreateUserForm ? $t('hideCreateUserForm') : $t('createUser') }}
                 </button>
@@ -480,7 +757,7 @@ Vue.component('admin-panel', {
                 <h4 class="text-lg font-semibold mb-2">{{ $t('createUser') }}</h4>
                 <input v-model="newUser.username" :placeholder="$t('newUsername')" class="shadow appearance-none border rounded w-full py-2 px-3 text-gray-700 leading-tight focus:outline-none focus:shadow-outline mb-2">
                 <input v-model="newUser.password" type="password" :placeholder="$t('newPassword')" class="shadow appearance-none border rounded w-full py-2 px-3 text-gray-700 leading-tight focus:outline-none focus:shadow-outline mb-2">
-                <label class="inline-flex items-center mb-2">
+                <label v-if="can('roles:manage')" class="inline-flex items-center mb-2">
                     <input type="checkbox" v-model="newUser.isAdmin" class="form-checkbox">
                     <span class="ml-2">{{ $t('isAdmin') }}</span>
                 </label>
@@ -488,56 +765,149 @@ Vue.component('admin-panel', {
             </div>
             <div>
                 <h4 class="text-lg font-semibold mb-2">{{ $t('userList') }}</h4>
+                <div class="flex mb-4">
+                    <input v-model="userSearch" @keyup.enter="searchUsers" :placeholder="$t('searchUsers')" class="shadow appearance-none border rounded w-full py-2 px-3 text-gray-700 leading-tight focus:outline-none focus:shadow-outline mr-2">
+                    <select v-model="userStatus" @change="searchUsers" class="shadow border rounded py-2 px-3 text-gray-700 mr-2">
+                        <option value="">{{ $t('status_all') }}</option>
+                        <option v-for="status in userStatuses" :key="status" :value="status">{{ $t('status_' + status) }}</option>
+                    </select>
+                    <button @click="searchUsers" class="btn btn-blue px-4 py-2 rounded-lg shadow-md hover:shadow-lg transition duration-300">{{ $t('search') }}</button>
+                </div>
                 <table class="min-w-full divide-y divide-gray-200">
                     <thead class="bg-gray-50">
                         <tr>
                             <th class="px-6 py-3 text-left text-xs font-medium text-gray-500 uppercase tracking-wider">{{ $t('id') }}</th>
                             <th class="px-6 py-3 text-left text-xs font-medium text-gray-500 uppercase tracking-wider">{{ $t('username') }}</th>
-                            <th class="px-6 py-3 text-left text-xs font-medium text-gray-500 uppercase tracking-wider">{{ $t('isAdmin') }}</th>
+                            <th class="px-6 py-3 text-left text-xs font-medium text-gray-500 uppercase tracking-wider">{{ $t('role') }}</th>
+                            <th class="px-6 py-3 text-left text-xs font-medium text-gray-500 uppercase tracking-wider">{{ $t('activity') }}</th>
                             <th class="px-6 py-3 text-left text-xs font-medium text-gray-500 uppercase tracking-wider">{{ $t('actions') }}</th>
                         </tr>
                     </thead>
                     <tbody class="bg-white divide-y divide-gray-200">
                         <tr v-for="user in users" :key="user.ID">
                             <td class="px-6 py-4 whitespace-nowrap">{{ user.ID }}</td>
-                            <td class="px-6 py-4 whitespace-nowrap">{{ user.Username }}</td>
-                            <td class="px-6 py-4 whitespace-nowrap">{{ user.IsAdmin ? $t('isAdminYes') : $t('isAdminNo') }}</td>
                             <td class="px-6 py-4 whitespace-nowrap">
-                                <button @click="deleteUser(user.ID)" class="btn btn-red mr-2 px-4 py-2 rounded-lg shadow-md hover:shadow-lg transition duration-300">{{ $t('deleteUser') }}</button>
-                                <button @click="resetPassword(user.ID)" class="btn btn-green px-4 py-2 rounded-lg shadow-md hover:shadow-lg transition duration-300">{{ $t('resetPassword') }}</button>
+                                {{ user.Username }}
+                                <span v-if="user.Disabled" class="text-sm text-red-600">({{ $t(user.DisabledReason === 'suspended' ? 'status_suspended' : 'status_disabled') }})</span>
+                                <span v-if="user.TwoFactorEnabled" class="text-sm text-green-600">2FA</span>
+                            </td>
+                            <td class="px-6 py-4 whitespace-nowrap">
+                                <select v-if="can('roles:manage')" :value="user.Role" @change="setRole(user, $event.target.value)" class="shadow border rounded py-1 px-2 text-gray-700">
+                                    <option v-for="role in roleNames" :key="role" :value="role">{{ $t('role_' + (role || 'none')) }}</option>
+                                </select>
+                                <span v-else>{{ $t('role_' + (user.Role || 'none')) }}</span>
+                            </td>
+                            <td class="px-6 py-4 whitespace-nowrap text-sm text-gray-600">
+                                <div>{{ $t('createdAt') }}: {{ new Date(user.CreatedAt).toLocaleDateString() }}</div>
+                                <div>{{ $t('lastLogin') }}: {{ user.LastLoginAt ? new Date(user.LastLoginAt).toLocaleString() : '-' }}</div>
+                                <div>{{ $t('sessions') }}: {{ user.SessionCount }} · {{ $t('addresses') }}: {{ user.AddressCount }} · {{ $t('tokens') }}: {{ user.TokenCount }}</div>
+                            </td>
+                            <td class="px-6 py-4 whitespace-nowrap">
+                                <button v-if="can('users:delete')" @click="deleteUser(user.ID)" class="btn btn-red mr-2 px-4 py-2 rounded-lg shadow-md hover:shadow-lg transition duration-300">{{ $t('deleteUser') }}</button>
+                                <template v-if="canManage(user)">
+                                <button v-if="!user.AuthProvider" @click="renameUser(user)" class="btn btn-blue mr-2 px-4 py-2 rounded-lg shadow-md hover:shadow-lg transition duration-300">{{ $t('renameUser') }}</button>
+                                <button @click="resetPassword(user.ID)" class="btn btn-green mr-2 px-4 py-2 rounded-lg shadow-md hover:shadow-lg transition duration-300">{{ $t('resetPassword') }}</button>
+                                <button @click="toggleRequireTwoFactor(user)" class="btn btn-blue mr-2 px-4 py-2 rounded-lg shadow-md hover:shadow-lg transition duration-300">{{ user.TwoFactorRequired ? $t('unrequireTwoFactor') : $t('requireTwoFactor') }}</button>
+                                <button v-if="user.TwoFactorEnabled" @click="resetTwoFactor(user.ID)" class="btn btn-red px-4 py-2 rounded-lg shadow-md hover:shadow-lg transition duration-300">{{ $t('resetTwoFactor') }}</button>
+                                <button @click="createResetLink(user.ID)" class="btn btn-blue mr-2 px-4 py-2 rounded-lg shadow-md hover:shadow-lg transition duration-300">{{ $t('createResetLink') }}</button>
+                                <button v-if="user.LockedUntil" @click="unlockUser(user.ID)" class="btn btn-green ml-2 px-4 py-2 rounded-lg shadow-md hover:shadow-lg transition duration-300">{{ $t('unlockUser') }}</button>
+                                <button v-if="user.DisabledReason === 'suspended'" @click="reactivateUser(user.ID)" class="btn btn-green ml-2 px-4 py-2 rounded-lg shadow-md hover:shadow-lg transition duration-300">{{ $t('reactivateUser') }}</button>
+                                <button v-else-if="!user.Disabled" @click="suspendUser(user.ID)" class="btn btn-red ml-2 px-4 py-2 rounded-lg shadow-md hover:shadow-lg transition duration-300">{{ $t('suspendUser') }}</button>
+                                </template>
                             </td>
                         </tr>
                     </tbody>
                 </table>
+                <div class="flex items-center justify-between mt-4">
+                    <span class="text-sm text-gray-600">{{ $t('userCount', { total: userTotal }) }}</span>
+                    <div>
+                        <button :disabled="userPage <= 1" @click="changeUserPage(-1)" class="btn btn-blue mr-2 px-4 py-2 rounded-lg shadow-md hover:shadow-lg transition duration-300">{{ $t('previousPage') }}</button>
+                        <span class="text-sm text-gray-600 mr-2">{{ userPage }} / {{ userPageCount }}</span>
+                        <button :disabled="userPage >= userPageCount" @click="changeUserPage(1)" class="btn btn-blue px-4 py-2 rounded-lg shadow-md hover:shadow-lg transition duration-300">{{ $t('nextPage') }}</button>
+                    </div>
+                </div>
             </div>
         </div>
     `,
     data() {
         return {
             users: [],
+            userSearch: '',
+            userStatus: '',
+            userStatuses: ['active', 'suspended', 'pending', 'disabled', 'locked'],
+            userPage: 1,
+            userPageSize: 50,
+            userTotal: 0,
             newUser: {
                 username: '',
                 password: '',
                 isAdmin: false
             },
-            showCreateUserForm: false
+            showCreateUserForm: false,
+            roleNames: ['', 'admin', 'user-manager', 'auditor', 'token-manager', 'support']
         };
     },
+    computed: {
+        userPageCount() {
+            return Math.max(1, Math.ceil(this.userTotal / this.userPageSize));
+        }
+    },
     mounted() {
         this.fetchUsers();
     },
     methods: {
+        can(permission) {
+            return this.permissions.includes(permission);
+        },
+        // 拥有管理角色的账户只能由完整管理员操作
+        canManage(user) {
+            return this.can('users:manage') && (this.can('roles:manage') || !user.Role);
+        },
+        async setRole(user, role) {
+            try {
+                await axios.put(`/admin/user-role/${user.ID}`, { role }, {
+                    headers: { 'Authorization': localStorage.getItem('token') }
+                });
+            } catch (error) {
+                this.handleError('updateUserFailed', error);
+            }
+            this.fetchUsers();
+        },
         async fetchUsers() {
             try {
                 const response = await axios.get('/admin/users', {
+                    params: { search: this.userSearch, status: this.userStatus, page: this.userPage, page_size: this.userPageSize },
                     headers: { 'Authorization': localStorage.getItem('token') }
                 });
                 this.users = response.data.users;
+                this.userTotal = response.data.total;
             } catch (error) {
                 console.error(this.$t('fetchUsersFailed'), error);
                 alert(this.$t('fetchUsersFailed'));
             }
         },
+        searchUsers() {
+            this.userPage = 1;
+            this.fetchUsers();
+        },
+        changeUserPage(delta) {
+            this.userPage += delta;
+            this.fetchUsers();
+        },
+        async renameUser(user) {
+            const username = prompt(this.$t('newUsername'), user.Username);
+            if (!username || username === user.Username) {
+                return;
+            }
+            try {
+                await axios.put(`/admin/user/${user.ID}`, { username }, {
+                    headers: { 'Authorization': localStorage.getItem('token') }
+                });
+                this.fetchUsers();
+            } catch (error) {
+                this.handleError('updateUserFailed', error);
+            }
+        },
         async createUser() {
             try {
                 await axios.post('/admin/create-user', this.newUser, {
@@ -552,8 +922,10 @@ Vue.component('admin-panel', {
         },
         async deleteUser(userId) {
             if (confirm(this.$t('confirmDelete'))) {
+                // 默认保留地址和 Token，以便之后转移给其他用户
+                const mode = confirm(this.$t('confirmDeleteUserData')) ? 'cascade' : 'archive';
                 try {
-                    await axios.delete(`/admin/delete-user/${userId}`, {
+                    await axios.delete(`/admin/delete-user/${userId}?mode=${mode}`, {
                         headers: { 'Authorization': localStorage.getItem('token') }
                     });
                     alert(this.$t('userDeleted'));
@@ -575,6 +947,71 @@ Vue.component('admin-panel', {
                     this.handleError('passwordResetFailed', error);
                 }
             }
+        },
+        async toggleRequireTwoFactor(user) {
+            try {
+                await axios.post(`/admin/require-2fa/${user.ID}`, { required: !user.TwoFactorRequired }, {
+                    headers: { 'Authorization': localStorage.getItem('token') }
+                });
+                this.fetchUsers();
+            } catch (error) {
+                this.handleError('updateUserFailed', error);
+            }
+        },
+        async resetTwoFactor(userId) {
+            if (confirm(this.$t('confirmResetTwoFactor'))) {
+                try {
+                    await axios.post(`/admin/reset-2fa/${userId}`, {}, {
+                        headers: { 'Authorization': localStorage.getItem('token') }
+                    });
+                    this.fetchUsers();
+                } catch (error) {
+                    this.handleError('updateUserFailed', error);
+                }
+            }
+        },
+        async createResetLink(userId) {
+            try {
+                const response = await axios.post(`/admin/reset-link/${userId}`, {}, {
+                    headers: { 'Authorization': localStorage.getItem('token') }
+                });
+                prompt(this.$t('resetLinkCreated'), response.data.link);
+            } catch (error) {
+                this.handleError('passwordResetFailed', error);
+            }
+        },
+        async suspendUser(userId) {
+            if (!confirm(this.$t('confirmSuspendUser'))) {
+                return;
+            }
+            try {
+                await axios.post(`/admin/suspend-user/${userId}`, {}, {
+                    headers: { 'Authorization': localStorage.getItem('token') }
+                });
+                this.fetchUsers();
+            } catch (error) {
+                this.handleError('updateUserFailed', error);
+            }
+        },
+        async reactivateUser(userId) {
+            try {
+                await axios.post(`/admin/reactivate-user/${userId}`, {}, {
+                    headers: { 'Authorization': localStorage.getItem('token') }
+                });
+                this.fetchUsers();
+            } catch (error) {
+                this.handleError('updateUserFailed', error);
+            }
+        },
+        async unlockUser(userId) {
+            try {
+                await axios.post(`/admin/unlock-user/${userId}`, {}, {
+                    headers: { 'Authorization': localStorage.getItem('token') }
+                });
+                this.fetchUsers();
+            } catch (error) {
+                this.handleError('updateUserFailed', error);
+            }
         }
     }
 });
@@ -682,6 +1119,7 @@ Vue.component('change-password', {
                 <div v-if="!isPasswordValid" class="mb-4 text-red-500">
                     {{ $t('passwordRequirements') }}
                 </div>
+                <div v-if="policyError" class="mb-4 text-red-500">{{ policyError }}</div>
                 <div class="flex items-center justify-between">
                     <button class="bg-blue-500 hover:bg-blue-700 text-white font-bold py-2 px-4 rounded focus:outline-none focus:shadow-outline" 
                             type="submit" 
@@ -697,7 +1135,8 @@ Vue.component('change-password', {
         return {
             oldPassword: '',
             newPassword: '',
-            confirmPassword: ''
+            confirmPassword: '',
+            policyError: ''
         };
     },
     computed: {
@@ -711,6 +1150,7 @@ Vue.component('change-password', {
                 alert(this.$t('passwordMismatch'));
                 return;
             }
+            this.policyError = '';
             try {
                 await axios.post('/change-password', {
                     old_password: this.oldPassword,
@@ -725,6 +1165,11 @@ Vue.component('change-password', {
                 this.$emit('password-changed');
             } catch (error) {
                 console.error('修改密码失败:', error);
+                // 新密码不符合密码策略时显示服务端返回的原因
+                if (error.response && error.response.status === 400 && error.response.data.error) {
+                    this.policyError = error.response.data.error;
+                    return;
+                }
                 alert(this.$t('passwordChangeFailed'));
             }
         },
@@ -737,6 +1182,255 @@ Vue.component('change-password', {
     }
 });
 
+// 使用重置链接设置新密码
+Vue.component('password-reset-form', {
+    props: ['token'],
+    template: `
+        <div class="bg-white shadow-md rounded px-8 pt-6 pb-8 mb-4">
+            <h2 class="text-2xl font-bold mb-6 text-center">{{ $t('setNewPassword') }}</h2>
+            <form @submit.prevent="resetPassword">
+                <div class="mb-4">
+                    <input v-model="newPassword" type="password" class="shadow appearance-none border rounded w-full py-2 px-3 text-gray-700 leading-tight focus:outline-none focus:shadow-outline" :placeholder="$t('newPassword')" required>
+                </div>
+                <div class="mb-6">
+                    <input v-model="confirmPassword" type="password" class="shadow appearance-none border rounded w-full py-2 px-3 text-gray-700 leading-tight focus:outline-none focus:shadow-outline" :placeholder="$t('confirmPassword')" required>
+                </div>
+                <div v-if="errorMessage" class="mb-4 text-red-500">{{ errorMessage }}</div>
+                <div class="flex items-center justify-between">
+                    <button class="bg-blue-500 hover:bg-blue-700 text-white font-bold py-2 px-4 rounded focus:outline-none focus:shadow-outline" type="submit" :disabled="newPassword !== confirmPassword">
+                        {{ $t('changePasswordButton') }}
+                    </button>
+                    <a @click="$emit('done')" class="inline-block align-baseline font-bold text-sm text-blue-500 hover:text-blue-800 cursor-pointer">{{ $t('login') }}</a>
+                </div>
+            </form>
+        </div>
+    `,
+    data() {
+        return {
+            newPassword: '',
+            confirmPassword: '',
+            errorMessage: ''
+        };
+    },
+    methods: {
+        async resetPassword() {
+            this.errorMessage = '';
+            try {
+                await axios.post('/password-reset', { token: this.token, new_password: this.newPassword });
+                alert(this.$t('passwordChanged'));
+                this.$emit('done');
+            } catch (error) {
+                console.error(this.$t('passwordChangeFailed'), error);
+                if (error.response && error.response.data.error) {
+                    this.errorMessage = error.response.data.error;
+                    return;
+                }
+                alert(this.$t('passwordChangeFailed'));
+            }
+        }
+    }
+});
+
+// 两步验证设置组件
+Vue.component('two-factor-settings', {
+    props: ['user'],
+    template: `
+        <div class="bg-white shadow-md rounded px-8 pt-6 pb-8 mb-4">
+            <h2 class="text-2xl font-bold mb-6">{{ $t('twoFactorAuth') }}</h2>
+            <div v-if="user.needsTwoFactorSetup" class="mb-4 p-4 bg-yellow-100 border-l-4 border-yellow-500 text-yellow-700">
+                {{ $t('twoFactorSetupRequired') }}
+            </div>
+            <div v-if="recoveryCodes.length" class="mb-4 p-4 bg-green-100 border-l-4 border-green-500 text-green-700">
+                <p class="mb-2">{{ $t('recoveryCodesHint') }}</p>
+                <pre class="font-mono">{{ recoveryCodes.join('\\n') }}</pre>
+            </div>
+            <div v-if="status.enabled">
+                <p class="mb-4">{{ $t('twoFactorEnabled') }} ({{ $t('recoveryCodesRemaining') }}: {{ status.recovery_codes_remaining }})</p>
+                <div class="mb-4">
+                    <input v-model="code" type="text" autocomplete="one-time-code" class="shadow appearance-none border rounded w-full py-2 px-3 text-gray-700 leading-tight focus:outline-none focus:shadow-outline" :placeholder="$t('twoFactorCode')">
+                </div>
+                <button @click="regenerateCodes" class="btn btn-blue mr-2">{{ $t('regenerateRecoveryCodes') }}</button>
+                <button @click="disable" class="btn btn-red">{{ $t('disableTwoFactor') }}</button>
+            </div>
+            <div v-else-if="secret">
+                <p class="mb-2">{{ $t('twoFactorScanHint') }}</p>
+                <p class="mb-2 font-mono break-all">{{ secret }}</p>
+                <p class="mb-4 text-sm text-gray-600 break-all">{{ provisioningUri }}</p>
+                <div class="mb-4">
+                    <input v-model="code" type="text" autocomplete="one-time-code" class="shadow appearance-none border rounded w-full py-2 px-3 text-gray-700 leading-tight focus:outline-none focus:shadow-outline" :placeholder="$t('twoFactorCode')">
+                </div>
+                <button @click="enable" class="btn btn-green">{{ $t('enableTwoFactor') }}</button>
+            </div>
+            <div v-else>
+                <p class="mb-4">{{ $t('twoFactorDisabled') }}</p>
+                <button @click="setup" class="btn btn-green">{{ $t('setupTwoFactor') }}</button>
+            </div>
+            <h3 class="text-xl font-bold mt-8 mb-4">{{ $t('securityKeys') }}</h3>
+            <ul class="mb-4">
+                <li v-for="key in securityKeys" :key="key.ID" class="flex justify-between items-center py-2 border-b">
+                    <span>{{ key.Name }} <span class="text-sm text-gray-500">{{ $t('lastUsed') }}: {{ key.LastUsedAt ? new Date(key.LastUsedAt).toLocaleString() : '-' }}</span></span>
+                    <span>
+                        <button @click="renameSecurityKey(key)" class="btn btn-blue mr-2">{{ $t('rename') }}</button>
+                        <button @click="deleteSecurityKey(key)" class="btn btn-red">{{ $t('delete') }}</button>
+                    </span>
+                </li>
+            </ul>
+            <button @click="addSecurityKey" class="btn btn-green">{{ $t('addSecurityKey') }}</button>
+            <button v-if="!user.needsTwoFactorSetup" @click="$emit('back')" class="mt-4 text-blue-500 hover:text-blue-800">{{ $t('back') }}</button>
+        </div>
+    `,
+    data() {
+        return {
+            securityKeys: [],
+            status: { enabled: false, recovery_codes_remaining: 0 },
+            secret: '',
+            provisioningUri: '',
+            code: '',
+            recoveryCodes: []
+        };
+    },
+    mounted() {
+        this.fetchStatus();
+        this.fetchSecurityKeys();
+    },
+    methods: {
+        authHeaders() {
+            return { headers: { 'Authorization': localStorage.getItem('token') } };
+        },
+        handleError(errorKey, error) {
+            console.error(this.$t(errorKey), error);
+            alert(this.$t(errorKey));
+        },
+        async fetchStatus() {
+            try {
+                const response = await axios.get('/2fa/status', this.authHeaders());
+                this.status = response.data;
+            } catch (error) {
+                this.handleError('twoFactorFailed', error);
+            }
+        },
+        async setup() {
+            const password = prompt(this.$t('enterPasswordToContinue'));
+            // 单点登录用户没有密码，可以留空
+            if (password === null) {
+                return;
+            }
+            try {
+                const response = await axios.post('/2fa/setup', { password }, this.authHeaders());
+                this.secret = response.data.secret;
+                this.provisioningUri = response.data.provisioning_uri;
+            } catch (error) {
+                this.handleError('twoFactorFailed', error);
+            }
+        },
+        async enable() {
+            try {
+                const response = await axios.post('/2fa/enable', { code: this.code.trim() }, this.authHeaders());
+                this.recoveryCodes = response.data.recovery_codes;
+                this.secret = '';
+                this.code = '';
+                await this.fetchStatus();
+                this.$emit('two-factor-changed');
+            } catch (error) {
+                this.handleError('twoFactorFailed', error);
+            }
+        },
+        async disable() {
+            const password = prompt(this.$t('enterPasswordToContinue'));
+            // 单点登录用户没有密码，可以留空
+            if (password === null) {
+                return;
+            }
+            try {
+                await axios.post('/2fa/disable', { password, code: this.code.trim() }, this.authHeaders());
+                this.code = '';
+                this.recoveryCodes = [];
+                await this.fetchStatus();
+                this.$emit('two-factor-changed');
+            } catch (error) {
+                this.handleError('twoFactorFailed', error);
+            }
+        },
+        async regenerateCodes() {
+            try {
+                const response = await axios.post('/2fa/recovery-codes', { code: this.code.trim() }, this.authHeaders());
+                this.recoveryCodes = response.data.recovery_codes;
+                this.code = '';
+                await this.fetchStatus();
+            } catch (error) {
+                this.handleError('twoFactorFailed', error);
+            }
+        },
+        async fetchSecurityKeys() {
+            try {
+                const response = await axios.get('/webauthn/credentials', this.authHeaders());
+                this.securityKeys = response.data.credentials;
+            } catch (error) {
+                this.handleError('securityKeyFailed', error);
+            }
+        },
+        async addSecurityKey() {
+            const password = prompt(this.$t('enterPasswordToContinue'));
+            // 单点登录用户没有密码，可以留空
+            if (password === null) {
+                return;
+            }
+            const name = prompt(this.$t('securityKeyName'), 'Security Key');
+            if (!name) {
+                return;
+            }
+            try {
+                const options = await axios.post('/webauthn/register/options', { password }, this.authHeaders());
+                const publicKey = options.data.publicKey;
+                publicKey.challenge = base64urlToBuffer(publicKey.challenge);
+                publicKey.user.id = base64urlToBuffer(publicKey.user.id);
+                publicKey.excludeCredentials = publicKey.excludeCredentials.map(c => Object.assign({}, c, { id: base64urlToBuffer(c.id) }));
+                const credential = await navigator.credentials.create({ publicKey });
+                await axios.post('/webauthn/register', {
+                    name,
+                    credential: {
+                        id: credential.id,
+                        type: credential.type,
+                        response: {
+                            clientDataJSON: bufferToBase64url(credential.response.clientDataJSON),
+                            attestationObject: bufferToBase64url(credential.response.attestationObject),
+                            transports: credential.response.getTransports ? credential.response.getTransports() : []
+                        }
+                    }
+                }, this.authHeaders());
+                await this.fetchSecurityKeys();
+                this.$emit('two-factor-changed');
+            } catch (error) {
+                this.handleError('securityKeyFailed', error);
+            }
+        },
+        async renameSecurityKey(key) {
+            const name = prompt(this.$t('securityKeyName'), key.Name);
+            if (!name) {
+                return;
+            }
+            try {
+                await axios.put(`/webauthn/credential/${key.ID}`, { name }, this.authHeaders());
+                await this.fetchSecurityKeys();
+            } catch (error) {
+                this.handleError('securityKeyFailed', error);
+            }
+        },
+        async deleteSecurityKey(key) {
+            if (!confirm(this.$t('confirmDeleteSecurityKey'))) {
+                return;
+            }
+            try {
+                await axios.delete(`/webauthn/credential/${key.ID}`, this.authHeaders());
+                await this.fetchSecurityKeys();
+                this.$emit('two-factor-changed');
+            } catch (error) {
+                this.handleError('securityKeyFailed', error);
+            }
+        }
+    }
+});
+
 // 修改 Vue 实例
 new Vue({
     i18n,
@@ -748,13 +1442,45 @@ new Vue({
         showTokenPage: false,
         showAddressConverter: false,
         showChangePassword: false,
-        showAdminChangePassword: false
+        showAdminChangePassword: false,
+        showTwoFactor: false,
+        resetToken: ''
     },
     mounted() {
+        this.handleResetLink();
+        this.handleSSORedirect();
         this.checkAuth();
         document.title = this.$t('title');
     },
     methods: {
+        // 管理员生成的重置密码链接通过 URL 片段传入一次性凭证
+        handleResetLink() {
+            const params = new URLSearchParams(window.location.hash.substring(1));
+            if (!params.has('reset_token')) {
+                return;
+            }
+            this.resetToken = params.get('reset_token');
+            history.replaceState(null, '', window.location.pathname);
+        },
+        // 单点登录回调后，一次性登录凭证或错误信息通过 URL 片段传回
+        async handleSSORedirect() {
+            const params = new URLSearchParams(window.location.hash.substring(1));
+            if (!params.has('sso_token') && !params.has('sso_error')) {
+                return;
+            }
+            history.replaceState(null, '', window.location.pathname);
+            if (params.has('sso_error')) {
+                alert(this.$t('ssoFailed') + ': ' + params.get('sso_error'));
+                return;
+            }
+            try {
+                const response = await axios.post('/login/sso', { sso_token: params.get('sso_token') });
+                this.onLoginSuccess(response.data.user, response.data.token);
+            } catch (error) {
+                console.error(this.$t('ssoFailed'), error);
+                alert(this.$t('ssoFailed'));
+            }
+        },
         async checkAuth() {
             const token = localStorage.getItem('token');
             if (token) {
@@ -764,18 +1490,40 @@ new Vue({
                     });
                     this.loggedIn = true;
                     this.currentUser = response.data.user;
+                    return;
                 } catch (error) {
-                    this.handleError('authFailed', error);
                     localStorage.removeItem('token');
+                    if (!await this.proxyLogin()) {
+                        this.handleError('authFailed', error);
+                    }
+                    return;
                 }
             }
+            await this.proxyLogin();
+        },
+        // 部署在认证代理之后时，用代理转发的身份直接换取会话
+        async proxyLogin() {
+            try {
+                const response = await axios.post('/login/proxy');
+                this.onLoginSuccess(response.data.user, response.data.token);
+                return true;
+            } catch (error) {
+                return false;
+            }
         },
         onLoginSuccess(user, token) {
             this.loggedIn = true;
             this.currentUser = user;
             localStorage.setItem('token', token);
         },
-        onLogout() {
+        async onLogout() {
+            try {
+                await axios.post('/logout', {}, {
+                    headers: { 'Authorization': localStorage.getItem('token') }
+                });
+            } catch (error) {
+                console.error(this.$t('logoutFailed'), error);
+            }
             this.loggedIn = false;
             this.currentUser = null;
             this.showLogin = true;
@@ -813,6 +1561,21 @@ new Vue({
         hidePasswordChange() {
             this.showChangePassword = false;
         },
+        async onPasswordChanged() {
+            await this.checkAuth();
+        },
+        showTwoFactorSettings() {
+            this.showTwoFactor = true;
+            this.showChangePassword = false;
+            this.showTokenPage = false;
+            this.showAddressConverter = false;
+        },
+        hideTwoFactorSettings() {
+            this.showTwoFactor = false;
+        },
+        async onTwoFactorChanged() {
+            await this.checkAuth();
+        },
         showAdminPasswordChange() {
             this.showAdminChangePassword = true;
         },
@@ -829,7 +1592,10 @@ new Vue({
                 </button>
             </div>
             <div v-if="!loggedIn">
-                <div v-if="showLogin">
+                <div v-if="resetToken">
+                    <password-reset-form :token="resetToken" @done="resetToken = ''"></password-reset-form>
+                </div>
+                <div v-else-if="showLogin">
                     <login-form @login-success="onLoginSuccess" @switch-to-register="showLogin = false"></login-form>
                 </div>
                 <div v-else>
@@ -840,12 +1606,20 @@ new Vue({
                 <div class="bg-white shadow-md rounded px-8 py-4 flex justify-between items-center mb-8">
                     <h2 class="text-xl font-semibold">{{ $t('welcome') }}, {{ currentUser.username }}</h2>
                     <div>
+                        <button @click="showTwoFactorSettings" class="btn btn-blue mr-2">{{ $t('twoFactorAuth') }}</button>
                         <button @click="showPasswordChange" class="btn btn-blue mr-2">{{ $t('changePassword') }}</button>
                         <button @click="onLogout" class="btn btn-red">{{ $t('logout') }}</button>
                     </div>
                 </div>
-                <div v-if="currentUser.isAdmin && !showChangePassword">
-                    <admin-panel></admin-panel>
+                <div v-if="currentUser.needsPasswordReset">
+                    <p class="mb-4 text-red-500">{{ $t('passwordChangeRequired') }}</p>
+                    <change-password @password-changed="onPasswordChanged" @back="onLogout"></change-password>
+                </div>
+                <div v-else-if="currentUser.needsTwoFactorSetup || showTwoFactor">
+                    <two-factor-settings :user="currentUser" @two-factor-changed="onTwoFactorChanged" @back="hideTwoFactorSettings"></two-factor-settings>
+                </div>
+                <div v-else-if="currentUser.permissions && currentUser.permissions.length && !showChangePassword">
+                    <admin-panel :permissions="currentUser.permissions"></admin-panel>
                 </div>
                 <div v-else-if="!showTokenPage && !showAddressConverter && !showChangePassword" class="grid grid-cols-1 gap-8">
                     <address-generator @address-generated="onAddressGenerated" class="mb-8"></address-generator>
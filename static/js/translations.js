@@ -59,8 +59,11 @@ const translations = {
         changePasswordButton: 'Change Password',
         passwordChanged: 'Password changed successfully',
         passwordChangeFailed: 'Failed to change password, please try again',
+        passwordChangeRequired: 'You must choose a new password before continuing.',
         passwordMismatch: 'Passwords do not match or are too short (minimum 8 characters)',
         registerSuccess: 'Registration successful, please login',
+        registerPendingApproval: 'Registration received. You can log in once an administrator has approved your account.',
+        inviteCode: 'Invite code (if you have one)',
         registerFailed: 'Registration failed, please try again later',
         loginFailed: 'Login failed, please check your username and password',
         tokenRequired: 'Please select a Token',
@@ -105,11 +108,93 @@ const translations = {
         logoutSuccess: 'Logged out successfully',
         confirmDeleteAddress: 'Are you sure you want to delete this address?',
         passwordResetFailed: 'Failed to reset password, please try again',
+        organizationToken: 'Shared token',
+        share: 'Share',
+        sharedWithMe: 'Shared with me',
+        sharedBy: 'Shared by',
+        editRecipient: 'Edit recipient',
+        removeShare: 'Remove',
+        shareWithUsername: 'Username to share this alias with',
+        shareAllowEdit: 'Allow this user to change the recipient? (Cancel = view only)',
+        addressShared: 'Alias shared',
+        shareAddressFailed: 'Failed to update sharing',
+        searchUsers: 'Search by username',
+        search: 'Search',
+        status_all: 'All users',
+        status_active: 'Active',
+        status_suspended: 'Suspended',
+        status_pending: 'Pending approval',
+        status_disabled: 'Disabled',
+        status_locked: 'Locked',
+        activity: 'Activity',
+        createdAt: 'Created',
+        lastLogin: 'Last login',
+        sessions: 'Sessions',
+        addresses: 'Aliases',
+        tokens: 'Tokens',
+        renameUser: 'Rename',
+        userCount: '{total} users',
+        previousPage: 'Previous',
+        nextPage: 'Next',
+        aliasQuota: 'Aliases: {used} / {limit}',
+        dailyAliasQuota: 'Today: {used} / {limit}',
+        suspendUser: 'Suspend',
+        reactivateUser: 'Reactivate',
+        confirmSuspendUser: 'Suspend this user? They are logged out and cannot log in until reactivated.',
+        confirmDeleteUserData: 'Also delete the aliases and tokens of this user? (Cancel keeps them so they can be transferred)',
+        role: 'Role',
+        role_none: 'User',
+        role_admin: 'Administrator',
+        'role_user-manager': 'User manager',
+        role_auditor: 'Auditor',
+        'role_token-manager': 'Token manager',
+        role_support: 'Support (read-only)',
         isAdminYes: 'Yes',
         isAdminNo: 'No',
         hideCreateUserForm: 'Hide Create User Form',
         logout: 'Logout',
         logoutFailed: 'Logout failed',
+        reenterPassword: 'Please enter your password to reveal this token',
+        revealTokenFailed: 'Failed to reveal token, please check your password',
+        defaultToken: '(default)',
+        setDefault: 'Set Default',
+        setDefaultTokenFailed: 'Failed to set default token',
+        verify: 'Verify',
+        twoFactorAuth: 'Two-Factor Authentication',
+        twoFactorCode: 'Code from your authenticator app',
+        twoFactorCodeOrRecovery: 'Authenticator code or recovery code',
+        twoFactorFailed: 'Two-factor verification failed, please try again',
+        twoFactorSetupRequired: 'Your account requires two-factor authentication. Please set it up to continue.',
+        twoFactorEnabled: 'Two-factor authentication is enabled',
+        twoFactorDisabled: 'Two-factor authentication is not enabled',
+        twoFactorScanHint: 'Add this secret to your authenticator app, then enter the code it shows:',
+        setupTwoFactor: 'Set Up Two-Factor',
+        enableTwoFactor: 'Enable',
+        disableTwoFactor: 'Disable Two-Factor',
+        regenerateRecoveryCodes: 'Regenerate Recovery Codes',
+        recoveryCodesHint: 'Save these recovery codes somewhere safe. Each code can be used once and they will not be shown again.',
+        recoveryCodesRemaining: 'recovery codes left',
+        enterPasswordToContinue: 'Please enter your password to continue',
+        requireTwoFactor: 'Require 2FA',
+        unrequireTwoFactor: 'Don\'t Require 2FA',
+        resetTwoFactor: 'Reset 2FA',
+        unlockUser: 'Unlock',
+        createResetLink: 'Reset link',
+        resetLinkCreated: 'Send this one-time link to the user:',
+        setNewPassword: 'Set a new password',
+        confirmResetTwoFactor: 'Remove this user\'s two-factor authentication?',
+        updateUserFailed: 'Failed to update user',
+        loginWithPasskey: 'Sign in with Passkey',
+        useSecurityKey: 'Use Security Key',
+        securityKeys: 'Security Keys & Passkeys',
+        addSecurityKey: 'Add Security Key',
+        securityKeyName: 'Name for this security key',
+        securityKeyFailed: 'Security key operation failed',
+        confirmDeleteSecurityKey: 'Remove this security key?',
+        lastUsed: 'Last used',
+        rename: 'Rename',
+        loginWithSSO: 'Sign in with {name}',
+        ssoFailed: 'Single sign-on failed',
     },
     zh: {
         title: 'DuckDuckGo 邮箱别名管理系统',
@@ -171,8 +256,11 @@ const translations = {
         changePasswordButton: '修改密码',
         passwordChanged: '密码修改成功',
         passwordChangeFailed: '密码修改失败，请重试',
+        passwordChangeRequired: '请先设置新密码再继续使用。',
         passwordMismatch: '密码不匹配或太短（最少8个字符）',
         registerSuccess: '注册成功，请登录',
+        registerPendingApproval: '注册申请已提交，管理员批准后即可登录。',
+        inviteCode: '邀请码（如有）',
         registerFailed: '注册失败，请稍后重试',
         loginFailed: '登录失败，请检查用户名和密码',
         tokenRequired: '请选择一个Token',
@@ -217,10 +305,92 @@ const translations = {
         logoutSuccess: '登出成功',
         confirmDeleteAddress: '确定要删除这个地址吗？',
         passwordResetFailed: '重置密码失败，请重试',
+        organizationToken: '共享 Token',
+        share: '共享',
+        sharedWithMe: '共享给我的',
+        sharedBy: '共享者',
+        editRecipient: '修改收件地址',
+        removeShare: '移除',
+        shareWithUsername: '要共享给的用户名',
+        shareAllowEdit: '是否允许该用户修改收件地址？（取消 = 只读）',
+        addressShared: '地址已共享',
+        shareAddressFailed: '更新共享失败',
+        searchUsers: '按用户名搜索',
+        search: '搜索',
+        status_all: '全部用户',
+        status_active: '正常',
+        status_suspended: '已暂停',
+        status_pending: '待审批',
+        status_disabled: '已停用',
+        status_locked: '已锁定',
+        activity: '活动',
+        createdAt: '创建时间',
+        lastLogin: '最后登录',
+        sessions: '会话',
+        addresses: '地址',
+        tokens: 'Token',
+        renameUser: '重命名',
+        userCount: '共 {total} 个用户',
+        previousPage: '上一页',
+        nextPage: '下一页',
+        aliasQuota: '地址：{used} / {limit}',
+        dailyAliasQuota: '今日：{used} / {limit}',
+        suspendUser: '暂停',
+        reactivateUser: '恢复',
+        confirmSuspendUser: '确定暂停该用户吗？该用户将被退出登录，恢复前无法登录。',
+        confirmDeleteUserData: '是否同时删除该用户的地址和 Token？（取消则保留，以便转移给其他用户）',
+        role: '角色',
+        role_none: '普通用户',
+        role_admin: '管理员',
+        'role_user-manager': '用户管理员',
+        role_auditor: '审计员',
+        'role_token-manager': 'Token 管理员',
+        role_support: '支持人员（只读）',
         isAdminYes: '是',
         isAdminNo: '否',
         hideCreateUserForm: '隐藏创建用户表单',
         logout: '登出',
         logoutFailed: '登出失败',
+        reenterPassword: '请输入密码以查看此 Token',
+        revealTokenFailed: '查看 Token 失败，请检查密码',
+        defaultToken: '（默认）',
+        setDefault: '设为默认',
+        setDefaultTokenFailed: '设置默认 Token 失败',
+        verify: '验证',
+        twoFactorAuth: '两步验证',
+        twoFactorCode: '验证器应用中的验证码',
+        twoFactorCodeOrRecovery: '验证码或恢复码',
+        twoFactorFailed: '两步验证失败，请重试',
+        twoFactorSetupRequired: '您的账户需要开启两步验证，请先完成设置。',
+        twoFactorEnabled: '已开启两步验证',
+        twoFactorDisabled: '尚未开启两步验证',
+        twoFactorScanHint: '将以下密钥添加到验证器应用中，然后输入应用显示的验证码：',
+        setupTwoFactor: '设置两步验证',
+        enableTwoFactor: '开启',
+        disableTwoFactor: '关闭两步验证',
+        regenerateRecoveryCodes: '重新生成恢复码',
+        recoveryCodesHint: '请妥善保存以下恢复码，每个恢复码只能使用一次，且不会再次显示。',
+        recoveryCodesRemaining: '剩余恢复码',
+        enterPasswordToContinue: '请输入密码以继续',
+        requireTwoFactor: '要求两步验证',
+        unrequireTwoFactor: '取消要求两步验证',
+        resetTwoFactor: '重置两步验证',
+        unlockUser: '解除锁定',
+        createResetLink: '重置链接',
+        resetLinkCreated: '请将此一次性链接发送给用户：',
+        setNewPassword: '设置新密码',
+        confirmResetTwoFactor: '确定要清除该用户的两步验证吗？',
+        updateUserFailed: '更新用户失败',
+        loginWithPasskey: '使用通行密钥登录',
+        useSecurityKey: '使用安全密钥',
+        securityKeys: '安全密钥与通行密钥',
+        addSecurityKey: '添加安全密钥',
+        securityKeyName: '为该安全密钥命名',
+        securityKeyFailed: '安全密钥操作失败',
+        confirmDeleteSecurityKey: '确定要删除这个安全密钥吗？',
+        lastUsed: '上次使用',
+        rename: '重命名',
+        loginWithSSO: '使用 {name} 登录',
+        ssoFailed: '单点登录失败',
     }
 };